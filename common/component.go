@@ -8,6 +8,8 @@ import (
 	"github.com/cloudfoundry/yagnats"
 	"net/http"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,6 +19,9 @@ var varz *Varz
 
 var procStat *ProcessStatus
 
+// Guards the credentials of running components
+var credentialsLock sync.RWMutex
+
 type VcapComponent struct {
 	// These fields are from individual components
 	Type        string                    `json:"type"`
@@ -108,8 +113,11 @@ func StartComponent(c *VcapComponent) {
 
 func Register(c *VcapComponent, mbusClient *yagnats.Client) {
 	mbusClient.Subscribe("vcap.component.discover", func(msg *yagnats.Message) {
+		credentialsLock.RLock()
 		Component.Uptime = Component.Start.Elapsed()
 		b, e := json.Marshal(Component)
+		credentialsLock.RUnlock()
+
 		if e != nil {
 			log.Warnf(e.Error())
 			return
@@ -133,10 +141,16 @@ func (c *VcapComponent) ListenAndServe() {
 	hs := http.NewServeMux()
 
 	hs.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		healthz := UpdateHealthz()
+
 		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusOK)
+		if healthz.IsDraining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
 
-		fmt.Fprintf(w, UpdateHealthz().Value())
+		fmt.Fprintf(w, healthz.Value())
 	})
 
 	hs.HandleFunc("/varz", func(w http.ResponseWriter, req *http.Request) {
@@ -147,7 +161,22 @@ func (c *VcapComponent) ListenAndServe() {
 		enc.Encode(UpdateVarz())
 	})
 
+	hs.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(http.StatusOK)
+
+		m := NewMetricsWriter(w, strings.ToLower(Component.Type))
+
+		varz := UpdateVarz()
+		varz.Lock()
+		varz.WriteMetrics(m)
+		varz.Unlock()
+
+		m.Flush()
+	})
+
 	for path, marshaler := range c.InfoRoutes {
+		marshaler := marshaler
 		hs.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusOK)
@@ -158,6 +187,9 @@ func (c *VcapComponent) ListenAndServe() {
 	}
 
 	f := func(user, password string) bool {
+		credentialsLock.RLock()
+		defer credentialsLock.RUnlock()
+
 		return user == c.Credentials[0] && password == c.Credentials[1]
 	}
 
@@ -171,3 +203,13 @@ func (c *VcapComponent) ListenAndServe() {
 		panic(err)
 	}
 }
+
+// SetCredentials changes the credentials of a running component's status
+// endpoints and the ones it announces.
+func (c *VcapComponent) SetCredentials(user, password string) {
+	credentialsLock.Lock()
+	defer credentialsLock.Unlock()
+
+	c.Credentials = []string{user, password}
+	Component.Credentials = c.Credentials
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"runtime"
+	"strings"
 )
 
 type ComponentSuite struct {
@@ -86,6 +87,46 @@ func (s *ComponentSuite) TestInfoRouteAccessNonExistent(c *C) {
 	c.Check(code, Equals, 404)
 }
 
+func (s *ComponentSuite) TestSetCredentials(c *C) {
+	path := "/test"
+
+	s.Component.InfoRoutes = map[string]json.Marshaler{
+		path: &MarshalableValue{Value: map[string]string{"key": "value"}},
+	}
+	s.serveComponent(c)
+
+	s.Component.SetCredentials("new-username", "new-password")
+
+	req := s.buildGetRequest(c, path)
+	req.SetBasicAuth("username", "password")
+	code, _, _ := s.doGetRequest(c, req)
+	c.Check(code, Equals, 401)
+
+	req = s.buildGetRequest(c, path)
+	req.SetBasicAuth("new-username", "new-password")
+	code, _, _ = s.doGetRequest(c, req)
+	c.Check(code, Equals, 200)
+}
+
+func (s *ComponentSuite) TestMetrics(c *C) {
+	Component.Type = "Router"
+	defer func() { Component = VcapComponent{} }()
+
+	varz = &Varz{GenericVarz: GenericVarz{NumCores: 4}}
+	procStat = &ProcessStatus{MemRss: 2}
+
+	s.serveComponent(c)
+
+	req := s.buildGetRequest(c, "/metrics")
+	req.SetBasicAuth("username", "password")
+
+	code, header, body := s.doGetRequest(c, req)
+	c.Check(code, Equals, 200)
+	c.Check(header.Get("Content-Type"), Equals, "text/plain; version=0.0.4")
+	c.Check(strings.Contains(body, "\nrouter_num_cores 4\n"), Equals, true)
+	c.Check(strings.Contains(body, "\nrouter_memory_rss_bytes 2048\n"), Equals, true)
+}
+
 func (s *ComponentSuite) serveComponent(c *C) {
 	go s.Component.ListenAndServe()
 
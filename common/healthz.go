@@ -1,5 +1,9 @@
 package common
 
+import (
+	"sync/atomic"
+)
+
 type Lockable interface {
 	Lock()
 	Unlock()
@@ -7,8 +11,24 @@ type Lockable interface {
 
 type Healthz struct {
 	LockableObject Lockable
+
+	draining int32
+}
+
+// Drain makes the component report itself as unhealthy from now on, so that
+// load balancers stop sending it traffic.
+func (v *Healthz) Drain() {
+	atomic.StoreInt32(&v.draining, 1)
+}
+
+func (v *Healthz) IsDraining() bool {
+	return atomic.LoadInt32(&v.draining) != 0
 }
 
 func (v *Healthz) Value() string {
+	if v.IsDraining() {
+		return "draining"
+	}
+
 	return "ok"
 }
@@ -27,3 +27,14 @@ func (s *HealthzSuite) TestJsonMarshal(c *C) {
 	ok := healthz.Value()
 	c.Assert(ok, Equals, "ok")
 }
+
+func (s *HealthzSuite) TestDrain(c *C) {
+	healthz := &Healthz{
+		LockableObject: &sync.Mutex{},
+	}
+	c.Check(healthz.IsDraining(), Equals, false)
+
+	healthz.Drain()
+	c.Check(healthz.IsDraining(), Equals, true)
+	c.Check(healthz.Value(), Equals, "draining")
+}
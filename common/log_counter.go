@@ -32,6 +32,19 @@ func (lc *LogCounter) GetCount(key string) int {
 	return lc.counts[key]
 }
 
+// Counts returns a copy of the number of records logged at each level.
+func (lc *LogCounter) Counts() map[string]int {
+	lc.Lock()
+	defer lc.Unlock()
+
+	counts := make(map[string]int, len(lc.counts))
+	for level, count := range lc.counts {
+		counts[level] = count
+	}
+
+	return counts
+}
+
 func (lc *LogCounter) Flush()                     {}
 func (lc *LogCounter) SetCodec(codec steno.Codec) {}
 
@@ -0,0 +1,162 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricsCollector is implemented by components exporting metrics besides the
+// generic ones on the /metrics endpoint.
+type MetricsCollector interface {
+	WriteMetrics(m *MetricsWriter)
+}
+
+type Labels map[string]string
+
+// MetricsWriter writes metrics in the Prometheus text exposition format. The
+// samples of a metric have to be written one after the other, and their HELP
+// and TYPE lines are written along with the first one.
+type MetricsWriter struct {
+	namespace string
+	w         *bufio.Writer
+	written   map[string]bool
+}
+
+func NewMetricsWriter(w io.Writer, namespace string) *MetricsWriter {
+	return &MetricsWriter{
+		namespace: namespace,
+		w:         bufio.NewWriter(w),
+		written:   make(map[string]bool),
+	}
+}
+
+func (m *MetricsWriter) Counter(name, help string, value float64, labels Labels) {
+	name = m.header(name, "counter", help)
+	m.sample(name, labels, "", "", value)
+}
+
+func (m *MetricsWriter) Gauge(name, help string, value float64, labels Labels) {
+	name = m.header(name, "gauge", help)
+	m.sample(name, labels, "", "", value)
+}
+
+func (m *MetricsWriter) Histogram(name, help string, h *Histogram, labels Labels) {
+	name = m.header(name, "histogram", help)
+
+	var count int64
+	for i, bound := range h.upperBounds {
+		count += h.counts[i]
+		m.sample(name+"_bucket", labels, "le", formatFloat(bound), float64(count))
+	}
+
+	count += h.counts[len(h.upperBounds)]
+	m.sample(name+"_bucket", labels, "le", "+Inf", float64(count))
+	m.sample(name+"_sum", labels, "", "", h.sum)
+	m.sample(name+"_count", labels, "", "", float64(count))
+}
+
+func (m *MetricsWriter) Flush() error {
+	return m.w.Flush()
+}
+
+func (m *MetricsWriter) header(name, kind, help string) string {
+	if m.namespace != "" {
+		name = m.namespace + "_" + name
+	}
+
+	if !m.written[name] {
+		m.written[name] = true
+
+		fmt.Fprintf(m.w, "# HELP %s %s\n", name, escapeHelp(help))
+		fmt.Fprintf(m.w, "# TYPE %s %s\n", name, kind)
+	}
+
+	return name
+}
+
+// sample writes a line for the named sample with the given labels, plus an
+// extra one (like a histogram's bucket bound) if extraName isn't empty.
+func (m *MetricsWriter) sample(name string, labels Labels, extraName, extraValue string, value float64) {
+	pairs := make([]string, 0, len(labels)+1)
+	for k, v := range labels {
+		pairs = append(pairs, k+`="`+escapeLabelValue(v)+`"`)
+	}
+	sort.Strings(pairs)
+
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+
+	m.w.WriteString(name)
+	if len(pairs) > 0 {
+		m.w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	m.w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Histogram counts observations in buckets with fixed upper bounds, as
+// exported by Prometheus histograms. It isn't safe for concurrent use.
+type Histogram struct {
+	upperBounds []float64
+
+	// One more than the upper bounds, for observations above the last one
+	counts []int64
+	sum    float64
+}
+
+// NewHistogram returns a histogram with the given upper bounds, which must be
+// sorted in increasing order.
+func NewHistogram(upperBounds []float64) *Histogram {
+	return &Histogram{
+		upperBounds: upperBounds,
+		counts:      make([]int64, len(upperBounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	h.counts[i]++
+	h.sum += v
+}
+
+func (h *Histogram) Count() int64 {
+	var count int64
+	for _, c := range h.counts {
+		count += c
+	}
+
+	return count
+}
+
+func (h *Histogram) Sum() float64 {
+	return h.sum
+}
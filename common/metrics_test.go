@@ -0,0 +1,70 @@
+package common
+
+import (
+	"bytes"
+	"math"
+
+	. "launchpad.net/gocheck"
+)
+
+type MetricsSuite struct{}
+
+var _ = Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) TestCountersAndGauges(c *C) {
+	var b bytes.Buffer
+
+	m := NewMetricsWriter(&b, "router")
+	m.Counter("requests_total", "Number of requests.", 3, Labels{"status": "2xx", "component": "cc"})
+	m.Counter("requests_total", "Number of requests.", 1, Labels{"status": "4xx", "component": "cc"})
+	m.Gauge("urls", "Number of URIs.", 2, nil)
+	m.Flush()
+
+	c.Check(b.String(), Equals, `# HELP router_requests_total Number of requests.
+# TYPE router_requests_total counter
+router_requests_total{component="cc",status="2xx"} 3
+router_requests_total{component="cc",status="4xx"} 1
+# HELP router_urls Number of URIs.
+# TYPE router_urls gauge
+router_urls 2
+`)
+}
+
+func (s *MetricsSuite) TestEscaping(c *C) {
+	var b bytes.Buffer
+
+	m := NewMetricsWriter(&b, "")
+	m.Gauge("value", "A \\ in\nhelp", math.Inf(1), Labels{"name": "\"a\\b\"\n"})
+	m.Flush()
+
+	c.Check(b.String(), Equals, `# HELP value A \\ in\nhelp
+# TYPE value gauge
+value{name="\"a\\b\"\n"} +Inf
+`)
+}
+
+func (s *MetricsSuite) TestHistogram(c *C) {
+	var b bytes.Buffer
+
+	h := NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	c.Check(h.Count(), Equals, int64(4))
+	c.Check(h.Sum(), Equals, 2.65)
+
+	m := NewMetricsWriter(&b, "router")
+	m.Histogram("latency_seconds", "Latency.", h, Labels{"component": "cc"})
+	m.Flush()
+
+	c.Check(b.String(), Equals, `# HELP router_latency_seconds Latency.
+# TYPE router_latency_seconds histogram
+router_latency_seconds_bucket{component="cc",le="0.1"} 2
+router_latency_seconds_bucket{component="cc",le="1"} 3
+router_latency_seconds_bucket{component="cc",le="+Inf"} 4
+router_latency_seconds_sum{component="cc"} 2.65
+router_latency_seconds_count{component="cc"} 4
+`)
+}
@@ -2,7 +2,9 @@ package common
 
 import (
 	"encoding/json"
+	"sort"
 	"sync"
+	"time"
 )
 
 type GenericVarz struct {
@@ -62,3 +64,30 @@ func (v *Varz) MarshalJSON() ([]byte, error) {
 
 	return json.Marshal(r)
 }
+
+// WriteMetrics writes the generic metrics, followed by the component's unique
+// ones if it collects any. The varz must be locked.
+func (v *Varz) WriteMetrics(m *MetricsWriter) {
+	m.Gauge("num_cores", "Number of CPU cores of the host.", float64(v.NumCores), nil)
+	m.Gauge("cpu_usage_ratio", "Share of a CPU core used by the process over the last second.", v.Cpu, nil)
+	m.Gauge("memory_rss_bytes", "Maximum resident set size of the process.", float64(v.MemStat*1024), nil)
+	m.Gauge("uptime_seconds", "Time since the component started.", time.Duration(v.Uptime).Seconds(), nil)
+
+	if v.LogCounts != nil {
+		counts := v.LogCounts.Counts()
+
+		levels := make([]string, 0, len(counts))
+		for level := range counts {
+			levels = append(levels, level)
+		}
+		sort.Strings(levels)
+
+		for _, level := range levels {
+			m.Counter("log_messages_total", "Number of messages logged.", float64(counts[level]), Labels{"level": level})
+		}
+	}
+
+	if collector, ok := v.UniqueVarz.(MetricsCollector); ok {
+		collector.WriteMetrics(m)
+	}
+}
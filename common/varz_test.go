@@ -1,9 +1,11 @@
 package common
 
 import (
+	"bytes"
 	"encoding/json"
 	steno "github.com/cloudfoundry/gosteno"
 	. "launchpad.net/gocheck"
+	"strings"
 )
 
 type VarzSuite struct {
@@ -71,6 +73,29 @@ func (s *VarzSuite) TestLogCounts(c *C) {
 	c.Assert(count, Equals, 1.0)
 }
 
+func (s *VarzSuite) TestWriteMetrics(c *C) {
+	varz := &Varz{}
+	varz.NumCores = 2
+	varz.LogCounts = NewLogCounter()
+	varz.LogCounts.AddRecord(&steno.Record{Level: steno.LOG_INFO})
+	varz.UniqueVarz = &collector{}
+
+	var b bytes.Buffer
+	m := NewMetricsWriter(&b, "router")
+	varz.WriteMetrics(m)
+	m.Flush()
+
+	c.Check(strings.Contains(b.String(), "\nrouter_num_cores 2\n"), Equals, true)
+	c.Check(strings.Contains(b.String(), "\nrouter_log_messages_total{level=\"info\"} 1\n"), Equals, true)
+	c.Check(strings.HasSuffix(b.String(), "\nrouter_unique 1\n"), Equals, true)
+}
+
+type collector struct{}
+
+func (x *collector) WriteMetrics(m *MetricsWriter) {
+	m.Gauge("unique", "A component's own metric.", 1, nil)
+}
+
 func (s *VarzSuite) TestTransformStruct(c *C) {
 	component := struct {
 		Type  string `json:"type"`
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"fmt"
 	vcap "github.com/cloudfoundry/gorouter/common"
+	"github.com/cloudfoundry/gorouter/route"
 	"io/ioutil"
 	"launchpad.net/goyaml"
 	"time"
@@ -44,7 +46,7 @@ var defaultLoggingConfig = LoggingConfig{
 }
 
 type LoggregatorConfig struct {
-	Url string
+	Url          string "url"
 	SharedSecret string "shared_secret"
 }
 
@@ -52,11 +54,189 @@ var defaultLoggregatorConfig = LoggregatorConfig{
 	Url: "",
 }
 
+type HealthCheckConfig struct {
+	Enabled            bool "enabled"
+	IntervalInSeconds  int  "interval"
+	TimeoutInSeconds   int  "timeout"
+	MaxChecksPerSecond int  "max_checks_per_second"
+
+	// These fields are populated by the `Process` function.
+	Interval time.Duration "-"
+	Timeout  time.Duration "-"
+}
+
+var defaultHealthCheckConfig = HealthCheckConfig{
+	Enabled:            false,
+	IntervalInSeconds:  30,
+	TimeoutInSeconds:   5,
+	MaxChecksPerSecond: 100,
+}
+
+type AppMetricsConfig struct {
+	Enabled bool "enabled"
+
+	// Metrics are only kept for this many of the most recently used
+	// applications.
+	MaxApps int "max_apps"
+}
+
+var defaultAppMetricsConfig = AppMetricsConfig{
+	Enabled: false,
+	MaxApps: 100,
+}
+
+type AccessLogRotationConfig struct {
+	// The access log is rotated when it would grow beyond this size, or has
+	// been open for longer than the interval; 0 disables either.
+	MaxSizeInMegabytes int "max_size"
+	IntervalInSeconds  int "interval"
+
+	// Number of rotated files kept; 0 keeps all of them.
+	MaxBackups int  "max_backups"
+	Compress   bool "compress"
+
+	// These fields are populated by the `Process` function.
+	MaxSize  int64         "-"
+	Interval time.Duration "-"
+}
+
+var defaultAccessLogRotationConfig = AccessLogRotationConfig{
+	MaxSizeInMegabytes: 0,
+	IntervalInSeconds:  0,
+	MaxBackups:         0,
+	Compress:           false,
+}
+
+type TracingConfig struct {
+	Enabled bool "enabled"
+
+	// "stdout", or "file" to append spans to the file at the given path.
+	Exporter string "exporter"
+	File     string "file"
+
+	// Fraction of requests starting a new trace that are sampled; requests
+	// continuing a trace keep the decision made upstream.
+	SampleRate float64 "sample_rate"
+
+	// Spans waiting to be written; more are dropped
+	BufferSize int "buffer_size"
+}
+
+var defaultTracingConfig = TracingConfig{
+	Enabled:    false,
+	Exporter:   "stdout",
+	SampleRate: 1,
+	BufferSize: 1024,
+}
+
+type RateLimitConfig struct {
+	Enabled bool "enabled"
+
+	// Requests per second allowed to each route, and how many more may be
+	// made in a burst; routes can override these with the "rate_limit" and
+	// "rate_limit_burst" tags of their endpoints. A rate of 0 doesn't limit.
+	RouteRate  float64 "route_rate"
+	RouteBurst int     "route_burst"
+
+	// Likewise for each client address.
+	ClientRate  float64 "client_rate"
+	ClientBurst int     "client_burst"
+
+	// Number of clients whose rate is tracked at once.
+	MaxClients int "max_clients"
+}
+
+var defaultRateLimitConfig = RateLimitConfig{
+	Enabled:    false,
+	MaxClients: 10000,
+}
+
+type ConcurrencyLimitConfig struct {
+	// Requests proxied at once by the router, to each route and to each
+	// endpoint; 0 doesn't limit.
+	MaxInFlight            int "max_in_flight"
+	MaxInFlightPerRoute    int "max_in_flight_per_route"
+	MaxInFlightPerEndpoint int "max_in_flight_per_endpoint"
+
+	// Requests over a limit waiting for others to finish, per router, route
+	// or endpoint, and for how long before they are turned away.
+	MaxQueued                  int "max_queued"
+	QueueTimeoutInMilliseconds int "queue_timeout_ms"
+
+	// This field is populated by the `Process` function.
+	QueueTimeout time.Duration "-"
+}
+
+var defaultConcurrencyLimitConfig = ConcurrencyLimitConfig{
+	MaxInFlight:                0,
+	MaxInFlightPerRoute:        0,
+	MaxInFlightPerEndpoint:     0,
+	MaxQueued:                  100,
+	QueueTimeoutInMilliseconds: 1000,
+}
+
+type CertificateConfig struct {
+	CertFile string "cert_file"
+	KeyFile  string "key_file"
+}
+
+type TLSConfig struct {
+	// Port to terminate TLS on; 0 disables the TLS listener.
+	Port uint16 "port"
+
+	// Certificates are selected by SNI server name, wildcards included. The
+	// first one is served to clients that don't send a matching name.
+	Certificates []CertificateConfig "certificates"
+}
+
+var defaultTLSConfig = TLSConfig{
+	Port: 0,
+}
+
+type HTTP2Config struct {
+	// Negotiate HTTP/2 with clients of the TLS listener via ALPN.
+	Enabled bool "enabled"
+
+	// Accept HTTP/2 without TLS from clients sending the HTTP/2 connection
+	// preface, as done by clients with prior knowledge of it.
+	H2C bool "h2c"
+
+	// Streams a client may have open at once on a connection.
+	MaxConcurrentStreams int "max_concurrent_streams"
+}
+
+var defaultHTTP2Config = HTTP2Config{
+	Enabled:              false,
+	H2C:                  false,
+	MaxConcurrentStreams: 100,
+}
+
+type BackendTLSConfig struct {
+	// PEM bundle of CAs endpoint certificates are verified against; the
+	// system roots are used when empty.
+	CACertsFile string "ca_certs"
+
+	// Client certificate presented to endpoints for mutual TLS.
+	CertFile string "cert_file"
+	KeyFile  string "key_file"
+}
+
 type Config struct {
 	Status            StatusConfig      "status"
 	Nats              NatsConfig        "nats"
 	Logging           LoggingConfig     "logging"
 	LoggregatorConfig LoggregatorConfig "loggregatorConfig"
+	HealthCheck       HealthCheckConfig "health_check"
+	TLS               TLSConfig         "tls"
+	HTTP2             HTTP2Config       "http2"
+	BackendTLS        BackendTLSConfig  "backend_tls"
+	AppMetrics        AppMetricsConfig  "app_metrics"
+	Tracing           TracingConfig     "tracing"
+	RateLimit         RateLimitConfig   "rate_limit"
+
+	ConcurrencyLimit ConcurrencyLimitConfig "concurrency_limit"
+
+	AccessLogRotation AccessLogRotationConfig "access_log_rotation"
 
 	Port       uint16 "port"
 	Index      uint   "index"
@@ -65,12 +245,58 @@ type Config struct {
 	TraceKey   string "trace_key"
 	AccessLog  string "access_log"
 
+	// "text", "json" or a template over the fields of an access log record
+	AccessLogFormat string "access_log_format"
+
+	// Number of access log records queued for writing; requests wait for
+	// room in the queue unless records are dropped when it's full.
+	AccessLogBufferSize   int  "access_log_buffer_size"
+	AccessLogDropWhenFull bool "access_log_drop_when_full"
+
+	LoadBalancing string "load_balancing"
+
 	PublishStartMessageIntervalInSeconds int "publish_start_message_interval"
 	PruneStaleDropletsIntervalInSeconds  int "prune_stale_droplets_interval"
 	DropletStaleThresholdInSeconds       int "droplet_stale_threshold"
 	PublishActiveAppsIntervalInSeconds   int "publish_active_apps_interval"
 	StartResponseDelayIntervalInSeconds  int "start_response_delay_interval"
 	EndpointTimeoutInSeconds             int "endpoint_timeout"
+	EndpointIdleTimeoutInSeconds         int "endpoint_idle_timeout"
+
+	// Number of idle keep-alive connections kept per endpoint; 0 disables
+	// keep-alive to endpoints altogether.
+	MaxIdleConnsPerEndpoint int "max_idle_conns_per_endpoint"
+
+	// Number of endpoints a request is tried against before giving up.
+	MaxEndpointAttempts int "max_endpoint_attempts"
+
+	// Number of consecutive dial errors or timeouts after which an endpoint
+	// is taken out of rotation; 0 disables this.
+	EndpointFailureThreshold        int "endpoint_failure_threshold"
+	EndpointFailureBackoffInSeconds int "endpoint_failure_backoff"
+
+	// How long in-flight requests are given to finish after a drain signal.
+	DrainTimeoutInSeconds int "drain_timeout"
+
+	// How long clients have to send a request, body included, to read the
+	// response, and to send their next request on a kept-alive connection;
+	// 0 doesn't time out. The idle timeout defaults to the read timeout.
+	ClientReadTimeoutInSeconds  int "client_read_timeout"
+	ClientWriteTimeoutInSeconds int "client_write_timeout"
+	ClientIdleTimeoutInSeconds  int "client_idle_timeout"
+
+	// Size of the request line and headers a client may send, and of the
+	// body of its requests; a body size of 0 doesn't limit.
+	MaxHeaderBytes      int   "max_header_bytes"
+	MaxRequestBodyBytes int64 "max_request_body_bytes"
+
+	// Whether X-Request-Id headers sent by clients are passed on, rather
+	// than replaced by one generated by the router.
+	TrustRequestId bool "trust_request_id"
+
+	// Addresses or CIDR ranges of load balancers in front of the router,
+	// trusted to tell the client address in X-Forwarded-For.
+	TrustedProxies []string "trusted_proxies"
 
 	// These fields are populated by the `Process` function.
 	PruneStaleDropletsInterval time.Duration
@@ -78,6 +304,12 @@ type Config struct {
 	PublishActiveAppsInterval  time.Duration
 	StartResponseDelayInterval time.Duration
 	EndpointTimeout            time.Duration
+	EndpointIdleTimeout        time.Duration
+	EndpointFailureBackoff     time.Duration
+	DrainTimeout               time.Duration
+	ClientReadTimeout          time.Duration
+	ClientWriteTimeout         time.Duration
+	ClientIdleTimeout          time.Duration
 
 	Ip string
 }
@@ -87,13 +319,43 @@ var defaultConfig = Config{
 	Nats:              defaultNatsConfig,
 	Logging:           defaultLoggingConfig,
 	LoggregatorConfig: defaultLoggregatorConfig,
+	HealthCheck:       defaultHealthCheckConfig,
+	TLS:               defaultTLSConfig,
+	HTTP2:             defaultHTTP2Config,
+	AppMetrics:        defaultAppMetricsConfig,
+	Tracing:           defaultTracingConfig,
+	RateLimit:         defaultRateLimitConfig,
+	ConcurrencyLimit:  defaultConcurrencyLimitConfig,
+	AccessLogRotation: defaultAccessLogRotationConfig,
 
 	Port:       8081,
 	Index:      0,
 	Pidfile:    "",
 	GoMaxProcs: 8,
 
-	EndpointTimeoutInSeconds: 60,
+	AccessLogBufferSize:   128,
+	AccessLogDropWhenFull: false,
+
+	LoadBalancing: "random",
+
+	EndpointTimeoutInSeconds:     60,
+	EndpointIdleTimeoutInSeconds: 30,
+	MaxIdleConnsPerEndpoint:      2,
+	MaxEndpointAttempts:          3,
+
+	EndpointFailureThreshold:        3,
+	EndpointFailureBackoffInSeconds: 30,
+
+	DrainTimeoutInSeconds: 30,
+
+	ClientReadTimeoutInSeconds:  0,
+	ClientWriteTimeoutInSeconds: 0,
+	ClientIdleTimeoutInSeconds:  0,
+
+	MaxHeaderBytes:      1024 * 1024,
+	MaxRequestBodyBytes: 0,
+
+	TrustRequestId: false,
 
 	PublishStartMessageIntervalInSeconds: 30,
 	PruneStaleDropletsIntervalInSeconds:  30,
@@ -118,6 +380,20 @@ func (c *Config) Process() {
 	c.PublishActiveAppsInterval = time.Duration(c.PublishActiveAppsIntervalInSeconds) * time.Second
 	c.StartResponseDelayInterval = time.Duration(c.StartResponseDelayIntervalInSeconds) * time.Second
 	c.EndpointTimeout = time.Duration(c.EndpointTimeoutInSeconds) * time.Second
+	c.EndpointIdleTimeout = time.Duration(c.EndpointIdleTimeoutInSeconds) * time.Second
+	c.EndpointFailureBackoff = time.Duration(c.EndpointFailureBackoffInSeconds) * time.Second
+	c.DrainTimeout = time.Duration(c.DrainTimeoutInSeconds) * time.Second
+	c.ClientReadTimeout = time.Duration(c.ClientReadTimeoutInSeconds) * time.Second
+	c.ClientWriteTimeout = time.Duration(c.ClientWriteTimeoutInSeconds) * time.Second
+	c.ClientIdleTimeout = time.Duration(c.ClientIdleTimeoutInSeconds) * time.Second
+
+	c.HealthCheck.Interval = time.Duration(c.HealthCheck.IntervalInSeconds) * time.Second
+	c.HealthCheck.Timeout = time.Duration(c.HealthCheck.TimeoutInSeconds) * time.Second
+
+	c.AccessLogRotation.MaxSize = int64(c.AccessLogRotation.MaxSizeInMegabytes) * 1024 * 1024
+	c.AccessLogRotation.Interval = time.Duration(c.AccessLogRotation.IntervalInSeconds) * time.Second
+
+	c.ConcurrencyLimit.QueueTimeout = time.Duration(c.ConcurrencyLimit.QueueTimeoutInMilliseconds) * time.Millisecond
 
 	c.Ip, err = vcap.LocalIP()
 	if err != nil {
@@ -126,20 +402,50 @@ func (c *Config) Process() {
 }
 
 func InitConfigFromFile(path string) *Config {
+	c, e := ReadConfigFromFile(path)
+	if e != nil {
+		panic(e.Error())
+	}
+
+	return c
+}
+
+// ReadConfigFromFile is like InitConfigFromFile, returning an error instead
+// of panicking so a running router can reject a broken file.
+func ReadConfigFromFile(path string) (*Config, error) {
 	var c *Config = DefaultConfig()
 	var e error
 
 	b, e := ioutil.ReadFile(path)
 	if e != nil {
-		panic(e.Error())
+		return nil, e
 	}
 
 	e = goyaml.Unmarshal(b, c)
 	if e != nil {
-		panic(e.Error())
+		return nil, e
 	}
 
 	c.Process()
 
-	return c
+	e = c.Validate()
+	if e != nil {
+		return nil, e
+	}
+
+	return c, nil
+}
+
+// Validate checks the values of the config that can't be used as they are.
+func (c *Config) Validate() error {
+	_, err := route.NewLoadBalancer(c.LoadBalancing)
+	if err != nil {
+		return fmt.Errorf("load_balancing: %s", err)
+	}
+
+	if c.AppMetrics.Enabled && c.AppMetrics.MaxApps < 1 {
+		return fmt.Errorf("app_metrics.max_apps: must be at least 1")
+	}
+
+	return nil
 }
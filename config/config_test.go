@@ -47,6 +47,297 @@ endpoint_timeout: 10
 	c.Check(s.EndpointTimeoutInSeconds, Equals, 10)
 }
 
+func (s *ConfigSuite) TestLoadBalancing(c *C) {
+	var b = []byte(`
+load_balancing: least_connections
+`)
+
+	c.Check(s.LoadBalancing, Equals, "random")
+
+	goyaml.Unmarshal(b, &s.Config)
+
+	c.Check(s.LoadBalancing, Equals, "least_connections")
+}
+
+func (s *ConfigSuite) TestEndpointConnections(c *C) {
+	var b = []byte(`
+endpoint_idle_timeout: 15
+max_idle_conns_per_endpoint: 8
+max_endpoint_attempts: 5
+endpoint_failure_threshold: 4
+endpoint_failure_backoff: 60
+`)
+
+	c.Check(s.EndpointIdleTimeout, Equals, 30*time.Second)
+	c.Check(s.MaxIdleConnsPerEndpoint, Equals, 2)
+	c.Check(s.MaxEndpointAttempts, Equals, 3)
+	c.Check(s.EndpointFailureThreshold, Equals, 3)
+	c.Check(s.EndpointFailureBackoff, Equals, 30*time.Second)
+
+	goyaml.Unmarshal(b, &s.Config)
+	s.Config.Process()
+
+	c.Check(s.EndpointIdleTimeout, Equals, 15*time.Second)
+	c.Check(s.MaxIdleConnsPerEndpoint, Equals, 8)
+	c.Check(s.MaxEndpointAttempts, Equals, 5)
+	c.Check(s.EndpointFailureThreshold, Equals, 4)
+	c.Check(s.EndpointFailureBackoff, Equals, 60*time.Second)
+}
+
+func (s *ConfigSuite) TestDrainTimeout(c *C) {
+	var b = []byte(`
+drain_timeout: 10
+`)
+
+	c.Check(s.DrainTimeout, Equals, 30*time.Second)
+
+	goyaml.Unmarshal(b, &s.Config)
+	s.Config.Process()
+
+	c.Check(s.DrainTimeout, Equals, 10*time.Second)
+}
+
+func (s *ConfigSuite) TestClientLimits(c *C) {
+	var b = []byte(`
+client_read_timeout: 30
+client_write_timeout: 60
+client_idle_timeout: 90
+max_header_bytes: 8192
+max_request_body_bytes: 10485760
+`)
+
+	c.Check(s.ClientReadTimeout, Equals, time.Duration(0))
+	c.Check(s.MaxHeaderBytes, Equals, 1048576)
+	c.Check(s.MaxRequestBodyBytes, Equals, int64(0))
+
+	goyaml.Unmarshal(b, &s.Config)
+	s.Config.Process()
+
+	c.Check(s.ClientReadTimeout, Equals, 30*time.Second)
+	c.Check(s.ClientWriteTimeout, Equals, 60*time.Second)
+	c.Check(s.ClientIdleTimeout, Equals, 90*time.Second)
+	c.Check(s.MaxHeaderBytes, Equals, 8192)
+	c.Check(s.MaxRequestBodyBytes, Equals, int64(10485760))
+}
+
+func (s *ConfigSuite) TestTrustRequestId(c *C) {
+	var b = []byte(`
+trust_request_id: true
+`)
+
+	c.Check(s.TrustRequestId, Equals, false)
+
+	goyaml.Unmarshal(b, &s.Config)
+	s.Config.Process()
+
+	c.Check(s.TrustRequestId, Equals, true)
+}
+
+func (s *ConfigSuite) TestHTTP2(c *C) {
+	var b = []byte(`
+http2:
+  enabled: true
+  h2c: true
+  max_concurrent_streams: 250
+`)
+
+	c.Check(s.HTTP2, Equals, HTTP2Config{MaxConcurrentStreams: 100})
+
+	goyaml.Unmarshal(b, &s.Config)
+	s.Config.Process()
+
+	c.Check(s.HTTP2, Equals, HTTP2Config{Enabled: true, H2C: true, MaxConcurrentStreams: 250})
+}
+
+func (s *ConfigSuite) TestTracing(c *C) {
+	var b = []byte(`
+tracing:
+  enabled: true
+  exporter: file
+  file: /var/vcap/sys/log/router/spans.log
+  sample_rate: 0.1
+  buffer_size: 4096
+`)
+
+	c.Check(s.Tracing.Enabled, Equals, false)
+	c.Check(s.Tracing.Exporter, Equals, "stdout")
+	c.Check(s.Tracing.SampleRate, Equals, 1.0)
+	c.Check(s.Tracing.BufferSize, Equals, 1024)
+
+	goyaml.Unmarshal(b, &s.Config)
+	s.Config.Process()
+
+	c.Check(s.Tracing.Enabled, Equals, true)
+	c.Check(s.Tracing.Exporter, Equals, "file")
+	c.Check(s.Tracing.File, Equals, "/var/vcap/sys/log/router/spans.log")
+	c.Check(s.Tracing.SampleRate, Equals, 0.1)
+	c.Check(s.Tracing.BufferSize, Equals, 4096)
+}
+
+func (s *ConfigSuite) TestRateLimit(c *C) {
+	var b = []byte(`
+rate_limit:
+  enabled: true
+  route_rate: 100
+  route_burst: 200
+  client_rate: 0.5
+  client_burst: 5
+  max_clients: 500
+trusted_proxies:
+- 10.0.0.0/8
+- 192.168.1.1
+`)
+
+	c.Check(s.RateLimit, Equals, RateLimitConfig{MaxClients: 10000})
+	c.Check(s.TrustedProxies, HasLen, 0)
+
+	goyaml.Unmarshal(b, &s.Config)
+	s.Config.Process()
+
+	c.Check(s.RateLimit, Equals, RateLimitConfig{
+		Enabled:     true,
+		RouteRate:   100,
+		RouteBurst:  200,
+		ClientRate:  0.5,
+		ClientBurst: 5,
+		MaxClients:  500,
+	})
+	c.Check(s.TrustedProxies, DeepEquals, []string{"10.0.0.0/8", "192.168.1.1"})
+}
+
+func (s *ConfigSuite) TestConcurrencyLimit(c *C) {
+	var b = []byte(`
+concurrency_limit:
+  max_in_flight: 10000
+  max_in_flight_per_route: 1000
+  max_in_flight_per_endpoint: 100
+  max_queued: 50
+  queue_timeout_ms: 250
+`)
+
+	c.Check(s.ConcurrencyLimit.MaxInFlight, Equals, 0)
+	c.Check(s.ConcurrencyLimit.MaxQueued, Equals, 100)
+	c.Check(s.ConcurrencyLimit.QueueTimeout, Equals, time.Second)
+
+	goyaml.Unmarshal(b, &s.Config)
+	s.Config.Process()
+
+	c.Check(s.ConcurrencyLimit.MaxInFlight, Equals, 10000)
+	c.Check(s.ConcurrencyLimit.MaxInFlightPerRoute, Equals, 1000)
+	c.Check(s.ConcurrencyLimit.MaxInFlightPerEndpoint, Equals, 100)
+	c.Check(s.ConcurrencyLimit.MaxQueued, Equals, 50)
+	c.Check(s.ConcurrencyLimit.QueueTimeout, Equals, 250*time.Millisecond)
+}
+
+func (s *ConfigSuite) TestHealthCheck(c *C) {
+	var b = []byte(`
+health_check:
+  enabled: true
+  interval: 10
+  timeout: 2
+  max_checks_per_second: 20
+`)
+
+	c.Check(s.HealthCheck.Enabled, Equals, false)
+	c.Check(s.HealthCheck.Interval, Equals, 30*time.Second)
+	c.Check(s.HealthCheck.Timeout, Equals, 5*time.Second)
+	c.Check(s.HealthCheck.MaxChecksPerSecond, Equals, 100)
+
+	goyaml.Unmarshal(b, &s.Config)
+	s.Config.Process()
+
+	c.Check(s.HealthCheck.Enabled, Equals, true)
+	c.Check(s.HealthCheck.Interval, Equals, 10*time.Second)
+	c.Check(s.HealthCheck.Timeout, Equals, 2*time.Second)
+	c.Check(s.HealthCheck.MaxChecksPerSecond, Equals, 20)
+}
+
+func (s *ConfigSuite) TestAccessLogFormat(c *C) {
+	var b = []byte(`
+access_log_format: json
+`)
+
+	c.Check(s.AccessLogFormat, Equals, "")
+
+	goyaml.Unmarshal(b, &s.Config)
+
+	c.Check(s.AccessLogFormat, Equals, "json")
+}
+
+func (s *ConfigSuite) TestAccessLogBuffer(c *C) {
+	var b = []byte(`
+access_log_buffer_size: 4096
+access_log_drop_when_full: true
+`)
+
+	c.Check(s.AccessLogBufferSize, Equals, 128)
+	c.Check(s.AccessLogDropWhenFull, Equals, false)
+
+	goyaml.Unmarshal(b, &s.Config)
+
+	c.Check(s.AccessLogBufferSize, Equals, 4096)
+	c.Check(s.AccessLogDropWhenFull, Equals, true)
+}
+
+func (s *ConfigSuite) TestAccessLogRotation(c *C) {
+	var b = []byte(`
+access_log_rotation:
+  max_size: 100
+  interval: 86400
+  max_backups: 7
+  compress: true
+`)
+
+	c.Check(s.AccessLogRotation.MaxSize, Equals, int64(0))
+	c.Check(s.AccessLogRotation.Interval, Equals, time.Duration(0))
+
+	goyaml.Unmarshal(b, &s.Config)
+	s.Config.Process()
+
+	c.Check(s.AccessLogRotation.MaxSize, Equals, int64(100*1024*1024))
+	c.Check(s.AccessLogRotation.Interval, Equals, 24*time.Hour)
+	c.Check(s.AccessLogRotation.MaxBackups, Equals, 7)
+	c.Check(s.AccessLogRotation.Compress, Equals, true)
+}
+
+func (s *ConfigSuite) TestAppMetrics(c *C) {
+	var b = []byte(`
+app_metrics:
+  enabled: true
+  max_apps: 500
+`)
+
+	c.Check(s.AppMetrics.Enabled, Equals, false)
+	c.Check(s.AppMetrics.MaxApps, Equals, 100)
+
+	goyaml.Unmarshal(b, &s.Config)
+
+	c.Check(s.AppMetrics.Enabled, Equals, true)
+	c.Check(s.AppMetrics.MaxApps, Equals, 500)
+}
+
+func (s *ConfigSuite) TestTLS(c *C) {
+	var b = []byte(`
+tls:
+  port: 443
+  certificates:
+  - cert_file: /path/to/a.crt
+    key_file: /path/to/a.key
+  - cert_file: /path/to/b.crt
+    key_file: /path/to/b.key
+`)
+
+	c.Check(s.TLS.Port, Equals, uint16(0))
+	c.Check(s.TLS.Certificates, HasLen, 0)
+
+	goyaml.Unmarshal(b, &s.Config)
+
+	c.Check(s.TLS.Port, Equals, uint16(443))
+	c.Assert(s.TLS.Certificates, HasLen, 2)
+	c.Check(s.TLS.Certificates[0], Equals, CertificateConfig{CertFile: "/path/to/a.crt", KeyFile: "/path/to/a.key"})
+	c.Check(s.TLS.Certificates[1], Equals, CertificateConfig{CertFile: "/path/to/b.crt", KeyFile: "/path/to/b.key"})
+}
+
 func (s *ConfigSuite) TestNats(c *C) {
 	var b = []byte(`
 nats:
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Settings that are applied to a running router when the configuration is
+// reloaded, by their key in the configuration file.
+var reloadableKeys = map[string]bool{
+	"logging.level":                 true,
+	"access_log":                    true,
+	"access_log_format":             true,
+	"endpoint_timeout":              true,
+	"prune_stale_droplets_interval": true,
+	"droplet_stale_threshold":       true,
+	"trace_key":                     true,
+	"status.user":                   true,
+	"status.pass":                   true,
+}
+
+func IsReloadable(key string) bool {
+	return reloadableKeys[key]
+}
+
+// Changes returns the keys of the settings that differ between c and other,
+// such as "port" or "status.user".
+func (c *Config) Changes(other *Config) []string {
+	return changes("", reflect.ValueOf(*c), reflect.ValueOf(*other))
+}
+
+// ChangesRequiringRestart returns the keys of the settings that differ
+// between c and other and can't be reloaded.
+func (c *Config) ChangesRequiringRestart(other *Config) []string {
+	keys := []string{}
+
+	for _, key := range c.Changes(other) {
+		if !IsReloadable(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func changes(prefix string, a, b reflect.Value) []string {
+	keys := []string{}
+
+	for i := 0; i < a.NumField(); i++ {
+		// Fields without a key are populated by `Process`
+		key := strings.Split(string(a.Type().Field(i).Tag), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+
+		key = prefix + key
+
+		x, y := a.Field(i), b.Field(i)
+		if x.Kind() == reflect.Struct {
+			keys = append(keys, changes(key+".", x, y)...)
+		} else if !reflect.DeepEqual(x.Interface(), y.Interface()) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type ReloadSuite struct{}
+
+var _ = Suite(&ReloadSuite{})
+
+func (s *ReloadSuite) TestNoChanges(c *C) {
+	c.Check(DefaultConfig().Changes(DefaultConfig()), DeepEquals, []string{})
+}
+
+func (s *ReloadSuite) TestChanges(c *C) {
+	a := DefaultConfig()
+	b := DefaultConfig()
+
+	b.Port = 9000
+	b.Status.User = "admin"
+	b.Logging.Level = "info"
+	b.TLS.Certificates = []CertificateConfig{{CertFile: "a.crt", KeyFile: "a.key"}}
+
+	// Processed fields don't count on their own
+	b.EndpointTimeout = time.Second
+
+	c.Check(a.Changes(b), DeepEquals, []string{"status.user", "logging.level", "tls.certificates", "port"})
+	c.Check(a.ChangesRequiringRestart(b), DeepEquals, []string{"tls.certificates", "port"})
+}
+
+func (s *ReloadSuite) TestReloadableKeys(c *C) {
+	for _, key := range []string{"logging.level", "access_log", "access_log_format", "endpoint_timeout", "prune_stale_droplets_interval", "droplet_stale_threshold", "trace_key", "status.user", "status.pass"} {
+		c.Check(IsReloadable(key), Equals, true)
+	}
+
+	c.Check(IsReloadable("port"), Equals, false)
+	c.Check(IsReloadable("logging.file"), Equals, false)
+}
+
+func (s *ReloadSuite) TestReadConfigFromFile(c *C) {
+	path := filepath.Join(c.MkDir(), "gorouter.yml")
+
+	_, err := ReadConfigFromFile(path)
+	c.Check(err, NotNil)
+
+	ioutil.WriteFile(path, []byte("port: [\n"), 0600)
+	_, err = ReadConfigFromFile(path)
+	c.Check(err, NotNil)
+
+	ioutil.WriteFile(path, []byte("port: 9000\nendpoint_timeout: 10\n"), 0600)
+	x, err := ReadConfigFromFile(path)
+	c.Assert(err, IsNil)
+	c.Check(x.Port, Equals, uint16(9000))
+	c.Check(x.EndpointTimeout, Equals, 10*time.Second)
+
+	ioutil.WriteFile(path, []byte("load_balancing: bogus\n"), 0600)
+	_, err = ReadConfigFromFile(path)
+	c.Check(err, ErrorMatches, "load_balancing: unknown load balancing strategy: bogus")
+
+	ioutil.WriteFile(path, []byte("app_metrics:\n  enabled: true\n  max_apps: 0\n"), 0600)
+	_, err = ReadConfigFromFile(path)
+	c.Check(err, ErrorMatches, "app_metrics.max_apps: must be at least 1")
+}
@@ -0,0 +1,282 @@
+package healthcheck
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	steno "github.com/cloudfoundry/gosteno"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/log"
+	"github.com/cloudfoundry/gorouter/registry"
+	"github.com/cloudfoundry/gorouter/route"
+)
+
+type CheckResult struct {
+	Address   string    `json:"address"`
+	Path      string    `json:"path,omitempty"`
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	Duration  float64   `json:"duration"`
+}
+
+// TLSConfigurer gives the TLS configuration to connect to an endpoint with,
+// or nil if the endpoint doesn't use TLS.
+type TLSConfigurer interface {
+	TLSConfigFor(endpoint *route.Endpoint) *tls.Config
+}
+
+// HealthChecker periodically probes every endpoint in the registry and takes
+// endpoints failing their check out of rotation until they pass again.
+type HealthChecker struct {
+	sync.Mutex
+	*steno.Logger
+
+	registry   *registry.Registry
+	tlsConfigs TLSConfigurer
+
+	interval           time.Duration
+	timeout            time.Duration
+	maxChecksPerSecond int
+
+	client *http.Client
+
+	results map[string]*CheckResult
+
+	// Addresses forgotten while checks were running, with the generation
+	// they were forgotten in. Results of checks started before then are
+	// dropped.
+	generation uint64
+	forgotten  map[string]uint64
+	running    int
+}
+
+func NewHealthChecker(c *config.Config, r *registry.Registry, t TLSConfigurer) *HealthChecker {
+	h := &HealthChecker{
+		Logger: log.NewLogger("router.healthcheck"),
+
+		registry:   r,
+		tlsConfigs: t,
+
+		interval:           c.HealthCheck.Interval,
+		timeout:            c.HealthCheck.Timeout,
+		maxChecksPerSecond: c.HealthCheck.MaxChecksPerSecond,
+
+		results:   make(map[string]*CheckResult),
+		forgotten: make(map[string]uint64),
+	}
+
+	h.client = &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+		Timeout:   h.timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	r.OnEndpointRemoved(h.forget)
+
+	return h
+}
+
+func (h *HealthChecker) Start() {
+	go h.run()
+}
+
+func (h *HealthChecker) run() {
+	if h.interval == 0 {
+		return
+	}
+
+	for {
+		startedAt := time.Now()
+
+		h.CheckAll()
+
+		elapsed := time.Since(startedAt)
+		if elapsed < h.interval {
+			time.Sleep(h.interval - elapsed)
+		}
+	}
+}
+
+// CheckAll checks every registered address once, starting no more than
+// maxChecksPerSecond checks per second.
+func (h *HealthChecker) CheckAll() {
+	var tick <-chan time.Time
+	if h.maxChecksPerSecond > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(h.maxChecksPerSecond))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var wg sync.WaitGroup
+
+	for addr, endpoints := range h.registry.EndpointsByAddr() {
+		if tick != nil {
+			<-tick
+		}
+
+		wg.Add(1)
+		go func(addr string, endpoints []*route.Endpoint) {
+			defer wg.Done()
+			h.check(addr, endpoints)
+		}(addr, endpoints)
+	}
+
+	wg.Wait()
+}
+
+func (h *HealthChecker) check(addr string, endpoints []*route.Endpoint) {
+	endpoint := endpoints[0]
+	for _, e := range endpoints {
+		if e.HealthCheckPath != "" {
+			endpoint = e
+			break
+		}
+	}
+
+	path := endpoint.HealthCheckPath
+
+	h.Lock()
+	started := h.generation
+	h.running++
+	h.Unlock()
+
+	result := &CheckResult{
+		Address:   addr,
+		Path:      path,
+		CheckedAt: time.Now(),
+	}
+
+	var err error
+	if path == "" {
+		err = h.checkTcp(endpoint)
+	} else {
+		err = h.checkHttp(endpoint, path)
+	}
+
+	result.Duration = time.Since(result.CheckedAt).Seconds()
+	result.Healthy = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	h.Lock()
+	h.running--
+	stale := h.forgotten[addr] > started
+	previous := h.results[addr]
+	if !stale {
+		h.results[addr] = result
+	}
+	if h.running == 0 {
+		h.forgotten = make(map[string]uint64)
+	}
+	h.Unlock()
+
+	if stale {
+		return
+	}
+
+	if previous == nil || previous.Healthy != result.Healthy {
+		if result.Healthy {
+			h.Infof("Endpoint %s passed its health check", addr)
+		} else {
+			h.Warnf("Endpoint %s failed its health check: %s", addr, result.Error)
+		}
+	}
+
+	for _, e := range endpoints {
+		e.MarkHealthCheck(result.Healthy)
+	}
+}
+
+func (h *HealthChecker) checkTcp(endpoint *route.Endpoint) error {
+	dialer := &net.Dialer{Timeout: h.timeout}
+
+	var conn net.Conn
+	var err error
+
+	tlsConfig := h.tlsConfigs.TLSConfigFor(endpoint)
+	if tlsConfig == nil {
+		conn, err = dialer.Dial("tcp", endpoint.BackendAddr())
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", endpoint.BackendAddr(), tlsConfig)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+func (h *HealthChecker) checkHttp(endpoint *route.Endpoint, path string) error {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	client := h.client
+	scheme := "http"
+
+	tlsConfig := h.tlsConfigs.TLSConfigFor(endpoint)
+	if tlsConfig != nil {
+		tlsClient := *h.client
+		tlsClient.Transport = &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   tlsConfig,
+		}
+
+		client = &tlsClient
+		scheme = "https"
+	}
+
+	resp, err := client.Get(fmt.Sprintf("%s://%s%s", scheme, endpoint.BackendAddr(), path))
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (h *HealthChecker) forget(endpoint *route.Endpoint) {
+	h.Lock()
+	defer h.Unlock()
+
+	addr := endpoint.CanonicalAddr()
+
+	h.generation++
+	if h.running > 0 {
+		h.forgotten[addr] = h.generation
+	}
+
+	delete(h.results, addr)
+}
+
+func (h *HealthChecker) Result(addr string) (*CheckResult, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	result, ok := h.results[addr]
+	return result, ok
+}
+
+func (h *HealthChecker) MarshalJSON() ([]byte, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	return json.Marshal(h.results)
+}
@@ -0,0 +1,268 @@
+package healthcheck
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry/yagnats/fakeyagnats"
+	. "launchpad.net/gocheck"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/registry"
+	"github.com/cloudfoundry/gorouter/route"
+	"github.com/cloudfoundry/gorouter/test"
+)
+
+type HealthCheckerSuite struct {
+	*HealthChecker
+
+	registry *registry.Registry
+	rootCAs  *x509.CertPool
+}
+
+var _ = Suite(&HealthCheckerSuite{})
+
+func (s *HealthCheckerSuite) SetUpTest(c *C) {
+	configObj := config.DefaultConfig()
+	configObj.HealthCheck.Timeout = 100 * time.Millisecond
+	configObj.HealthCheck.MaxChecksPerSecond = 1000
+
+	s.registry = registry.NewRegistry(configObj, fakeyagnats.New())
+	s.rootCAs = x509.NewCertPool()
+	s.HealthChecker = NewHealthChecker(configObj, s.registry, s)
+}
+
+func (s *HealthCheckerSuite) TLSConfigFor(endpoint *route.Endpoint) *tls.Config {
+	if !endpoint.UsesTLS() {
+		return nil
+	}
+
+	return &tls.Config{RootCAs: s.rootCAs}
+}
+
+func (s *HealthCheckerSuite) endpointFor(ln net.Listener, path string) *route.Endpoint {
+	h, p, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		panic(err)
+	}
+
+	return &route.Endpoint{
+		Host:            h,
+		Port:            uint16(port),
+		HealthCheckPath: path,
+	}
+}
+
+func (s *HealthCheckerSuite) serve(c *C, status int) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+
+	go http.Serve(ln, mux)
+
+	return ln
+}
+
+func (s *HealthCheckerSuite) TestTcpCheck(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	endpoint := s.endpointFor(ln, "")
+	s.registry.Register("foo", endpoint)
+
+	s.CheckAll()
+
+	result, ok := s.Result(endpoint.CanonicalAddr())
+	c.Assert(ok, Equals, true)
+	c.Check(result.Healthy, Equals, true)
+	c.Check(endpoint.State(), Equals, route.EndpointHealthy)
+
+	ln.Close()
+	s.CheckAll()
+
+	result, _ = s.Result(endpoint.CanonicalAddr())
+	c.Check(result.Healthy, Equals, false)
+	c.Check(result.Error, Not(Equals), "")
+	c.Check(endpoint.State(), Equals, route.EndpointUnhealthy)
+}
+
+func (s *HealthCheckerSuite) TestHttpCheck(c *C) {
+	healthy := s.serve(c, http.StatusOK)
+	defer healthy.Close()
+
+	unhealthy := s.serve(c, http.StatusServiceUnavailable)
+	defer unhealthy.Close()
+
+	healthyEndpoint := s.endpointFor(healthy, "/health")
+	unhealthyEndpoint := s.endpointFor(unhealthy, "health")
+
+	s.registry.Register("foo", healthyEndpoint)
+	s.registry.Register("foo", unhealthyEndpoint)
+
+	s.CheckAll()
+
+	c.Check(healthyEndpoint.State(), Equals, route.EndpointHealthy)
+	c.Check(unhealthyEndpoint.State(), Equals, route.EndpointUnhealthy)
+
+	result, _ := s.Result(unhealthyEndpoint.CanonicalAddr())
+	c.Check(result.Path, Equals, "health")
+	c.Check(result.Error, Equals, "unexpected status code 503")
+
+	for i := 0; i < 10; i++ {
+		endpoint, ok := s.registry.Lookup("foo")
+		c.Assert(ok, Equals, true)
+		c.Check(endpoint, Equals, healthyEndpoint)
+	}
+}
+
+func (s *HealthCheckerSuite) TestTlsChecks(c *C) {
+	certPEM, keyPEM := test.GenerateCertificate("127.0.0.1")
+	c.Assert(s.rootCAs.AppendCertsFromPEM(certPEM), Equals, true)
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	c.Assert(err, IsNil)
+
+	// Nothing listens on the plaintext port
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	closed.Close()
+
+	for _, path := range []string{"", "/health"} {
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+		c.Assert(err, IsNil)
+		defer ln.Close()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+			c.Check(r.TLS, NotNil)
+		})
+
+		go http.Serve(ln, mux)
+
+		endpoint := s.endpointFor(closed, path)
+		endpoint.TLSPort = s.endpointFor(ln, "").Port
+		s.registry.Register(route.Uri("foo"+path), endpoint)
+
+		s.CheckAll()
+
+		result, ok := s.Result(endpoint.CanonicalAddr())
+		c.Assert(ok, Equals, true)
+		c.Check(result.Error, Equals, "")
+		c.Check(endpoint.State(), Equals, route.EndpointHealthy)
+
+		s.registry.Unregister(route.Uri("foo"+path), endpoint)
+	}
+}
+
+func (s *HealthCheckerSuite) TestCheckAppliesToEveryRouteOfAnAddress(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	ln.Close()
+
+	foo := s.endpointFor(ln, "")
+	bar := s.endpointFor(ln, "")
+
+	s.registry.Register("foo", foo)
+	s.registry.Register("bar", bar)
+
+	s.CheckAll()
+
+	c.Check(foo.State(), Equals, route.EndpointUnhealthy)
+	c.Check(bar.State(), Equals, route.EndpointUnhealthy)
+}
+
+func (s *HealthCheckerSuite) TestResultsAreForgottenWhenEndpointIsRemoved(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	endpoint := s.endpointFor(ln, "")
+	s.registry.Register("foo", endpoint)
+
+	s.CheckAll()
+
+	b, err := json.Marshal(s.HealthChecker)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Matches, `\{"127\.0\.0\.1:\d+":\{"address":"127\.0\.0\.1:\d+","healthy":true,.*\}\}`)
+
+	s.registry.Unregister("foo", endpoint)
+
+	_, ok := s.Result(endpoint.CanonicalAddr())
+	c.Check(ok, Equals, false)
+}
+
+func (s *HealthCheckerSuite) TestResultsOfRunningChecksAreDroppedWhenEndpointIsRemoved(c *C) {
+	checking := make(chan bool)
+	release := make(chan bool)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		checking <- true
+		<-release
+	})
+
+	go http.Serve(ln, mux)
+
+	endpoint := s.endpointFor(ln, "/health")
+	s.registry.Register("foo", endpoint)
+
+	done := make(chan bool)
+	go func() {
+		s.CheckAll()
+		done <- true
+	}()
+
+	<-checking
+	s.registry.Unregister("foo", endpoint)
+	close(release)
+	<-done
+
+	_, ok := s.Result(endpoint.CanonicalAddr())
+	c.Check(ok, Equals, false)
+
+	s.registry.Register("foo", endpoint)
+	go func() {
+		<-checking
+	}()
+	s.CheckAll()
+
+	result, ok := s.Result(endpoint.CanonicalAddr())
+	c.Assert(ok, Equals, true)
+	c.Check(result.Healthy, Equals, true)
+}
+
+func (s *HealthCheckerSuite) TestChecksAreRateLimited(c *C) {
+	s.maxChecksPerSecond = 50
+
+	for i := 0; i < 5; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, IsNil)
+		defer ln.Close()
+
+		s.registry.Register("foo", s.endpointFor(ln, ""))
+	}
+
+	startedAt := time.Now()
+	s.CheckAll()
+
+	c.Check(time.Since(startedAt) >= 100*time.Millisecond, Equals, true)
+}
@@ -139,6 +139,57 @@ func (s *IntegrationSuite) TestNatsConnectivity(c *C) {
 	}
 }
 
+func (s *IntegrationSuite) TestUnregisterDuringDrain(c *C) {
+	proxyPort := nextAvailPort()
+	statusPort := nextAvailPort()
+
+	s.Config = SpecConfig(s.natsPort, statusPort, proxyPort)
+	s.Config.EndpointTimeout = 5 * time.Second
+	s.Config.DrainTimeout = 5 * time.Second
+
+	s.router = NewRouter(s.Config)
+	s.router.Run()
+
+	s.mbusClient = s.router.mbusClient
+
+	slowApp := test.NewSlowApp([]route.Uri{"slow.vcap.me"}, proxyPort, s.mbusClient, time.Second)
+	slowApp.Listen()
+
+	otherApp := test.NewGreetApp([]route.Uri{"other.vcap.me"}, proxyPort, s.mbusClient, nil)
+	otherApp.Listen()
+
+	c.Assert(s.waitAppRegistered(slowApp, 2*time.Second), Equals, true)
+	c.Assert(s.waitAppRegistered(otherApp, 2*time.Second), Equals, true)
+
+	responded := make(chan error)
+	go func() {
+		responded <- slowApp.CheckAppStatus(200)
+	}()
+
+	// Let the slow request reach the app
+	time.Sleep(200 * time.Millisecond)
+
+	drained := make(chan bool)
+	go func() {
+		s.router.Drain()
+		drained <- true
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	otherApp.Unregister()
+
+	c.Check(s.waitAppUnregistered(otherApp, 500*time.Millisecond), Equals, true)
+
+	select {
+	case <-drained:
+		c.Error("Finished draining before the slow request did")
+	default:
+	}
+
+	c.Check(<-responded, IsNil)
+	<-drained
+}
+
 func (s *IntegrationSuite) startNats(port uint16) {
 	s.natsPort = port
 	s.natsCmd = StartNats(int(port))
@@ -201,3 +252,7 @@ func (s *IntegrationSuite) waitMsgReceived(a *test.TestApp, shouldBeRegistered b
 func (s *IntegrationSuite) waitAppRegistered(app *test.TestApp, timeout time.Duration) bool {
 	return s.waitMsgReceived(app, true, timeout)
 }
+
+func (s *IntegrationSuite) waitAppUnregistered(app *test.TestApp, timeout time.Duration) bool {
+	return s.waitMsgReceived(app, false, timeout)
+}
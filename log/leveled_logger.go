@@ -0,0 +1,32 @@
+package log
+
+import (
+	"sync/atomic"
+
+	steno "github.com/cloudfoundry/gosteno"
+)
+
+// Priority of the most verbose level records are logged at.
+var levelPriority int32 = int32(steno.LOG_ALL.Priority)
+
+// leveledLogger drops records above the current log level before steno
+// builds them. Steno fixes the level of a logger when it is created, so
+// loggers are created logging everything and the level is applied here
+// instead, where it can be changed later on.
+type leveledLogger struct {
+	steno.L
+}
+
+func (l leveledLogger) Log(x steno.LogLevel, m string, d map[string]interface{}) {
+	if int32(x.Priority) > atomic.LoadInt32(&levelPriority) {
+		return
+	}
+
+	l.L.Log(x, m, d)
+}
+
+// NewLogger returns a steno logger following the level set with
+// SetupLoggerFromConfig and SetLevel.
+func NewLogger(name string) *steno.Logger {
+	return &steno.Logger{L: leveledLogger{steno.NewLogger(name).L}}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/cloudfoundry/gorouter/config"
 	steno "github.com/cloudfoundry/gosteno"
 	"os"
+	"sync/atomic"
 )
 
 var logger *steno.Logger
@@ -41,14 +42,29 @@ func SetupLoggerFromConfig(c *config.Config) {
 
 	s = append(s, Counter)
 
+	atomic.StoreInt32(&levelPriority, int32(l.Priority))
+
 	stenoConfig := &steno.Config{
 		Sinks: s,
 		Codec: steno.NewJsonCodec(),
-		Level: l,
+		Level: steno.LOG_ALL,
 	}
 
 	steno.Init(stenoConfig)
-	logger = steno.NewLogger("router.global")
+	logger = NewLogger("router.global")
+}
+
+// SetLevel changes the level of every logger, including those already
+// created.
+func SetLevel(level string) error {
+	l, err := steno.GetLogLevel(level)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&levelPriority, int32(l.Priority))
+
+	return nil
 }
 
 func Fatal(msg string) { logger.Fatal(msg) }
@@ -22,3 +22,24 @@ func (s *LoggerSuite) TestSetupLoggerFromConfig(c *C) {
 	logger.Info("Hello")
 	c.Assert(Counter.GetCount("info"), Equals, count+1)
 }
+
+func (s *LoggerSuite) TestSetLevel(c *C) {
+	cfg := config.DefaultConfig()
+	cfg.Logging.File = "/tmp/gorouter.log"
+	cfg.Logging.Level = "info"
+
+	SetupLoggerFromConfig(cfg)
+
+	logger := NewLogger("test.level")
+
+	count := Counter.GetCount("debug")
+	logger.Debug("Hidden")
+	c.Check(Counter.GetCount("debug"), Equals, count)
+
+	c.Assert(SetLevel("debug"), IsNil)
+
+	logger.Debug("Shown")
+	c.Check(Counter.GetCount("debug"), Equals, count+1)
+
+	c.Check(SetLevel("unknown"), NotNil)
+}
@@ -21,7 +21,7 @@ func BenchmarkRegister(b *testing.B) {
 	c := config.DefaultConfig()
 	mbus := fakeyagnats.New()
 	r := registry.NewRegistry(c, mbus)
-	p := proxy.NewProxy(c, r, varz.NewVarz(r))
+	p := proxy.NewProxy(c, r, varz.NewVarz(c, r))
 
 	for i := 0; i < b.N; i++ {
 		str := strconv.Itoa(i)
@@ -35,3 +35,32 @@ func BenchmarkRegister(b *testing.B) {
 		)
 	}
 }
+
+func BenchmarkLookupWildcard(b *testing.B) {
+	c := config.DefaultConfig()
+	mbus := fakeyagnats.New()
+	r := registry.NewRegistry(c, mbus)
+
+	for i := 0; i < 50000; i++ {
+		str := strconv.Itoa(i)
+
+		r.Register(
+			route.Uri("bench"+str+".vcap.me"),
+			&route.Endpoint{
+				Host: "localhost",
+				Port: uint16(i),
+			},
+		)
+	}
+
+	r.Register(route.Uri("*.vcap.me"), &route.Endpoint{Host: "localhost", Port: 1})
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, ok := r.Lookup(route.Uri("unknown.vcap.me/some/path"))
+		if !ok {
+			b.Fatal("wildcard route not found")
+		}
+	}
+}
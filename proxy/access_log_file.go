@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/log"
+)
+
+// Rotated files are named after the time they were rotated at, so that they
+// sort in the order they were written in.
+const accessLogBackupTimeFormat = "2006-01-02T15-04-05.000"
+
+var errAccessLogFileClosed = errors.New("access log file is closed")
+
+// AccessLogFile is an access log file that can be reopened after it has been
+// moved away by tools like logrotate, and that can rotate itself as set up
+// in its config.
+type AccessLogFile struct {
+	sync.Mutex
+	config.AccessLogRotationConfig
+
+	path     string
+	f        *os.File
+	size     int64
+	openedAt time.Time
+	closed   bool
+
+	// Only regular files are rotated, not the likes of /dev/null
+	regular bool
+
+	// Compressing and removing rotated files happens in the background
+	cleanups    sync.WaitGroup
+	cleanupLock sync.Mutex
+}
+
+func OpenAccessLogFile(path string, c config.AccessLogRotationConfig) (*AccessLogFile, error) {
+	f := &AccessLogFile{
+		AccessLogRotationConfig: c,
+		path:                    path,
+	}
+
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *AccessLogFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.f = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	f.regular = info.Mode().IsRegular()
+
+	return nil
+}
+
+func (f *AccessLogFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return 0, errAccessLogFileClosed
+	}
+
+	// Try again if the file couldn't be opened during the last rotation
+	if f.f == nil {
+		err := f.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if f.shouldRotate(len(p)) {
+		err := f.rotate()
+		if err != nil {
+			log.Errorf("Could not rotate %s: %s", f.path, err)
+
+			if f.f == nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+func (f *AccessLogFile) shouldRotate(n int) bool {
+	if !f.regular {
+		return false
+	}
+
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(n) > f.MaxSize {
+		return true
+	}
+
+	if f.Interval > 0 && time.Since(f.openedAt) >= f.Interval {
+		return true
+	}
+
+	return false
+}
+
+// Reopen closes the file and opens the file at its path again, creating it
+// if it has been moved away.
+func (f *AccessLogFile) Reopen() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return errAccessLogFileClosed
+	}
+
+	if f.f != nil {
+		f.f.Close()
+		f.f = nil
+	}
+
+	return f.open()
+}
+
+// rotate moves the file aside and starts writing to a new one.
+func (f *AccessLogFile) rotate() error {
+	backup := f.path + "." + time.Now().Format(accessLogBackupTimeFormat)
+
+	err := os.Rename(f.path, backup)
+	if err != nil {
+		return err
+	}
+
+	f.f.Close()
+	f.f = nil
+
+	err = f.open()
+	if err != nil {
+		return err
+	}
+
+	f.cleanups.Add(1)
+	go f.cleanup(backup)
+
+	return nil
+}
+
+func (f *AccessLogFile) cleanup(backup string) {
+	defer f.cleanups.Done()
+
+	f.cleanupLock.Lock()
+	defer f.cleanupLock.Unlock()
+
+	if f.Compress {
+		err := compressFile(backup)
+		if err != nil {
+			log.Errorf("Could not compress %s: %s", backup, err)
+		}
+	}
+
+	if f.MaxBackups > 0 {
+		backups, err := f.backups()
+		if err != nil {
+			log.Errorf("Could not list rotated access logs: %s", err)
+			return
+		}
+
+		for len(backups) > f.MaxBackups {
+			err = os.Remove(backups[0])
+			if err != nil {
+				log.Errorf("Could not remove %s: %s", backups[0], err)
+			}
+
+			backups = backups[1:]
+		}
+	}
+}
+
+// backups returns the paths of the rotated files, oldest first.
+func (f *AccessLogFile) backups() ([]string, error) {
+	dir, base := filepath.Split(f.path)
+	if dir == "" {
+		dir = "."
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []string{}
+	for _, info := range infos {
+		name := info.Name()
+		if info.Mode().IsRegular() && isAccessLogBackup(base, name) {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+
+	sort.Strings(backups)
+
+	return backups, nil
+}
+
+func isAccessLogBackup(base, name string) bool {
+	if !strings.HasPrefix(name, base+".") {
+		return false
+	}
+
+	suffix := strings.TrimSuffix(name[len(base)+1:], ".gz")
+
+	_, err := time.Parse(accessLogBackupTimeFormat, suffix)
+	return err == nil
+}
+
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(out)
+
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Close closes the file, after waiting for rotated files to be cleaned up.
+func (f *AccessLogFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.cleanups.Wait()
+	f.closed = true
+
+	if f.f == nil {
+		return nil
+	}
+
+	err := f.f.Close()
+	f.f = nil
+
+	return err
+}
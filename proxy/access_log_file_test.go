@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/config"
+	. "launchpad.net/gocheck"
+)
+
+type AccessLogFileSuite struct {
+	dir  string
+	path string
+}
+
+var _ = Suite(&AccessLogFileSuite{})
+
+func (s *AccessLogFileSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.path = filepath.Join(s.dir, "access.log")
+}
+
+func (s *AccessLogFileSuite) files(c *C) []string {
+	infos, err := ioutil.ReadDir(s.dir)
+	c.Assert(err, IsNil)
+
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (s *AccessLogFileSuite) read(c *C, path string) string {
+	b, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	return string(b)
+}
+
+func (s *AccessLogFileSuite) TestAppendsToExistingFile(c *C) {
+	c.Assert(ioutil.WriteFile(s.path, []byte("before\n"), 0666), IsNil)
+
+	f, err := OpenAccessLogFile(s.path, config.AccessLogRotationConfig{})
+	c.Assert(err, IsNil)
+
+	f.Write([]byte("after\n"))
+	f.Close()
+
+	c.Check(s.read(c, s.path), Equals, "before\nafter\n")
+}
+
+func (s *AccessLogFileSuite) TestReopen(c *C) {
+	f, err := OpenAccessLogFile(s.path, config.AccessLogRotationConfig{})
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	f.Write([]byte("first\n"))
+	c.Assert(os.Rename(s.path, s.path+".1"), IsNil)
+
+	// Still written to the moved file until reopened
+	f.Write([]byte("second\n"))
+	c.Assert(f.Reopen(), IsNil)
+	f.Write([]byte("third\n"))
+
+	c.Check(s.read(c, s.path+".1"), Equals, "first\nsecond\n")
+	c.Check(s.read(c, s.path), Equals, "third\n")
+}
+
+func (s *AccessLogFileSuite) TestRotatesBySize(c *C) {
+	f, err := OpenAccessLogFile(s.path, config.AccessLogRotationConfig{MaxSize: 10})
+	c.Assert(err, IsNil)
+
+	f.Write([]byte("12345\n"))
+	f.Write([]byte("1234\n"))
+	f.Write([]byte("abc\n"))
+	f.Close()
+
+	files := s.files(c)
+	c.Assert(files, HasLen, 2)
+	c.Check(files[0], Equals, "access.log")
+	c.Check(isAccessLogBackup("access.log", files[1]), Equals, true)
+
+	c.Check(s.read(c, filepath.Join(s.dir, files[1])), Equals, "12345\n")
+	c.Check(s.read(c, s.path), Equals, "1234\nabc\n")
+}
+
+func (s *AccessLogFileSuite) TestRotatesByInterval(c *C) {
+	f, err := OpenAccessLogFile(s.path, config.AccessLogRotationConfig{Interval: time.Hour})
+	c.Assert(err, IsNil)
+
+	f.Write([]byte("old\n"))
+	f.openedAt = time.Now().Add(-time.Hour)
+	f.Write([]byte("new\n"))
+	f.Close()
+
+	c.Check(s.files(c), HasLen, 2)
+	c.Check(s.read(c, s.path), Equals, "new\n")
+}
+
+func (s *AccessLogFileSuite) TestDoesNotRotateDevices(c *C) {
+	f, err := OpenAccessLogFile(os.DevNull, config.AccessLogRotationConfig{MaxSize: 1})
+	c.Assert(err, IsNil)
+
+	f.Write([]byte("a\n"))
+	f.Write([]byte("b\n"))
+	f.Close()
+
+	_, err = os.Stat(os.DevNull)
+	c.Check(err, IsNil)
+}
+
+func (s *AccessLogFileSuite) TestCompressesRotatedFiles(c *C) {
+	f, err := OpenAccessLogFile(s.path, config.AccessLogRotationConfig{MaxSize: 1, Compress: true})
+	c.Assert(err, IsNil)
+
+	f.Write([]byte("first\n"))
+	f.Write([]byte("second\n"))
+	f.Close()
+
+	files := s.files(c)
+	c.Assert(files, HasLen, 2)
+	c.Check(filepath.Ext(files[1]), Equals, ".gz")
+
+	gz, err := os.Open(filepath.Join(s.dir, files[1]))
+	c.Assert(err, IsNil)
+	defer gz.Close()
+
+	r, err := gzip.NewReader(gz)
+	c.Assert(err, IsNil)
+
+	b, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, "first\n")
+}
+
+func (s *AccessLogFileSuite) TestKeepsMaxBackups(c *C) {
+	other := filepath.Join(s.dir, "access.log.old")
+	c.Assert(ioutil.WriteFile(other, []byte("unrelated\n"), 0666), IsNil)
+
+	f, err := OpenAccessLogFile(s.path, config.AccessLogRotationConfig{MaxSize: 1, MaxBackups: 2})
+	c.Assert(err, IsNil)
+
+	for _, line := range []string{"1\n", "2\n", "3\n", "4\n"} {
+		f.Write([]byte(line))
+
+		// Rotated files are named after the millisecond they're rotated in
+		time.Sleep(2 * time.Millisecond)
+	}
+	f.Close()
+
+	files := s.files(c)
+	c.Assert(files, HasLen, 4)
+	c.Check(files[0], Equals, "access.log")
+	c.Check(s.read(c, filepath.Join(s.dir, files[1])), Equals, "2\n")
+	c.Check(s.read(c, filepath.Join(s.dir, files[2])), Equals, "3\n")
+	c.Check(files[3], Equals, "access.log.old")
+}
+
+func (s *AccessLogFileSuite) TestWriteAfterClose(c *C) {
+	f, err := OpenAccessLogFile(s.path, config.AccessLogRotationConfig{})
+	c.Assert(err, IsNil)
+	f.Close()
+
+	_, err = f.Write([]byte("a\n"))
+	c.Check(err, NotNil)
+	c.Check(f.Reopen(), NotNil)
+}
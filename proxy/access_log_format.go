@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/route"
+)
+
+const (
+	AccessLogFormatText = "text"
+	AccessLogFormatJSON = "json"
+)
+
+// AccessLogFormat turns access log records into lines of the access log.
+type AccessLogFormat interface {
+	// Format appends the line for r, including its trailing newline, to b.
+	Format(b *bytes.Buffer, r *AccessLogRecord) error
+}
+
+// NewAccessLogFormat returns the built-in format with the given name, or
+// parses format as a template over the record's fields and methods when it
+// isn't one. A trailing newline is added to templates that lack it.
+func NewAccessLogFormat(format string) (AccessLogFormat, error) {
+	switch format {
+	case "", AccessLogFormatText:
+		return textAccessLogFormat{}, nil
+	case AccessLogFormatJSON:
+		return jsonAccessLogFormat{}, nil
+	}
+
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
+	}
+
+	t, err := template.New("access_log_format").Parse(format)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unknown fields only show up when executing the template
+	err = t.Execute(ioutil.Discard, sampleAccessLogRecord())
+	if err != nil {
+		return nil, err
+	}
+
+	return &templateAccessLogFormat{t}, nil
+}
+
+// sampleAccessLogRecord returns a record with everything set, so templates
+// following pointers in it can be checked.
+func sampleAccessLogRecord() *AccessLogRecord {
+	request := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/"},
+		Proto:  "HTTP/1.1",
+		Header: make(http.Header),
+		Host:   "localhost",
+	}
+
+	return &AccessLogRecord{
+		Request: request,
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Request:    request,
+		},
+		RouteEndpoint: &route.Endpoint{
+			Host: "127.0.0.1",
+			Port: 8080,
+			Tags: make(map[string]string),
+		},
+	}
+}
+
+type textAccessLogFormat struct{}
+
+func (f textAccessLogFormat) Format(b *bytes.Buffer, r *AccessLogRecord) error {
+	fmt.Fprintf(b, `%s - `, r.Host())
+	fmt.Fprintf(b, `[%s] `, r.FormatStartedAt())
+	fmt.Fprintf(b, `"%s %s %s" `, r.Method(), r.URI(), r.Proto())
+	fmt.Fprintf(b, `%d `, r.StatusCode())
+	fmt.Fprintf(b, `%d `, r.BodyBytesSent)
+	fmt.Fprintf(b, `"%s" `, r.FormatRequestHeader("Referer"))
+	fmt.Fprintf(b, `"%s" `, r.FormatRequestHeader("User-Agent"))
+	fmt.Fprintf(b, `%s `, r.RemoteAddr())
+	fmt.Fprintf(b, `response_time:%.9f `, r.ResponseTime())
+	fmt.Fprintf(b, `app_id:%s`, r.ApplicationId())
+	fmt.Fprint(b, "\n")
+	return nil
+}
+
+type jsonAccessLogRecord struct {
+	Host          string  `json:"host"`
+	StartedAt     string  `json:"started_at"`
+	Method        string  `json:"method"`
+	URI           string  `json:"uri"`
+	Proto         string  `json:"proto"`
+	StatusCode    int     `json:"status"`
+	BodyBytesSent int64   `json:"body_bytes_sent"`
+	Referer       string  `json:"referer,omitempty"`
+	UserAgent     string  `json:"user_agent,omitempty"`
+	XForwardedFor string  `json:"x_forwarded_for,omitempty"`
+	RemoteAddr    string  `json:"remote_addr"`
+	ResponseTime  float64 `json:"response_time"`
+	ApplicationId string  `json:"app_id,omitempty"`
+	Endpoint      string  `json:"endpoint,omitempty"`
+	Attempts      int     `json:"attempts"`
+	RequestId     string  `json:"request_id,omitempty"`
+	RouterError   string  `json:"router_error,omitempty"`
+}
+
+type jsonAccessLogFormat struct{}
+
+func (f jsonAccessLogFormat) Format(b *bytes.Buffer, r *AccessLogRecord) error {
+	y := jsonAccessLogRecord{
+		Host:          r.Host(),
+		StartedAt:     r.StartedAt.Format(time.RFC3339Nano),
+		Method:        r.Method(),
+		URI:           r.URI(),
+		Proto:         r.Proto(),
+		StatusCode:    r.StatusCode(),
+		BodyBytesSent: r.BodyBytesSent,
+		Referer:       r.RequestHeader("Referer"),
+		UserAgent:     r.RequestHeader("User-Agent"),
+		XForwardedFor: r.RequestHeader("X-Forwarded-For"),
+		RemoteAddr:    r.RemoteAddr(),
+		ResponseTime:  r.ResponseTime(),
+		ApplicationId: r.ApplicationId(),
+		Endpoint:      r.EndpointAddress(),
+		Attempts:      r.Attempts,
+		RequestId:     r.RequestId,
+		RouterError:   r.RouterError,
+	}
+
+	// The encoder ends the line with a newline
+	return json.NewEncoder(b).Encode(y)
+}
+
+type templateAccessLogFormat struct {
+	t *template.Template
+}
+
+func (f *templateAccessLogFormat) Format(b *bytes.Buffer, r *AccessLogRecord) error {
+	return f.t.Execute(b, r)
+}
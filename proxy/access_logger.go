@@ -2,26 +2,31 @@ package proxy
 
 import (
 	"bytes"
-	"fmt"
 	"github.com/cloudfoundry/gorouter/log"
 	"github.com/cloudfoundry/gorouter/route"
-	steno "github.com/cloudfoundry/gosteno"
 	"github.com/cloudfoundry/loggregatorlib/emitter"
 	"io"
 	"net/http"
 	"regexp"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type AccessLogRecord struct {
 	Request       *http.Request
+	RequestId     string
 	Response      *http.Response
 	RouteEndpoint *route.Endpoint
 	StartedAt     time.Time
 	FirstByteAt   time.Time
 	FinishedAt    time.Time
 	BodyBytesSent int64
+	Attempts      int
+
+	// Why the router responded itself, as in the X-Cf-RouterError header
+	RouterError string
 }
 
 var ipAddressRegex, _ = regexp.Compile(`^(([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\.){3}([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])(:[0-9]{1,5}){1}$`)
@@ -32,30 +37,108 @@ func (r *AccessLogRecord) FormatStartedAt() string {
 }
 
 func (r *AccessLogRecord) FormatRequestHeader(k string) (v string) {
-	v = r.Request.Header.Get(k)
+	v = r.RequestHeader(k)
 	if v == "" {
 		v = "-"
 	}
 	return
 }
 
+func (r *AccessLogRecord) FormatResponseHeader(k string) (v string) {
+	v = r.ResponseHeader(k)
+	if v == "" {
+		v = "-"
+	}
+	return
+}
+
+func (r *AccessLogRecord) RequestHeader(k string) string {
+	if r.Request == nil {
+		return ""
+	}
+
+	return r.Request.Header.Get(k)
+}
+
+func (r *AccessLogRecord) ResponseHeader(k string) string {
+	if r.Response == nil {
+		return ""
+	}
+
+	return r.Response.Header.Get(k)
+}
+
+func (r *AccessLogRecord) Host() string {
+	if r.Request == nil {
+		return ""
+	}
+
+	return r.Request.Host
+}
+
+func (r *AccessLogRecord) Method() string {
+	if r.Request == nil {
+		return ""
+	}
+
+	return r.Request.Method
+}
+
+func (r *AccessLogRecord) URI() string {
+	if r.Request == nil || r.Request.URL == nil {
+		return ""
+	}
+
+	return r.Request.URL.RequestURI()
+}
+
+func (r *AccessLogRecord) Proto() string {
+	if r.Request == nil {
+		return ""
+	}
+
+	return r.Request.Proto
+}
+
+func (r *AccessLogRecord) RemoteAddr() string {
+	if r.Request == nil {
+		return ""
+	}
+
+	return r.Request.RemoteAddr
+}
+
+func (r *AccessLogRecord) StatusCode() int {
+	if r.Response == nil {
+		return 0
+	}
+
+	return r.Response.StatusCode
+}
+
+func (r *AccessLogRecord) ApplicationId() string {
+	if r.RouteEndpoint == nil {
+		return ""
+	}
+
+	return r.RouteEndpoint.ApplicationId
+}
+
+func (r *AccessLogRecord) EndpointAddress() string {
+	if r.RouteEndpoint == nil {
+		return ""
+	}
+
+	return r.RouteEndpoint.CanonicalAddr()
+}
+
 func (r *AccessLogRecord) ResponseTime() float64 {
 	return float64(r.FinishedAt.UnixNano()-r.StartedAt.UnixNano()) / float64(time.Second)
 }
 
 func (r *AccessLogRecord) makeRecord() *bytes.Buffer {
 	b := &bytes.Buffer{}
-	fmt.Fprintf(b, `%s - `, r.Request.Host)
-	fmt.Fprintf(b, `[%s] `, r.FormatStartedAt())
-	fmt.Fprintf(b, `"%s %s %s" `, r.Request.Method, r.Request.URL.RequestURI(), r.Request.Proto)
-	fmt.Fprintf(b, `%d `, r.Response.StatusCode)
-	fmt.Fprintf(b, `%d `, r.BodyBytesSent)
-	fmt.Fprintf(b, `"%s" `, r.FormatRequestHeader("Referer"))
-	fmt.Fprintf(b, `"%s" `, r.FormatRequestHeader("User-Agent"))
-	fmt.Fprintf(b, `%s `, r.Request.RemoteAddr)
-	fmt.Fprintf(b, `response_time:%.9f `, r.ResponseTime())
-	fmt.Fprintf(b, `app_id:%s`, r.RouteEndpoint.ApplicationId)
-	fmt.Fprint(b, "\n")
+	textAccessLogFormat{}.Format(b, r)
 	return b
 }
 
@@ -65,30 +148,50 @@ func (r *AccessLogRecord) WriteTo(w io.Writer) (int64, error) {
 }
 
 func (r *AccessLogRecord) Emit(e emitter.Emitter) {
-	if r.RouteEndpoint.ApplicationId != "" {
+	// Requests the router answered itself may not have an endpoint
+	appId := r.ApplicationId()
+	if appId != "" {
 		b := r.makeRecord()
 		message := b.String()
 		log.Debugf("Logging to the loggregator: %s", message)
-		e.Emit(r.RouteEndpoint.ApplicationId, message)
+		e.Emit(appId, message)
 	}
 }
 
+// Most records written to the access log at once
+const accessLogMaxBatch = 64
+
 type AccessLogger struct {
-	e     emitter.Emitter
-	c     chan AccessLogRecord
-	w     io.Writer
-	index uint
+	// Updated atomically, and first in the struct to be 64-bit aligned
+	written int64
+	dropped int64
+
+	sync.Mutex
+
+	e      emitter.Emitter
+	c      chan AccessLogRecord
+	w      io.Writer
+	format AccessLogFormat
+	index  uint
+
+	dropWhenFull bool
 }
 
-func NewAccessLogger(f io.Writer, loggregatorUrl, loggregatorSharedSecret string, index uint) *AccessLogger {
+// NewAccessLogger returns an access logger queueing up to bufferSize records.
+// Log blocks while the queue is full, or drops the record if dropWhenFull is
+// set.
+func NewAccessLogger(f io.Writer, loggregatorUrl, loggregatorSharedSecret string, index uint, bufferSize int, dropWhenFull bool) *AccessLogger {
 	a := &AccessLogger{
-		w:     f,
-		c:     make(chan AccessLogRecord, 128),
-		index: index,
+		w:      f,
+		c:      make(chan AccessLogRecord, bufferSize),
+		format: textAccessLogFormat{},
+		index:  index,
+
+		dropWhenFull: dropWhenFull,
 	}
 
 	if isValidUrl(loggregatorUrl) {
-		a.e, _ = emitter.NewEmitter(loggregatorUrl, "RTR", strconv.FormatUint(uint64(index), 10), loggregatorSharedSecret, steno.NewLogger("router.loggregator"))
+		a.e, _ = emitter.NewEmitter(loggregatorUrl, "RTR", strconv.FormatUint(uint64(index), 10), loggregatorSharedSecret, log.NewLogger("router.loggregator"))
 	} else {
 		log.Errorf("Invalid loggregator url %s", loggregatorUrl)
 	}
@@ -97,22 +200,121 @@ func NewAccessLogger(f io.Writer, loggregatorUrl, loggregatorSharedSecret string
 }
 
 func (x *AccessLogger) Run() {
+	batch := make([]AccessLogRecord, 0, accessLogMaxBatch)
+
 	for r := range x.c {
+		batch = append(batch[:0], r)
+
+		// Write the records that queued up in the meantime along with it
+	queued:
+		for len(batch) < accessLogMaxBatch {
+			select {
+			case r, ok := <-x.c:
+				if !ok {
+					break queued
+				}
+
+				batch = append(batch, r)
+			default:
+				break queued
+			}
+		}
+
+		x.Lock()
 		if x.w != nil {
-			r.WriteTo(x.w)
+			x.write(batch)
 		}
+		x.Unlock()
+
 		if x.e != nil {
-			r.Emit(x.e)
+			for i := range batch {
+				batch[i].Emit(x.e)
+			}
 		}
 	}
 }
 
+// SetWriter switches the writer records are written to, returning the
+// previous one. Nothing is written to the previous writer once it returns.
+func (x *AccessLogger) SetWriter(w io.Writer) io.Writer {
+	x.Lock()
+	defer x.Unlock()
+
+	previous := x.w
+	x.w = w
+
+	return previous
+}
+
+func (x *AccessLogger) Writer() io.Writer {
+	x.Lock()
+	defer x.Unlock()
+
+	return x.w
+}
+
+// SetFormat changes the format of records written from now on. Records sent
+// to loggregator keep the text format.
+func (x *AccessLogger) SetFormat(format AccessLogFormat) {
+	x.Lock()
+	defer x.Unlock()
+
+	x.format = format
+}
+
+func (x *AccessLogger) write(batch []AccessLogRecord) {
+	b := &bytes.Buffer{}
+	n := 0
+
+	for i := range batch {
+		l := b.Len()
+
+		err := x.format.Format(b, &batch[i])
+		if err != nil {
+			// Whatever was written of the record would run into the next
+			b.Truncate(l)
+
+			log.Warnf("Could not format access log record: %s", err)
+			continue
+		}
+
+		n++
+	}
+
+	_, err := b.WriteTo(x.w)
+	if err != nil {
+		log.Warnf("Could not write access log: %s", err)
+		return
+	}
+
+	atomic.AddInt64(&x.written, int64(n))
+}
+
 func (x *AccessLogger) Stop() {
 	close(x.c)
 }
 
 func (x *AccessLogger) Log(r AccessLogRecord) {
-	x.c <- r
+	if !x.dropWhenFull {
+		x.c <- r
+		return
+	}
+
+	select {
+	case x.c <- r:
+	default:
+		atomic.AddInt64(&x.dropped, 1)
+	}
+}
+
+// Written returns the number of records written to the access log file.
+func (x *AccessLogger) Written() int64 {
+	return atomic.LoadInt64(&x.written)
+}
+
+// Dropped returns the number of records dropped because the queue was full.
+func (x *AccessLogger) Dropped() int64 {
+	return atomic.LoadInt64(&x.dropped)
 }
 
 func isValidUrl(url string) bool {
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bytes"
+	"encoding/json"
 	"github.com/cloudfoundry/gorouter/route"
 	"github.com/cloudfoundry/loggregatorlib/logmessage"
 	. "launchpad.net/gocheck"
@@ -9,6 +10,7 @@ import (
 	"net/url"
 	"regexp"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -65,6 +67,7 @@ func (s *AccessLoggerSuite) CreateAccessLogRecord() *AccessLogRecord {
 		FirstByteAt:   time.Unix(10, 200000000),
 		FinishedAt:    time.Unix(10, 300000000),
 		BodyBytesSent: 42,
+		Attempts:      1,
 	}
 
 	return &r
@@ -80,6 +83,102 @@ func (s *AccessLoggerSuite) TestAccessLogRecordEncode(c *C) {
 	c.Check(b.String(), Matches, "^"+logMessageRegex+"\n")
 }
 
+func (s *AccessLoggerSuite) TestRouterErrorIsFormatted(c *C) {
+	r := s.CreateAccessLogRecord()
+	r.RouterError = "endpoint_failure"
+
+	b := &bytes.Buffer{}
+	c.Assert(jsonAccessLogFormat{}.Format(b, r), IsNil)
+	c.Check(strings.Contains(b.String(), `"router_error":"endpoint_failure"`), Equals, true)
+}
+
+func (s *AccessLoggerSuite) TestTextFormatIsUnchanged(c *C) {
+	r := s.CreateAccessLogRecord()
+	r.RequestId = "abc"
+	r.RouterError = "endpoint_failure"
+
+	b := &bytes.Buffer{}
+	c.Assert(textAccessLogFormat{}.Format(b, r), IsNil)
+	c.Check(b.String(), Matches, "^"+logMessageRegex+"\n")
+}
+
+func (s *AccessLoggerSuite) TestJSONFormat(c *C) {
+	r := s.CreateAccessLogRecord()
+	r.Request.Header.Set("X-Forwarded-For", "5.6.7.8")
+
+	f, err := NewAccessLogFormat("json")
+	c.Assert(err, IsNil)
+
+	b := &bytes.Buffer{}
+	c.Assert(f.Format(b, r), IsNil)
+	c.Check(strings.HasSuffix(b.String(), "}\n"), Equals, true)
+
+	var fields map[string]interface{}
+	c.Assert(json.Unmarshal(b.Bytes(), &fields), IsNil)
+
+	c.Check(fields["host"], Equals, "foo.bar")
+	c.Check(fields["started_at"], Equals, r.StartedAt.Format(time.RFC3339Nano))
+	c.Check(fields["method"], Equals, "GET")
+	c.Check(fields["uri"], Equals, "/quz?wat")
+	c.Check(fields["status"], Equals, float64(200))
+	c.Check(fields["body_bytes_sent"], Equals, float64(42))
+	c.Check(fields["user_agent"], Equals, "user-agent")
+	c.Check(fields["x_forwarded_for"], Equals, "5.6.7.8")
+	c.Check(fields["response_time"], Equals, 0.2)
+	c.Check(fields["app_id"], Equals, "my_awesome_id")
+	c.Check(fields["endpoint"], Equals, "127.0.0.1:4567")
+	c.Check(fields["attempts"], Equals, float64(1))
+}
+
+func (s *AccessLoggerSuite) TestTemplateFormat(c *C) {
+	r := s.CreateAccessLogRecord()
+	r.Response.Header = http.Header{"Content-Type": []string{"text/plain"}}
+
+	f, err := NewAccessLogFormat(`{{.Method}} {{.Host}}{{.URI}} {{.StatusCode}} {{.EndpointAddress}} {{.FormatRequestHeader "Referer"}} {{.FormatResponseHeader "Content-Type"}} {{.FormatResponseHeader "Missing"}}`)
+	c.Assert(err, IsNil)
+
+	b := &bytes.Buffer{}
+	c.Assert(f.Format(b, r), IsNil)
+	c.Check(b.String(), Equals, "GET foo.bar/quz?wat 200 127.0.0.1:4567 referer text/plain -\n")
+}
+
+func (s *AccessLoggerSuite) TestInvalidTemplateFormat(c *C) {
+	_, err := NewAccessLogFormat(`{{.Method`)
+	c.Check(err, NotNil)
+
+	_, err = NewAccessLogFormat(`{{.Unknown}}`)
+	c.Check(err, NotNil)
+
+	_, err = NewAccessLogFormat(`{{.Request.Unknown}}`)
+	c.Check(err, NotNil)
+}
+
+func (s *AccessLoggerSuite) TestTemplateFormatFollowingPointers(c *C) {
+	f, err := NewAccessLogFormat(`{{.Request.Method}} {{.RouteEndpoint.Host}} {{.Response.StatusCode}}`)
+	c.Assert(err, IsNil)
+
+	b := &bytes.Buffer{}
+	c.Assert(f.Format(b, s.CreateAccessLogRecord()), IsNil)
+	c.Check(b.String(), Equals, "GET 127.0.0.1 200\n")
+}
+
+func (s *AccessLoggerSuite) TestWritingOfLogRecordsInFormat(c *C) {
+	var fakeFile = new(fakeFile)
+
+	f, err := NewAccessLogFormat("{{.ApplicationId}}")
+	c.Assert(err, IsNil)
+
+	accessLogger := NewAccessLogger(fakeFile, "", "", 42, 128, false)
+	accessLogger.SetFormat(f)
+
+	accessLogger.Log(*s.CreateAccessLogRecord())
+	go accessLogger.Run()
+	runtime.Gosched()
+
+	c.Check(string(fakeFile.payload), Equals, "my_awesome_id\n")
+	accessLogger.Stop()
+}
+
 type fakeFile struct {
 	payload []byte
 }
@@ -106,7 +205,7 @@ func (m *mockEmitter) EmitLogMessage(l *logmessage.LogMessage) {
 }
 
 func (s *AccessLoggerSuite) TestEmittingOfLogRecords(c *C) {
-	accessLogger := NewAccessLogger(nil, "localhost:9843", "secret", 42)
+	accessLogger := NewAccessLogger(nil, "localhost:9843", "secret", 42, 128, false)
 	testEmitter := &mockEmitter{emitted: false}
 	accessLogger.e = testEmitter
 
@@ -121,7 +220,7 @@ func (s *AccessLoggerSuite) TestEmittingOfLogRecords(c *C) {
 }
 
 func (s *AccessLoggerSuite) TestNotEmittingLogRecordsWithNoAppId(c *C) {
-	accessLogger := NewAccessLogger(nil, "localhost:9843", "secret", 42)
+	accessLogger := NewAccessLogger(nil, "localhost:9843", "secret", 42, 128, false)
 	testEmitter := &mockEmitter{emitted: false}
 	accessLogger.e = testEmitter
 
@@ -141,10 +240,20 @@ func (s *AccessLoggerSuite) TestNotEmittingLogRecordsWithNoAppId(c *C) {
 	accessLogger.Stop()
 }
 
+func (s *AccessLoggerSuite) TestNotEmittingLogRecordsWithNoEndpoint(c *C) {
+	testEmitter := &mockEmitter{emitted: false}
+
+	accessLogRecord := s.CreateAccessLogRecord()
+	accessLogRecord.RouteEndpoint = nil
+	accessLogRecord.Emit(testEmitter)
+
+	c.Check(testEmitter.emitted, Equals, false)
+}
+
 func (s *AccessLoggerSuite) TestWritingOfLogRecordsToTheFile(c *C) {
 	var fakeFile = new(fakeFile)
 
-	accessLogger := NewAccessLogger(fakeFile, "localhost:9843", "secret", 42)
+	accessLogger := NewAccessLogger(fakeFile, "localhost:9843", "secret", 42, 128, false)
 
 	accessLogger.Log(*s.CreateAccessLogRecord())
 	go accessLogger.Run()
@@ -154,39 +263,103 @@ func (s *AccessLoggerSuite) TestWritingOfLogRecordsToTheFile(c *C) {
 	accessLogger.Stop()
 }
 
+type recordingWriter struct {
+	writes []string
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.writes = append(w.writes, string(data))
+	return len(data), nil
+}
+
+func (s *AccessLoggerSuite) TestBatchingOfLogRecords(c *C) {
+	w := &recordingWriter{}
+
+	accessLogger := NewAccessLogger(w, "", "", 42, 128, false)
+	for i := 0; i < 3; i++ {
+		accessLogger.Log(*s.CreateAccessLogRecord())
+	}
+
+	// Run writes the queued records and returns once stopped
+	accessLogger.Stop()
+	accessLogger.Run()
+
+	c.Assert(w.writes, HasLen, 1)
+	c.Check(w.writes[0], Matches, "^("+logMessageRegex+"\n){3}$")
+	c.Check(accessLogger.Written(), Equals, int64(3))
+	c.Check(accessLogger.Dropped(), Equals, int64(0))
+}
+
+func (s *AccessLoggerSuite) TestSkippingOfRecordsFailingToFormat(c *C) {
+	w := &recordingWriter{}
+
+	f, err := NewAccessLogFormat("{{.Host}} {{.Request.Method}}")
+	c.Assert(err, IsNil)
+
+	accessLogger := NewAccessLogger(w, "", "", 42, 128, false)
+	accessLogger.SetFormat(f)
+
+	r := s.CreateAccessLogRecord()
+	r.Request = nil
+	accessLogger.Log(*r)
+	accessLogger.Log(*s.CreateAccessLogRecord())
+
+	accessLogger.Stop()
+	accessLogger.Run()
+
+	c.Assert(w.writes, HasLen, 1)
+	c.Check(w.writes[0], Equals, "foo.bar GET\n")
+	c.Check(accessLogger.Written(), Equals, int64(1))
+}
+
+func (s *AccessLoggerSuite) TestDroppingOfLogRecordsWhenFull(c *C) {
+	w := &recordingWriter{}
+
+	accessLogger := NewAccessLogger(w, "", "", 42, 2, true)
+	for i := 0; i < 5; i++ {
+		accessLogger.Log(*s.CreateAccessLogRecord())
+	}
+
+	accessLogger.Stop()
+	accessLogger.Run()
+
+	c.Check(accessLogger.Written(), Equals, int64(2))
+	c.Check(accessLogger.Dropped(), Equals, int64(3))
+}
+
 func (s *AccessLoggerSuite) TestRealEmitterIsNotNil(c *C) {
-	accessLogger := NewAccessLogger(nil, "localhost:9843", "secret", 42)
+	accessLogger := NewAccessLogger(nil, "localhost:9843", "secret", 42, 128, false)
 
 	c.Assert(accessLogger.e, Not(IsNil))
 }
 
 func (s *AccessLoggerSuite) TestNotCreatingEmitterWhenNoValidUrlIsGiven(c *C) {
-	accessLogger := NewAccessLogger(nil, "this_is_not_a_url", "secret", 42)
+	accessLogger := NewAccessLogger(nil, "this_is_not_a_url", "secret", 42, 128, false)
 	c.Assert(accessLogger.e, IsNil)
 	accessLogger.Stop()
 
-	accessLogger = NewAccessLogger(nil, "localhost", "secret", 42)
+	accessLogger = NewAccessLogger(nil, "localhost", "secret", 42, 128, false)
 	c.Assert(accessLogger.e, IsNil)
 	accessLogger.Stop()
 
-	accessLogger = NewAccessLogger(nil, "10.10.16.14", "secret", 42)
+	accessLogger = NewAccessLogger(nil, "10.10.16.14", "secret", 42, 128, false)
 	c.Assert(accessLogger.e, IsNil)
 	accessLogger.Stop()
 
-	accessLogger = NewAccessLogger(nil, "", "secret", 42)
+	accessLogger = NewAccessLogger(nil, "", "secret", 42, 128, false)
 	c.Assert(accessLogger.e, IsNil)
 	accessLogger.Stop()
 }
 
 func (s *AccessLoggerSuite) TestCreatingEmitterWithIPAddressAndPort(c *C) {
-	accessLogger := NewAccessLogger(nil, "10.10.16.14:5432", "secret", 42)
+	accessLogger := NewAccessLogger(nil, "10.10.16.14:5432", "secret", 42, 128, false)
 
 	c.Assert(accessLogger.e, NotNil)
 	accessLogger.Stop()
 }
 
 func (s *AccessLoggerSuite) TestCreatingEmitterWithLocalhostt(c *C) {
-	accessLogger := NewAccessLogger(nil, "localhost:123", "secret", 42)
+	accessLogger := NewAccessLogger(nil, "localhost:123", "secret", 42, 128, false)
 
 	c.Assert(accessLogger.e, NotNil)
 	accessLogger.Stop()
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/route"
+)
+
+// BackendTransport keeps a separate http.Transport per endpoint so that idle
+// keep-alive connections are bounded per endpoint and can be dropped as soon
+// as the endpoint goes away.
+type BackendTransport struct {
+	sync.Mutex
+
+	// By canonical address, then by transportKey
+	transports map[string]map[string]*http.Transport
+
+	// Also bounds how long dialing an endpoint takes
+	responseHeaderTimeout time.Duration
+	idleConnTimeout       time.Duration
+	maxIdleConnsPerHost   int
+
+	// Shared by all TLS endpoints; only the server name differs
+	tlsConfig *tls.Config
+}
+
+func NewBackendTransport(c *config.Config) *BackendTransport {
+	tlsConfig, err := newBackendTLSConfig(c.BackendTLS)
+	if err != nil {
+		panic(err)
+	}
+
+	return &BackendTransport{
+		transports: make(map[string]map[string]*http.Transport),
+
+		responseHeaderTimeout: c.EndpointTimeout,
+		idleConnTimeout:       c.EndpointIdleTimeout,
+		maxIdleConnsPerHost:   c.MaxIdleConnsPerEndpoint,
+
+		tlsConfig: tlsConfig,
+	}
+}
+
+func newBackendTLSConfig(c config.BackendTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if c.CACertsFile != "" {
+		b, err := ioutil.ReadFile(c.CACertsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificates found in " + c.CACertsFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// TLSConfigFor returns the TLS configuration to connect to an endpoint
+// with, or nil if the endpoint doesn't use TLS.
+func (t *BackendTransport) TLSConfigFor(endpoint *route.Endpoint) *tls.Config {
+	if !endpoint.UsesTLS() {
+		return nil
+	}
+
+	tlsConfig := t.tlsConfig.Clone()
+
+	tlsConfig.ServerName = endpoint.ServerName
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = endpoint.Host
+	}
+
+	return tlsConfig
+}
+
+func (t *BackendTransport) dialer() *net.Dialer {
+	t.Lock()
+	defer t.Unlock()
+
+	return &net.Dialer{Timeout: t.responseHeaderTimeout}
+}
+
+// Dial opens a connection to an endpoint for requests that bypass the
+// http.Transport, such as WebSocket and TCP upgrades.
+func (t *BackendTransport) Dial(endpoint *route.Endpoint) (net.Conn, error) {
+	dialer := t.dialer()
+
+	tlsConfig := t.TLSConfigFor(endpoint)
+	if tlsConfig == nil {
+		return dialer.Dial("tcp", endpoint.BackendAddr())
+	}
+
+	return tls.DialWithDialer(dialer, "tcp", endpoint.BackendAddr(), tlsConfig)
+}
+
+func (t *BackendTransport) TransportFor(endpoint *route.Endpoint) *http.Transport {
+	addr := endpoint.CanonicalAddr()
+	key := transportKey(endpoint)
+
+	t.Lock()
+	defer t.Unlock()
+
+	transport, ok := t.transports[addr][key]
+	if !ok {
+		dialer := &net.Dialer{Timeout: t.responseHeaderTimeout}
+
+		transport = &http.Transport{
+			DialContext:           dialer.DialContext,
+			ResponseHeaderTimeout: t.responseHeaderTimeout,
+			IdleConnTimeout:       t.idleConnTimeout,
+			MaxIdleConnsPerHost:   t.maxIdleConnsPerHost,
+			TLSClientConfig:       t.TLSConfigFor(endpoint),
+		}
+
+		if endpoint.UsesHTTP2() {
+			// Requests are multiplexed over a single connection, which
+			// is kept alive regardless
+			transport.Protocols = new(http.Protocols)
+			if endpoint.UsesTLS() {
+				transport.Protocols.SetHTTP2(true)
+			} else {
+				transport.Protocols.SetUnencryptedHTTP2(true)
+			}
+		} else {
+			transport.DisableKeepAlives = t.maxIdleConnsPerHost == 0
+		}
+
+		if t.transports[addr] == nil {
+			t.transports[addr] = make(map[string]*http.Transport)
+		}
+
+		t.transports[addr][key] = transport
+	}
+
+	return transport
+}
+
+// transportKey tells transports apart by address and protocol, as endpoints
+// registered at the same address under different routes may speak different
+// protocols. An endpoint keeps its protocol and TLS settings for as long as
+// it stays registered; see Registry.Register.
+func transportKey(endpoint *route.Endpoint) string {
+	if endpoint.UsesHTTP2() {
+		return endpoint.BackendAddr() + "/h2"
+	}
+
+	return endpoint.BackendAddr()
+}
+
+// Evict closes the idle connections to an endpoint's address and forgets its
+// transports, whatever the protocol or TLS port they were created for.
+// Requests still in flight on the transports are left to finish.
+func (t *BackendTransport) Evict(endpoint *route.Endpoint) {
+	addr := endpoint.CanonicalAddr()
+
+	t.Lock()
+	transports := t.transports[addr]
+	delete(t.transports, addr)
+	t.Unlock()
+
+	for _, transport := range transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// SetResponseHeaderTimeout changes how long to wait for an endpoint's
+// response headers. Transports are created with the timeout, so existing
+// ones are dropped; requests in flight on them keep the previous timeout.
+func (t *BackendTransport) SetResponseHeaderTimeout(timeout time.Duration) {
+	t.Lock()
+	transports := t.transports
+	t.transports = make(map[string]map[string]*http.Transport)
+	t.responseHeaderTimeout = timeout
+	t.Unlock()
+
+	for _, byKey := range transports {
+		for _, transport := range byKey {
+			transport.CloseIdleConnections()
+		}
+	}
+}
+
+func (t *BackendTransport) NumTransports() int {
+	t.Lock()
+	defer t.Unlock()
+
+	n := 0
+	for _, byKey := range t.transports {
+		n += len(byKey)
+	}
+
+	return n
+}
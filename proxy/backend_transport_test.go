@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/route"
+	"github.com/cloudfoundry/gorouter/test"
+)
+
+type BackendTransportSuite struct{}
+
+var _ = Suite(&BackendTransportSuite{})
+
+func (s *BackendTransportSuite) TestTransportIsReusedPerEndpoint(c *C) {
+	t := NewBackendTransport(config.DefaultConfig())
+
+	a := t.TransportFor(&route.Endpoint{Host: "1.2.3.4", Port: 1234})
+	b := t.TransportFor(&route.Endpoint{Host: "1.2.3.4", Port: 1234})
+	d := t.TransportFor(&route.Endpoint{Host: "1.2.3.4", Port: 4321})
+
+	c.Check(a, Equals, b)
+	c.Check(a, Not(Equals), d)
+	c.Check(t.NumTransports(), Equals, 2)
+}
+
+func (s *BackendTransportSuite) TestTransportIsConfigured(c *C) {
+	x := config.DefaultConfig()
+	x.EndpointTimeout = 5 * time.Second
+	x.EndpointIdleTimeout = 7 * time.Second
+	x.MaxIdleConnsPerEndpoint = 3
+
+	t := NewBackendTransport(x).TransportFor(&route.Endpoint{Host: "1.2.3.4", Port: 1234})
+
+	c.Check(t.ResponseHeaderTimeout, Equals, 5*time.Second)
+	c.Check(t.IdleConnTimeout, Equals, 7*time.Second)
+	c.Check(t.MaxIdleConnsPerHost, Equals, 3)
+	c.Check(t.DisableKeepAlives, Equals, false)
+}
+
+func (s *BackendTransportSuite) TestDialTimesOut(c *C) {
+	x := config.DefaultConfig()
+	x.EndpointTimeout = 50 * time.Millisecond
+
+	t := NewBackendTransport(x)
+	c.Check(t.dialer().Timeout, Equals, 50*time.Millisecond)
+	c.Check(t.TransportFor(&route.Endpoint{Host: "1.2.3.4", Port: 1234}).DialContext, NotNil)
+
+	t.SetResponseHeaderTimeout(time.Second)
+	c.Check(t.dialer().Timeout, Equals, time.Second)
+}
+
+func (s *BackendTransportSuite) TestKeepAliveDisabledWithoutIdleConns(c *C) {
+	x := config.DefaultConfig()
+	x.MaxIdleConnsPerEndpoint = 0
+
+	t := NewBackendTransport(x).TransportFor(&route.Endpoint{Host: "1.2.3.4", Port: 1234})
+
+	c.Check(t.DisableKeepAlives, Equals, true)
+}
+
+func (s *BackendTransportSuite) TestHTTP2Endpoints(c *C) {
+	t := NewBackendTransport(config.DefaultConfig())
+
+	a := t.TransportFor(&route.Endpoint{Host: "1.2.3.4", Port: 1234})
+	b := t.TransportFor(&route.Endpoint{Host: "1.2.3.4", Port: 1234, Protocol: route.ProtocolH2C})
+	d := t.TransportFor(&route.Endpoint{Host: "1.2.3.4", TLSPort: 1443, Protocol: route.ProtocolH2})
+
+	c.Check(a, Not(Equals), b)
+	c.Check(a.Protocols, IsNil)
+	c.Check(b.Protocols.UnencryptedHTTP2(), Equals, true)
+	c.Check(b.Protocols.HTTP1(), Equals, false)
+	c.Check(d.Protocols.HTTP2(), Equals, true)
+	c.Check(d.Protocols.HTTP1(), Equals, false)
+}
+
+func (s *BackendTransportSuite) TestEvict(c *C) {
+	t := NewBackendTransport(config.DefaultConfig())
+
+	endpoint := &route.Endpoint{Host: "1.2.3.4", Port: 1234}
+
+	a := t.TransportFor(endpoint)
+	t.Evict(endpoint)
+	c.Check(t.NumTransports(), Equals, 0)
+
+	// Evicting twice is harmless
+	t.Evict(endpoint)
+
+	b := t.TransportFor(endpoint)
+	c.Check(a, Not(Equals), b)
+}
+
+func (s *BackendTransportSuite) TestEvictForgetsEveryTransportOfAnAddress(c *C) {
+	t := NewBackendTransport(config.DefaultConfig())
+
+	h1 := &route.Endpoint{Host: "1.2.3.4", Port: 1234}
+	h2 := &route.Endpoint{Host: "1.2.3.4", Port: 1234, Protocol: route.ProtocolH2C}
+	secure := &route.Endpoint{Host: "1.2.3.4", Port: 1234, TLSPort: 1443}
+	other := &route.Endpoint{Host: "1.2.3.4", Port: 5678}
+
+	t.TransportFor(h1)
+	t.TransportFor(h2)
+	t.TransportFor(secure)
+	t.TransportFor(other)
+	c.Check(t.NumTransports(), Equals, 4)
+
+	t.Evict(h1)
+	c.Check(t.NumTransports(), Equals, 1)
+
+	t.Evict(other)
+	c.Check(t.NumTransports(), Equals, 0)
+}
+
+func (s *BackendTransportSuite) TestTLSIsOnlyUsedForTLSEndpoints(c *C) {
+	t := NewBackendTransport(config.DefaultConfig())
+
+	plain := &route.Endpoint{Host: "1.2.3.4", Port: 1234}
+	c.Check(t.TLSConfigFor(plain), IsNil)
+	c.Check(t.TransportFor(plain).TLSClientConfig, IsNil)
+
+	secure := &route.Endpoint{Host: "1.2.3.4", Port: 1234, TLSPort: 1443}
+	c.Assert(t.TransportFor(secure).TLSClientConfig, NotNil)
+	c.Check(t.TransportFor(secure).TLSClientConfig.ServerName, Equals, "1.2.3.4")
+	c.Check(t.TransportFor(secure), Not(Equals), t.TransportFor(plain))
+}
+
+func (s *BackendTransportSuite) TestTLSServerName(c *C) {
+	t := NewBackendTransport(config.DefaultConfig())
+
+	endpoint := &route.Endpoint{Host: "1.2.3.4", Port: 1234, TLSPort: 1443, ServerName: "app.internal"}
+	c.Check(t.TLSConfigFor(endpoint).ServerName, Equals, "app.internal")
+}
+
+func (s *BackendTransportSuite) TestTLSConfigIsLoaded(c *C) {
+	dir := c.MkDir()
+
+	caFile, _ := test.WriteCertificate(dir, "ca.internal")
+	certFile, keyFile := test.WriteCertificate(dir, "router.internal")
+
+	x := config.DefaultConfig()
+	x.BackendTLS = config.BackendTLSConfig{CACertsFile: caFile, CertFile: certFile, KeyFile: keyFile}
+
+	tlsConfig := NewBackendTransport(x).TLSConfigFor(&route.Endpoint{Host: "1.2.3.4", TLSPort: 1443})
+
+	c.Check(tlsConfig.RootCAs, NotNil)
+	c.Check(tlsConfig.Certificates, HasLen, 1)
+}
+
+func (s *BackendTransportSuite) TestPanicsOnInvalidCACerts(c *C) {
+	x := config.DefaultConfig()
+	x.BackendTLS.CACertsFile = "/dev/null"
+
+	c.Check(func() { NewBackendTransport(x) }, PanicMatches, "no certificates found in /dev/null")
+}
+
+func (s *BackendTransportSuite) TestSetResponseHeaderTimeout(c *C) {
+	t := NewBackendTransport(config.DefaultConfig())
+
+	endpoint := &route.Endpoint{Host: "1.2.3.4", Port: 1234}
+
+	a := t.TransportFor(endpoint)
+
+	t.SetResponseHeaderTimeout(3 * time.Second)
+	c.Check(t.NumTransports(), Equals, 0)
+
+	b := t.TransportFor(endpoint)
+	c.Check(b, Not(Equals), a)
+	c.Check(b.ResponseHeaderTimeout, Equals, 3*time.Second)
+}
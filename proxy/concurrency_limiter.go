@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/route"
+)
+
+// What a request was turned away by for having too many requests in flight.
+const (
+	LimitedByRouter   = "router"
+	LimitedByRoute    = "route"
+	LimitedByEndpoint = "endpoint"
+)
+
+var errEndpointBusy = errors.New("endpoint has too many requests in flight")
+
+// gate lets a number of requests through at once. Requests arriving when
+// it's full queue up, and are let through in order as others leave.
+// Guarded by the limiter's mutex.
+type gate struct {
+	inFlight int
+	queue    []chan bool
+
+	// Pool of the route the gate is for, told of the requests going through
+	pool *route.Pool
+}
+
+func (g *gate) report() {
+	if g.pool != nil {
+		g.pool.SetConcurrency(g.inFlight, len(g.queue))
+	}
+}
+
+// ConcurrencyLimiter bounds the number of requests proxied at once by the
+// router, to each route and to each endpoint. Requests over a limit wait for
+// a short while for others to finish, and are turned away if they don't. The
+// requests of every route are counted in its pool, limited or not.
+type ConcurrencyLimiter struct {
+	sync.Mutex
+
+	// 0 doesn't limit
+	max            int
+	maxPerRoute    int
+	maxPerEndpoint int
+
+	// Requests waiting per gate, and for how long at most
+	maxQueued    int
+	queueTimeout time.Duration
+
+	all *gate
+
+	// Gates of routes and endpoints by route and address, dropped once
+	// nothing goes through them
+	routes    map[string]*gate
+	endpoints map[string]*gate
+
+	queued int
+}
+
+func NewConcurrencyLimiter(c *config.Config) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		max:            c.ConcurrencyLimit.MaxInFlight,
+		maxPerRoute:    c.ConcurrencyLimit.MaxInFlightPerRoute,
+		maxPerEndpoint: c.ConcurrencyLimit.MaxInFlightPerEndpoint,
+
+		maxQueued:    c.ConcurrencyLimit.MaxQueued,
+		queueTimeout: c.ConcurrencyLimit.QueueTimeout,
+
+		all:       &gate{},
+		routes:    make(map[string]*gate),
+		endpoints: make(map[string]*gate),
+	}
+}
+
+// Enter lets a request in once the router and the route it is routed to, as
+// returned by Registry.PoolFor, have room for it. The returned function lets
+// the request out again. Requests that can't get in are told what they were
+// limited by instead.
+func (l *ConcurrencyLimiter) Enter(uri route.Uri, pool *route.Pool) (func(), string) {
+	l.Lock()
+	defer l.Unlock()
+
+	if !l.enter(l.all, l.max) {
+		return nil, LimitedByRouter
+	}
+
+	g := l.gateFor(l.routes, string(uri))
+	g.pool = pool
+
+	if !l.enter(g, l.maxPerRoute) {
+		l.leave(l.all, nil, "")
+		return nil, LimitedByRoute
+	}
+
+	all := l.leaver(l.all, nil, "")
+	route := l.leaver(g, l.routes, string(uri))
+
+	return func() {
+		route()
+		all()
+	}, ""
+}
+
+// EnterEndpoint lets a request through to endpoint once the endpoint has
+// room for it, telling whether it did. The returned function lets the
+// request out again.
+func (l *ConcurrencyLimiter) EnterEndpoint(endpoint *route.Endpoint) (func(), bool) {
+	if l.maxPerEndpoint <= 0 {
+		return func() {}, true
+	}
+
+	addr := endpoint.BackendAddr()
+
+	l.Lock()
+	defer l.Unlock()
+
+	g := l.gateFor(l.endpoints, addr)
+	if !l.enter(g, l.maxPerEndpoint) {
+		return nil, false
+	}
+
+	return l.leaver(g, l.endpoints, addr), true
+}
+
+// InFlight returns the number of requests being proxied.
+func (l *ConcurrencyLimiter) InFlight() int {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.all.inFlight
+}
+
+// Queued returns the number of requests waiting to be let through.
+func (l *ConcurrencyLimiter) Queued() int {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.queued
+}
+
+func (l *ConcurrencyLimiter) gateFor(gates map[string]*gate, key string) *gate {
+	g, ok := gates[key]
+	if !ok {
+		g = &gate{}
+		gates[key] = g
+	}
+
+	return g
+}
+
+// enter takes a place in g, queueing for one if there's none. It is called
+// with the limiter locked, which is released while waiting. Requests are
+// only turned away from full gates, so those are never left empty.
+func (l *ConcurrencyLimiter) enter(g *gate, max int) bool {
+	if max <= 0 || g.inFlight < max {
+		g.inFlight++
+		g.report()
+		return true
+	}
+
+	if len(g.queue) >= l.maxQueued {
+		return false
+	}
+
+	ready := make(chan bool, 1)
+	g.queue = append(g.queue, ready)
+	l.queued++
+	g.report()
+
+	l.Unlock()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	var entered bool
+	select {
+	case entered = <-ready:
+	case <-timer.C:
+	}
+
+	l.Lock()
+
+	if entered {
+		return true
+	}
+
+	// The place may have been handed over just as the wait timed out
+	select {
+	case <-ready:
+		return true
+	default:
+	}
+
+	for i, x := range g.queue {
+		if x == ready {
+			g.queue = append(g.queue[:i], g.queue[i+1:]...)
+			l.queued--
+			break
+		}
+	}
+
+	g.report()
+
+	return false
+}
+
+// leave gives the place of a request leaving g to the next one in the
+// queue, if any. Gates of routes and endpoints are dropped from gates once
+// they're empty.
+func (l *ConcurrencyLimiter) leave(g *gate, gates map[string]*gate, key string) {
+	if len(g.queue) > 0 {
+		ready := g.queue[0]
+		g.queue = g.queue[1:]
+		l.queued--
+		g.report()
+
+		ready <- true
+		return
+	}
+
+	g.inFlight--
+	g.report()
+
+	if gates != nil && g.inFlight == 0 && len(g.queue) == 0 {
+		delete(gates, key)
+	}
+}
+
+func (l *ConcurrencyLimiter) leaver(g *gate, gates map[string]*gate, key string) func() {
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			l.Lock()
+			defer l.Unlock()
+
+			l.leave(g, gates, key)
+		})
+	}
+}
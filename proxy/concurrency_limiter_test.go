@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/yagnats/fakeyagnats"
+	. "launchpad.net/gocheck"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/registry"
+	"github.com/cloudfoundry/gorouter/route"
+)
+
+type ConcurrencyLimiterSuite struct {
+	r *registry.Registry
+	x *config.Config
+}
+
+var _ = Suite(&ConcurrencyLimiterSuite{})
+
+func (s *ConcurrencyLimiterSuite) SetUpTest(c *C) {
+	s.x = config.DefaultConfig()
+	s.x.ConcurrencyLimit.MaxQueued = 0
+	s.x.ConcurrencyLimit.QueueTimeout = time.Second
+
+	s.r = registry.NewRegistry(s.x, fakeyagnats.New())
+	s.r.Register("foo", &route.Endpoint{Host: "1.2.3.4", Port: 1234})
+	s.r.Register("bar", &route.Endpoint{Host: "1.2.3.4", Port: 1234})
+}
+
+func (s *ConcurrencyLimiterSuite) route(uri route.Uri) (route.Uri, *route.Pool) {
+	key, pool, _ := s.r.PoolFor(uri)
+	return key, pool
+}
+
+func (s *ConcurrencyLimiterSuite) TestUnlimited(c *C) {
+	l := NewConcurrencyLimiter(s.x)
+
+	var leaves []func()
+	for i := 0; i < 10; i++ {
+		leave, limited := l.Enter(s.route("foo"))
+		c.Assert(limited, Equals, "")
+		leaves = append(leaves, leave)
+
+		_, ok := l.EnterEndpoint(&route.Endpoint{Host: "1.2.3.4", Port: 1234})
+		c.Assert(ok, Equals, true)
+	}
+
+	c.Check(l.InFlight(), Equals, 10)
+
+	for _, leave := range leaves {
+		leave()
+	}
+
+	c.Check(l.InFlight(), Equals, 0)
+}
+
+func (s *ConcurrencyLimiterSuite) TestCountsRequestsOfRoutes(c *C) {
+	s.x.ConcurrencyLimit.MaxInFlightPerRoute = 1
+	s.x.ConcurrencyLimit.MaxQueued = 1
+	l := NewConcurrencyLimiter(s.x)
+
+	_, pool, ok := s.r.PoolFor("foo")
+	c.Assert(ok, Equals, true)
+
+	leave, limited := l.Enter(s.route("foo"))
+	c.Assert(limited, Equals, "")
+	c.Check(pool.InFlight(), Equals, int64(1))
+
+	entered := make(chan func())
+	go func() {
+		leave, _ := l.Enter(s.route("foo"))
+		entered <- leave
+	}()
+
+	for pool.Queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	leave()
+	leave = <-entered
+	c.Check(pool.InFlight(), Equals, int64(1))
+	c.Check(pool.Queued(), Equals, int64(0))
+
+	leave()
+	c.Check(pool.InFlight(), Equals, int64(0))
+}
+
+func (s *ConcurrencyLimiterSuite) TestCountsRequestsOfUnlimitedRoutes(c *C) {
+	l := NewConcurrencyLimiter(s.x)
+
+	_, pool, _ := s.r.PoolFor("foo")
+
+	leave, _ := l.Enter(s.route("foo"))
+	c.Check(pool.InFlight(), Equals, int64(1))
+
+	leave()
+	c.Check(pool.InFlight(), Equals, int64(0))
+}
+
+func (s *ConcurrencyLimiterSuite) TestQueuesUpToTheLimit(c *C) {
+	s.x.ConcurrencyLimit.MaxInFlight = 1
+	s.x.ConcurrencyLimit.MaxQueued = 1
+	l := NewConcurrencyLimiter(s.x)
+
+	leave, limited := l.Enter(s.route("foo"))
+	c.Assert(limited, Equals, "")
+
+	entered := make(chan func())
+	go func() {
+		leave, _ := l.Enter(s.route("foo"))
+		entered <- leave
+	}()
+
+	for l.Queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full
+	_, limited = l.Enter(s.route("foo"))
+	c.Check(limited, Equals, LimitedByRouter)
+
+	leave()
+
+	// Leaving twice is harmless
+	leave()
+
+	next := <-entered
+	c.Assert(next, NotNil)
+	c.Check(l.InFlight(), Equals, 1)
+	c.Check(l.Queued(), Equals, 0)
+
+	next()
+	c.Check(l.InFlight(), Equals, 0)
+}
+
+func (s *ConcurrencyLimiterSuite) TestQueueTimesOut(c *C) {
+	s.x.ConcurrencyLimit.MaxInFlight = 1
+	s.x.ConcurrencyLimit.MaxQueued = 1
+	s.x.ConcurrencyLimit.QueueTimeout = 20 * time.Millisecond
+	l := NewConcurrencyLimiter(s.x)
+
+	_, limited := l.Enter(s.route("foo"))
+	c.Assert(limited, Equals, "")
+
+	startedAt := time.Now()
+	_, limited = l.Enter(s.route("foo"))
+	c.Check(limited, Equals, LimitedByRouter)
+	c.Check(time.Since(startedAt) >= 20*time.Millisecond, Equals, true)
+	c.Check(l.Queued(), Equals, 0)
+}
+
+func (s *ConcurrencyLimiterSuite) TestRoutesAreLimitedSeparately(c *C) {
+	s.x.ConcurrencyLimit.MaxInFlightPerRoute = 1
+	l := NewConcurrencyLimiter(s.x)
+
+	leave, limited := l.Enter(s.route("foo"))
+	c.Assert(limited, Equals, "")
+
+	_, limited = l.Enter(s.route("foo"))
+	c.Check(limited, Equals, LimitedByRoute)
+
+	leaveBar, limited := l.Enter(s.route("bar"))
+	c.Check(limited, Equals, "")
+
+	// Requests turned away by their route don't count
+	c.Check(l.InFlight(), Equals, 2)
+
+	leave()
+	leaveBar()
+
+	c.Check(l.InFlight(), Equals, 0)
+	c.Check(l.routes, HasLen, 0)
+}
+
+func (s *ConcurrencyLimiterSuite) TestEndpointsAreLimitedSeparately(c *C) {
+	s.x.ConcurrencyLimit.MaxInFlightPerEndpoint = 1
+	l := NewConcurrencyLimiter(s.x)
+
+	a := &route.Endpoint{Host: "1.2.3.4", Port: 1234}
+	b := &route.Endpoint{Host: "1.2.3.4", Port: 4321}
+
+	leave, ok := l.EnterEndpoint(a)
+	c.Assert(ok, Equals, true)
+
+	// The same endpoint registered for another route
+	_, ok = l.EnterEndpoint(&route.Endpoint{Host: "1.2.3.4", Port: 1234})
+	c.Check(ok, Equals, false)
+
+	leaveB, ok := l.EnterEndpoint(b)
+	c.Check(ok, Equals, true)
+
+	leave()
+	leaveB()
+
+	c.Check(l.endpoints, HasLen, 0)
+}
@@ -1,8 +1,10 @@
 package proxy
 
 import (
+	"errors"
+	"io"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -10,8 +12,10 @@ import (
 	steno "github.com/cloudfoundry/gosteno"
 
 	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/log"
 	"github.com/cloudfoundry/gorouter/registry"
 	"github.com/cloudfoundry/gorouter/route"
+	"github.com/cloudfoundry/gorouter/tracing"
 	"github.com/cloudfoundry/gorouter/varz"
 )
 
@@ -29,33 +33,172 @@ type Proxy struct {
 	*registry.Registry
 	varz.Varz
 	*AccessLogger
-	*http.Transport
+	*BackendTransport
+	*tracing.Tracer
+	*RateLimiter
+	*ConcurrencyLimiter
+
+	// Reloadable settings, guarded by the mutex
+	traceKey string
+
+	// Set once the router is shutting down, guarded by the mutex
+	draining bool
 }
 
 func NewProxy(c *config.Config, registry *registry.Registry, v varz.Varz) *Proxy {
 	p := &Proxy{
-		Config:    c,
-		Logger:    steno.NewLogger("router.proxy"),
-		Registry:  registry,
-		Varz:      v,
-		Transport: &http.Transport{ResponseHeaderTimeout: c.EndpointTimeout},
+		Config:           c,
+		Logger:           log.NewLogger("router.proxy"),
+		Registry:         registry,
+		Varz:             v,
+		BackendTransport: NewBackendTransport(c),
+
+		ConcurrencyLimiter: NewConcurrencyLimiter(c),
+
+		traceKey: c.TraceKey,
+	}
+
+	if registry != nil {
+		registry.OnEndpointRemoved(p.BackendTransport.Evict)
 	}
 
 	loggregatorUrl := c.LoggregatorConfig.Url
 	loggregatorSharedSecret := c.LoggregatorConfig.SharedSecret
 	if c.AccessLog != "" || loggregatorUrl != "" {
-		f, err := os.OpenFile(c.AccessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
-		if err != nil && c.AccessLog != "" {
+		var w io.Writer
+		if c.AccessLog != "" {
+			f, err := OpenAccessLogFile(c.AccessLog, c.AccessLogRotation)
+			if err != nil {
+				panic(err)
+			}
+
+			w = f
+		}
+
+		format, err := NewAccessLogFormat(c.AccessLogFormat)
+		if err != nil {
 			panic(err)
 		}
 
-		p.AccessLogger = NewAccessLogger(f, loggregatorUrl, loggregatorSharedSecret, c.Index)
+		p.AccessLogger = NewAccessLogger(w, loggregatorUrl, loggregatorSharedSecret, c.Index, c.AccessLogBufferSize, c.AccessLogDropWhenFull)
+		p.AccessLogger.SetFormat(format)
 		go p.AccessLogger.Run()
+
+		if v != nil {
+			v.SetAccessLogCounter(p.AccessLogger)
+		}
+	}
+
+	if c.Tracing.Enabled {
+		exporter, err := tracing.NewExporter(c.Tracing.Exporter, c.Tracing.File, c.Tracing.BufferSize)
+		if err != nil {
+			panic(err)
+		}
+
+		p.Tracer = tracing.NewTracer(exporter, c.Tracing.SampleRate)
+
+		if counter, ok := exporter.(varz.SpanCounter); ok && v != nil {
+			v.SetSpanCounter(counter)
+		}
+	}
+
+	if c.RateLimit.Enabled {
+		p.RateLimiter = NewRateLimiter(c, registry)
+	}
+
+	if v != nil {
+		v.SetConcurrencyCounter(p.ConcurrencyLimiter)
 	}
 
 	return p
 }
 
+func (p *Proxy) SetTraceKey(traceKey string) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.traceKey = traceKey
+}
+
+// StartDraining makes load balancer heartbeats fail from now on.
+func (p *Proxy) StartDraining() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.draining = true
+}
+
+func (p *Proxy) isDraining() bool {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.draining
+}
+
+func (p *Proxy) getTraceKey() string {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.traceKey
+}
+
+// SetAccessLog switches the access log to the file at path, or stops writing
+// it when path is empty. Records are still sent to loggregator either way.
+func (p *Proxy) SetAccessLog(path string) error {
+	if p.AccessLogger == nil {
+		return errors.New("access logging was disabled at startup")
+	}
+
+	var w io.Writer
+	if path != "" {
+		f, err := OpenAccessLogFile(path, p.Config.AccessLogRotation)
+		if err != nil {
+			return err
+		}
+
+		w = f
+	}
+
+	previous := p.AccessLogger.SetWriter(w)
+	if f, ok := previous.(io.Closer); ok {
+		f.Close()
+	}
+
+	return nil
+}
+
+// ReopenAccessLog reopens the access log file, so that records go to a new
+// file after the previous one has been moved away.
+func (p *Proxy) ReopenAccessLog() error {
+	if p.AccessLogger == nil {
+		return nil
+	}
+
+	f, ok := p.AccessLogger.Writer().(*AccessLogFile)
+	if !ok {
+		return nil
+	}
+
+	return f.Reopen()
+}
+
+// SetAccessLogFormat changes the format of the access log; see
+// NewAccessLogFormat.
+func (p *Proxy) SetAccessLogFormat(format string) error {
+	if p.AccessLogger == nil {
+		return errors.New("access logging was disabled at startup")
+	}
+
+	f, err := NewAccessLogFormat(format)
+	if err != nil {
+		return err
+	}
+
+	p.AccessLogger.SetFormat(f)
+
+	return nil
+}
+
 func hostWithoutPort(req *http.Request) string {
 	host := req.Host
 
@@ -68,13 +211,18 @@ func hostWithoutPort(req *http.Request) string {
 	return host
 }
 
-func (proxy *Proxy) Lookup(request *http.Request) (*route.Endpoint, bool) {
-	uri := route.Uri(hostWithoutPort(request))
+// requestUri is the uri a request is routed by: its host name followed by
+// its path, matched against routes by longest path prefix.
+func requestUri(req *http.Request) route.Uri {
+	return route.Uri(hostWithoutPort(req) + req.URL.Path)
+}
 
+// Lookup picks the endpoint of pool to send request to.
+func (proxy *Proxy) Lookup(request *http.Request, pool *route.Pool) (*route.Endpoint, bool) {
 	// Try choosing a backend using sticky session
 	if _, err := request.Cookie(StickyCookieKey); err == nil {
 		if sticky, err := request.Cookie(VcapCookieId); err == nil {
-			routeEndpoint, ok := proxy.Registry.LookupByPrivateInstanceId(uri, sticky.Value)
+			routeEndpoint, ok := proxy.Registry.SampleByPrivateInstanceId(pool, sticky.Value)
 			if ok {
 				return routeEndpoint, ok
 			}
@@ -82,30 +230,101 @@ func (proxy *Proxy) Lookup(request *http.Request) (*route.Endpoint, bool) {
 	}
 
 	// Choose backend using host alone
-	return proxy.Registry.Lookup(uri)
+	return proxy.Registry.Sample(pool)
 }
 
 func (proxy *Proxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
 	startedAt := time.Now()
 
 	handler := NewRequestHandler(request, responseWriter)
+	requestId := handler.SetRequestId(proxy.Config.TrustRequestId)
+
+	// Spans are nil when tracing is disabled, and record nothing
+	span := proxy.Tracer.StartSpan("router", request.Header)
+	span.Inject(request.Header)
+	handler.SetSpan(span)
 
 	accessLog := AccessLogRecord{
 		Request:   request,
+		RequestId: requestId,
 		StartedAt: startedAt,
 	}
 
+	// Every request is logged, however it ends
+	defer func() {
+		if proxy.AccessLogger == nil {
+			return
+		}
+
+		accessLog.FinishedAt = time.Now()
+		accessLog.BodyBytesSent = handler.BytesSent()
+		accessLog.RouterError = handler.RouterError()
+
+		if accessLog.Response == nil {
+			accessLog.Response = &http.Response{
+				StatusCode: handler.StatusCode(),
+				Header:     responseWriter.Header(),
+			}
+		}
+
+		proxy.AccessLogger.Log(accessLog)
+	}()
+
+	defer func() {
+		if span == nil {
+			return
+		}
+
+		span.SetAttribute("http.method", request.Method)
+		span.SetAttribute("http.host", request.Host)
+		span.SetAttribute("http.target", request.RequestURI)
+		span.SetAttribute("http.status_code", strconv.Itoa(handler.StatusCode()))
+		span.SetAttribute("router.request_id", requestId)
+		span.SetAttribute("router.attempts", strconv.Itoa(accessLog.Attempts))
+
+		if e := accessLog.RouteEndpoint; e != nil {
+			span.SetAttribute("router.endpoint", e.CanonicalAddr())
+			span.SetAttribute("router.app_id", e.ApplicationId)
+		}
+
+		if err := handler.RouterError(); err != "" {
+			span.SetAttribute("router.error", err)
+		}
+
+		span.Finish()
+	}()
+
 	if !isProtocolSupported(request) {
 		handler.HandleUnsupportedProtocol()
 		return
 	}
 
 	if isLoadBalancerHeartbeat(request) {
-		handler.HandleHeartbeat()
+		handler.HandleHeartbeat(proxy.isDraining())
+		return
+	}
+
+	if !handler.LimitBody(proxy.Config.MaxRequestBodyBytes) {
+		proxy.Varz.CaptureBadRequest(request)
+		handler.HandleRequestTooLarge()
 		return
 	}
 
-	routeEndpoint, found := proxy.Lookup(request)
+	if ok, wait := proxy.AllowClient(request); !ok {
+		proxy.Varz.CaptureRateLimited(request, "client")
+		handler.HandleRateLimited("client", wait)
+		return
+	}
+
+	// The route is matched once; sampling, limits and retries all use it
+	uri, pool, found := proxy.Registry.PoolFor(requestUri(request))
+
+	var routeEndpoint *route.Endpoint
+	if found {
+		routeEndpoint, found = proxy.Lookup(request, pool)
+	}
+
+	span.AddEvent("lookup")
 	if !found {
 		proxy.Varz.CaptureBadRequest(request)
 		handler.HandleMissingRoute()
@@ -114,26 +333,117 @@ func (proxy *Proxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.
 
 	handler.logger.Set("RouteEndpoint", routeEndpoint.ToLogData())
 
+	if ok, wait := proxy.AllowRoute(uri, routeEndpoint); !ok {
+		proxy.Varz.CaptureRateLimited(request, "route")
+		handler.HandleRateLimited("route", wait)
+		return
+	}
+
+	routeEndpoint.IncrementInFlight()
+	defer func() {
+		// routeEndpoint changes when the request is retried
+		routeEndpoint.DecrementInFlight()
+	}()
+
 	accessLog.RouteEndpoint = routeEndpoint
 
 	proxy.Varz.CaptureRoutingRequest(routeEndpoint, handler.request)
 
 	if isTcpUpgrade(request) {
-		handler.HandleTcpRequest(routeEndpoint)
+		handler.HandleTcpRequest(proxy.BackendTransport, routeEndpoint)
 		return
 	}
 
 	if isWebSocketUpgrade(request) {
-		handler.HandleWebSocketRequest(routeEndpoint)
+		handler.HandleWebSocketRequest(proxy.BackendTransport, routeEndpoint)
+		return
+	}
+
+	leave, limited := proxy.Enter(uri, pool)
+	if limited != "" {
+		proxy.Varz.CaptureConcurrencyLimited(request, limited)
+		handler.HandleConcurrencyLimited(limited)
 		return
 	}
+	defer leave()
+
+	var endpointResponse *http.Response
+	var err error
+
+	tried := []*route.Endpoint{}
+
+	leaveEndpoint := func() {}
+	defer func() {
+		// Only once the response has been copied is the endpoint done
+		leaveEndpoint()
+	}()
+
+	for {
+		accessLog.Attempts++
+
+		var entered bool
+		leaveEndpoint, entered = proxy.EnterEndpoint(routeEndpoint)
+		if entered {
+			endpointResponse, err = handler.HandleHttpRequest(proxy.BackendTransport.TransportFor(routeEndpoint), routeEndpoint)
+			if err == nil {
+				proxy.Registry.CaptureEndpointSuccess(routeEndpoint)
+			} else if isEndpointFailure(err) {
+				proxy.Registry.CaptureEndpointFailure(routeEndpoint)
+			}
+		} else {
+			leaveEndpoint = func() {}
+			err = errEndpointBusy
+		}
+
+		if err == nil || accessLog.Attempts >= proxy.Config.MaxEndpointAttempts || !handler.CanRetry(err) {
+			break
+		}
 
-	endpointResponse, err := handler.HandleHttpRequest(proxy.Transport, routeEndpoint)
+		leaveEndpoint()
+
+		tried = append(tried, routeEndpoint)
+
+		nextEndpoint, found := proxy.Registry.SampleExcluding(pool, tried)
+		if !found {
+			break
+		}
+
+		handler.logger.Set("Error", err.Error())
+		handler.logger.Warnf("proxy.endpoint.retry")
+
+		proxy.Varz.CaptureRetry(routeEndpoint, request)
+
+		routeEndpoint.DecrementInFlight()
+		routeEndpoint = nextEndpoint
+		routeEndpoint.IncrementInFlight()
+
+		handler.logger.Set("RouteEndpoint", routeEndpoint.ToLogData())
+		accessLog.RouteEndpoint = routeEndpoint
+	}
+
+	if err == errEndpointBusy {
+		proxy.Varz.CaptureConcurrencyLimited(request, LimitedByEndpoint)
+		handler.HandleConcurrencyLimited(LimitedByEndpoint)
+		return
+	}
+
+	// Bodies without a length are only found to be too large on the way
+	if err != nil && handler.BodyTooLarge() {
+		proxy.Varz.CaptureBadRequest(request)
+		handler.HandleRequestTooLarge()
+		return
+	}
 
 	latency := time.Since(startedAt)
 
 	proxy.Registry.CaptureRoutingRequest(routeEndpoint, startedAt)
-	proxy.Varz.CaptureRoutingResponse(routeEndpoint, endpointResponse, latency)
+
+	// gRPC responses are counted by the status in their trailers, which
+	// are only there once the body has been read
+	grpc := err == nil && isGrpc(endpointResponse.Header)
+	if !grpc {
+		proxy.Varz.CaptureRoutingResponse(routeEndpoint, endpointResponse, latency)
+	}
 
 	if err != nil {
 		proxy.Varz.CaptureBadGateway(request)
@@ -144,21 +454,24 @@ func (proxy *Proxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.
 	accessLog.FirstByteAt = time.Now()
 	accessLog.Response = endpointResponse
 
-	if proxy.Config.TraceKey != "" && request.Header.Get(VcapTraceHeader) == proxy.Config.TraceKey {
+	traceKey := proxy.getTraceKey()
+	if traceKey != "" && request.Header.Get(VcapTraceHeader) == traceKey {
 		handler.SetTraceHeaders(proxy.Config.Ip, routeEndpoint.CanonicalAddr())
 	}
 
-	bytesSent := handler.WriteResponse(endpointResponse)
-
-	accessLog.FinishedAt = time.Now()
-	accessLog.BodyBytesSent = bytesSent
+	handler.WriteResponse(endpointResponse)
 
-	if proxy.AccessLogger != nil {
-		proxy.AccessLogger.Log(accessLog)
+	if grpc {
+		proxy.Varz.CaptureRoutingResponse(routeEndpoint, endpointResponse, latency)
 	}
 }
 
 func isProtocolSupported(request *http.Request) bool {
+	// HTTP/2 requests are proxied to endpoints over HTTP/1.1
+	if request.ProtoMajor == 2 {
+		return request.ProtoMinor == 0
+	}
+
 	return request.ProtoMajor == 1 && (request.ProtoMinor == 0 || request.ProtoMinor == 1)
 }
 
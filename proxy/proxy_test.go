@@ -2,12 +2,17 @@ package proxy
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -18,6 +23,9 @@ import (
 	"github.com/cloudfoundry/gorouter/config"
 	"github.com/cloudfoundry/gorouter/registry"
 	"github.com/cloudfoundry/gorouter/route"
+	"github.com/cloudfoundry/gorouter/test"
+	"github.com/cloudfoundry/gorouter/tracing"
+	"github.com/cloudfoundry/gorouter/varz"
 )
 
 type connHandler func(*httpConn)
@@ -26,8 +34,15 @@ type nullVarz struct{}
 
 func (_ nullVarz) MarshalJSON() ([]byte, error) { return json.Marshal(nil) }
 
+func (_ nullVarz) SetAccessLogCounter(c varz.AccessLogCounter)                                   {}
+func (_ nullVarz) SetHttp2Counter(c varz.Http2Counter)                                           {}
+func (_ nullVarz) SetConcurrencyCounter(c varz.ConcurrencyCounter)                               {}
+func (_ nullVarz) SetSpanCounter(c varz.SpanCounter)                                             {}
 func (_ nullVarz) CaptureBadRequest(req *http.Request)                                           {}
 func (_ nullVarz) CaptureBadGateway(req *http.Request)                                           {}
+func (_ nullVarz) CaptureRateLimited(req *http.Request, limited string)                          {}
+func (_ nullVarz) CaptureConcurrencyLimited(req *http.Request, limited string)                   {}
+func (_ nullVarz) CaptureRetry(b *route.Endpoint, req *http.Request)                             {}
 func (_ nullVarz) CaptureRoutingRequest(b *route.Endpoint, req *http.Request)                    {}
 func (_ nullVarz) CaptureRoutingResponse(b *route.Endpoint, res *http.Response, d time.Duration) {}
 
@@ -216,6 +231,78 @@ func (s *ProxySuite) TestProxyPanicsIfInvalidAccessLogLocation(c *C) {
 	}, PanicMatches, "open /this\\\\should/panic: no such file or directory")
 }
 
+func (s *ProxySuite) TestSetAccessLog(c *C) {
+	dir := c.MkDir()
+
+	x := config.DefaultConfig()
+	x.AccessLog = filepath.Join(dir, "first.log")
+	proxy := NewProxy(x, nil, nil)
+
+	c.Check(proxy.SetAccessLog(filepath.Join(dir, "second.log")), IsNil)
+	c.Check(proxy.AccessLogger.w.(*AccessLogFile).path, Equals, filepath.Join(dir, "second.log"))
+
+	c.Check(proxy.SetAccessLog(""), IsNil)
+	c.Check(proxy.AccessLogger.w, IsNil)
+
+	c.Check(proxy.SetAccessLog(filepath.Join(dir, "missing", "third.log")), NotNil)
+}
+
+func (s *ProxySuite) TestReopenAccessLog(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "access.log")
+
+	x := config.DefaultConfig()
+	x.AccessLog = path
+	proxy := NewProxy(x, nil, nil)
+
+	c.Assert(os.Rename(path, path+".1"), IsNil)
+	c.Check(proxy.ReopenAccessLog(), IsNil)
+
+	_, err := proxy.AccessLogger.Writer().Write([]byte("after\n"))
+	c.Assert(err, IsNil)
+
+	b, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, "after\n")
+}
+
+func (s *ProxySuite) TestSetAccessLogRequiresAccessLogger(c *C) {
+	proxy := NewProxy(config.DefaultConfig(), nil, nil)
+	c.Check(proxy.SetAccessLog("/dev/null"), ErrorMatches, "access logging was disabled at startup")
+}
+
+type chanWriter chan string
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- string(b)
+	return len(b), nil
+}
+
+// captureAccessLog makes the proxy log requests in JSON to the returned
+// channel.
+func (s *ProxySuite) captureAccessLog(c *C) chanWriter {
+	records := make(chanWriter, 16)
+
+	s.p.AccessLogger = NewAccessLogger(records, "", "", 0, 16, false)
+	s.p.AccessLogger.SetFormat(jsonAccessLogFormat{})
+	go s.p.AccessLogger.Run()
+
+	return records
+}
+
+func (s *ProxySuite) nextAccessLogRecord(c *C, records chanWriter) map[string]interface{} {
+	var record map[string]interface{}
+
+	select {
+	case line := <-records:
+		c.Assert(json.Unmarshal([]byte(line), &record), IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("no access log record written")
+	}
+
+	return record
+}
+
 func (s *ProxySuite) RegisterHandler(c *C, u string, h connHandler) net.Listener {
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -313,6 +400,223 @@ func (s *ProxySuite) TestRespondsToLoadBalancerCheck(c *C) {
 	c.Check(body, Equals, "ok\n")
 }
 
+func (s *ProxySuite) TestLoadBalancerCheckFailsWhileDraining(c *C) {
+	s.p.StartDraining()
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "HTTP-Monitor/1.1")
+	x.WriteRequest(req)
+
+	resp, body := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Check(body, Equals, "draining\n")
+}
+
+func (s *ProxySuite) TestMissingRouteIsLogged(c *C) {
+	records := s.captureAccessLog(c)
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "unknown"
+	x.WriteRequest(req)
+	x.ReadResponse()
+
+	record := s.nextAccessLogRecord(c, records)
+	c.Check(record["host"], Equals, "unknown")
+	c.Check(record["status"], Equals, float64(http.StatusNotFound))
+	c.Check(record["router_error"], Equals, "unknown_route")
+	c.Check(record["body_bytes_sent"].(float64) > 0, Equals, true)
+}
+
+func (s *ProxySuite) TestBadGatewayIsLogged(c *C) {
+	records := s.captureAccessLog(c)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	ln.Close()
+	s.registerAddr("nowhere", ln.Addr())
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "nowhere"
+	x.WriteRequest(req)
+	x.ReadResponse()
+
+	record := s.nextAccessLogRecord(c, records)
+	c.Check(record["status"], Equals, float64(http.StatusBadGateway))
+	c.Check(record["router_error"], Equals, "endpoint_failure")
+	c.Check(record["endpoint"], Equals, ln.Addr().String())
+}
+
+func (s *ProxySuite) TestRateLimitsRoutes(c *C) {
+	cfg := config.DefaultConfig()
+	cfg.RateLimit.RouteRate = 0.01
+	cfg.RateLimit.RouteBurst = 1
+	s.p.RateLimiter = NewRateLimiter(cfg, s.r)
+
+	s.RegisterHandler(c, "limited", func(x *httpConn) {
+		x.CheckLine("GET / HTTP/1.1")
+
+		x.WriteLines([]string{
+			"HTTP/1.1 200 OK",
+			"Content-Length: 0",
+		})
+	})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "limited"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	// Other paths of the route share its limit
+	req = x.NewRequest("GET", "/other", nil)
+	req.Host = "limited"
+	x.WriteRequest(req)
+
+	resp, _ = x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusTooManyRequests)
+	c.Check(resp.Header.Get("Retry-After"), Equals, "100")
+	c.Check(resp.Header.Get("X-Cf-RouterError"), Equals, "rate_limited")
+}
+
+func (s *ProxySuite) TestRateLimitsClients(c *C) {
+	cfg := config.DefaultConfig()
+	cfg.RateLimit.ClientRate = 0.5
+	cfg.RateLimit.ClientBurst = 2
+	s.p.RateLimiter = NewRateLimiter(cfg, s.r)
+
+	x := s.DialProxy(c)
+
+	for _, status := range []int{http.StatusNotFound, http.StatusNotFound, http.StatusTooManyRequests} {
+		req := x.NewRequest("GET", "/", nil)
+		req.Host = "unknown"
+		x.WriteRequest(req)
+
+		resp, _ := x.ReadResponse()
+		c.Check(resp.StatusCode, Equals, status)
+	}
+}
+
+func (s *ProxySuite) TestRejectsLargeBodiesUpFront(c *C) {
+	s.p.Config.MaxRequestBodyBytes = 4
+
+	attempts := make(chan bool, 1)
+	s.RegisterHandler(c, "limited", func(x *httpConn) {
+		x.ReadRequest()
+		attempts <- true
+	})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("POST", "/", strings.NewReader("too long"))
+	req.Host = "limited"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+	c.Check(resp.Header.Get("X-Cf-RouterError"), Equals, "request_too_large")
+	c.Check(len(attempts), Equals, 0)
+}
+
+func (s *ProxySuite) TestRejectsLargeChunkedBodies(c *C) {
+	s.p.Config.MaxRequestBodyBytes = 4
+
+	s.RegisterHandler(c, "limited", func(x *httpConn) {
+		req, err := http.ReadRequest(x.reader)
+		if err == nil {
+			ioutil.ReadAll(req.Body)
+		}
+		x.Close()
+	})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("POST", "/", ioutil.NopCloser(strings.NewReader("too long")))
+	req.Host = "limited"
+	req.TransferEncoding = []string{"chunked"}
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+	c.Check(resp.Header.Get("X-Cf-RouterError"), Equals, "request_too_large")
+}
+
+func (s *ProxySuite) TestAllowsBodiesWithinTheLimit(c *C) {
+	s.p.Config.MaxRequestBodyBytes = 4
+
+	s.RegisterHandler(c, "limited", func(x *httpConn) {
+		_, body := x.ReadRequest()
+		c.Check(body, Equals, "fits")
+
+		x.WriteLines([]string{
+			"HTTP/1.1 200 OK",
+			"Content-Length: 0",
+		})
+	})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("POST", "/", ioutil.NopCloser(strings.NewReader("fits")))
+	req.Host = "limited"
+	req.TransferEncoding = []string{"chunked"}
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *ProxySuite) TestBusyEndpointsAreUnavailable(c *C) {
+	cfg := config.DefaultConfig()
+	cfg.ConcurrencyLimit.MaxInFlightPerEndpoint = 1
+	cfg.ConcurrencyLimit.MaxQueued = 0
+	s.p.ConcurrencyLimiter = NewConcurrencyLimiter(cfg)
+
+	done := make(chan bool)
+	s.RegisterHandler(c, "busy", func(x *httpConn) {
+		x.CheckLine("GET / HTTP/1.1")
+
+		<-done
+
+		x.WriteLines([]string{
+			"HTTP/1.1 200 OK",
+			"Content-Length: 0",
+		})
+	})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "busy"
+	x.WriteRequest(req)
+
+	for s.p.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	y := s.DialProxy(c)
+
+	req = y.NewRequest("GET", "/", nil)
+	req.Host = "busy"
+	y.WriteRequest(req)
+
+	resp, _ := y.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Check(resp.Header.Get("X-Cf-RouterError"), Equals, "concurrency_limited")
+
+	close(done)
+
+	resp, _ = x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
 func (s *ProxySuite) TestRespondsToUnknownHostWith404(c *C) {
 	x := s.DialProxy(c)
 
@@ -326,6 +630,29 @@ func (s *ProxySuite) TestRespondsToUnknownHostWith404(c *C) {
 	c.Check(body, Equals, "404 Not Found: Requested route ('unknown') does not exist.\n")
 }
 
+func (s *ProxySuite) TestRoutesByLongestPathPrefix(c *C) {
+	s.RegisterHandler(c, "paths", func(x *httpConn) {
+		x.CheckLine("GET /other HTTP/1.1")
+		x.WriteResponse(newResponse(http.StatusOK))
+	})
+
+	s.RegisterHandler(c, "paths/api", func(x *httpConn) {
+		x.CheckLine("GET /api/users HTTP/1.1")
+		x.WriteResponse(newResponse(http.StatusCreated))
+	})
+
+	for path, status := range map[string]int{"/other": http.StatusOK, "/api/users": http.StatusCreated} {
+		x := s.DialProxy(c)
+
+		req := x.NewRequest("GET", path, nil)
+		req.Host = "paths"
+		x.WriteRequest(req)
+
+		resp, _ := x.ReadResponse()
+		c.Check(resp.StatusCode, Equals, status)
+	}
+}
+
 func (s *ProxySuite) TestRespondsToMisbehavingHostWith502(c *C) {
 	s.RegisterHandler(c, "enfant-terrible", func(x *httpConn) {
 		x.Close()
@@ -343,6 +670,84 @@ func (s *ProxySuite) TestRespondsToMisbehavingHostWith502(c *C) {
 	c.Check(body, Equals, "502 Bad Gateway: Registered endpoint failed to handle the request.\n")
 }
 
+func (s *ProxySuite) registerDeadEndpoint(u string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	ln.Close()
+
+	s.registerAddr(u, ln.Addr())
+}
+
+func (s *ProxySuite) TestRetriesOnAnotherEndpointWhenDialFails(c *C) {
+	s.registerDeadEndpoint("retry")
+
+	s.RegisterHandler(c, "retry", func(x *httpConn) {
+		req, body := x.ReadRequest()
+		c.Check(req.Method, Equals, "POST")
+		c.Check(body, Equals, "some body")
+		c.Check(req.Header.Get("X-Forwarded-For"), Equals, "127.0.0.1")
+
+		resp := newResponse(http.StatusOK)
+		x.WriteResponse(resp)
+		x.Close()
+	})
+
+	s.registerDeadEndpoint("retry")
+
+	for i := 0; i < 5; i++ {
+		x := s.DialProxy(c)
+
+		req := x.NewRequest("POST", "/", strings.NewReader("some body"))
+		req.Host = "retry"
+		x.WriteRequest(req)
+
+		resp, _ := x.ReadResponse()
+		c.Check(resp.StatusCode, Equals, http.StatusOK)
+	}
+}
+
+func (s *ProxySuite) TestDoesNotRetryNonIdempotentRequestOnceSent(c *C) {
+	attempts := make(chan bool, 2)
+
+	handler := func(x *httpConn) {
+		x.ReadRequest()
+		attempts <- true
+		x.Close()
+	}
+
+	s.RegisterHandler(c, "no-retry", handler)
+	s.RegisterHandler(c, "no-retry", handler)
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("POST", "/", strings.NewReader("some body"))
+	req.Host = "no-retry"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusBadGateway)
+	c.Check(len(attempts), Equals, 1)
+}
+
+func (s *ProxySuite) TestRetryGivesUpAfterMaxAttempts(c *C) {
+	for i := 0; i < 4; i++ {
+		s.registerDeadEndpoint("all-dead")
+	}
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "all-dead"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusBadGateway)
+	c.Check(resp.Header.Get("X-Cf-RouterError"), Equals, "endpoint_failure")
+}
+
 func (s *ProxySuite) TestTraceHeadersAddedOnCorrectTraceKey(c *C) {
 	ln := s.RegisterHandler(c, "trace-test", func(x *httpConn) {
 		resp := newResponse(http.StatusOK)
@@ -363,6 +768,28 @@ func (s *ProxySuite) TestTraceHeadersAddedOnCorrectTraceKey(c *C) {
 	c.Check(resp.Header.Get("X-Vcap-Router"), Equals, s.p.Config.Ip)
 }
 
+func (s *ProxySuite) TestTraceKeyCanBeChanged(c *C) {
+	s.RegisterHandler(c, "trace-test", func(x *httpConn) {
+		x.ReadRequest()
+		x.WriteResponse(newResponse(http.StatusOK))
+		x.Close()
+	})
+
+	s.p.SetTraceKey("new_trace_key")
+
+	for key, traced := range map[string]bool{"my_trace_key": false, "new_trace_key": true} {
+		x := s.DialProxy(c)
+
+		req := x.NewRequest("GET", "/", nil)
+		req.Host = "trace-test"
+		req.Header.Set("X-Vcap-Trace", key)
+		x.WriteRequest(req)
+
+		resp, _ := x.ReadResponse()
+		c.Check(resp.Header.Get("X-Vcap-Router") != "", Equals, traced)
+	}
+}
+
 func (s *ProxySuite) TestTraceHeadersNotAddedOnIncorrectTraceKey(c *C) {
 	s.RegisterHandler(c, "trace-test", func(x *httpConn) {
 		resp := newResponse(http.StatusOK)
@@ -420,6 +847,334 @@ func (s *ProxySuite) TestXFFIsAppended(c *C) {
 	<-done
 }
 
+func (s *ProxySuite) TestXForwardedProtoIsAdded(c *C) {
+	done := make(chan bool)
+
+	s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get("X-Forwarded-Proto"), Equals, "http")
+		done <- true
+	})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	x.WriteRequest(req)
+
+	<-done
+}
+
+func (s *ProxySuite) TestXForwardedProtoIsKept(c *C) {
+	done := make(chan bool)
+
+	s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get("X-Forwarded-Proto"), Equals, "https")
+		done <- true
+	})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	x.WriteRequest(req)
+
+	<-done
+}
+
+func (s *ProxySuite) TestRequestIdIsGenerated(c *C) {
+	records := s.captureAccessLog(c)
+	ids := make(chan string, 1)
+
+	s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		ids <- req.Header.Get(RequestIdHeader)
+
+		resp := newResponse(http.StatusOK)
+		resp.Header.Set(RequestIdHeader, "from-the-endpoint")
+		x.WriteResponse(resp)
+		x.Close()
+	})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	req.Header.Set(RequestIdHeader, "from-the-client")
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+
+	id := <-ids
+	c.Check(id, Matches, "[0-9a-f]{32}")
+	c.Check(resp.Header[RequestIdHeader], DeepEquals, []string{id})
+
+	record := s.nextAccessLogRecord(c, records)
+	c.Check(record["request_id"], Equals, id)
+}
+
+func (s *ProxySuite) TestTrustedRequestIdIsKept(c *C) {
+	s.p.Config.TrustRequestId = true
+	ids := make(chan string, 1)
+
+	s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		ids <- req.Header.Get(RequestIdHeader)
+
+		x.WriteResponse(newResponse(http.StatusOK))
+		x.Close()
+	})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	req.Header.Set(RequestIdHeader, "from-the-client")
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+
+	c.Check(<-ids, Equals, "from-the-client")
+	c.Check(resp.Header.Get(RequestIdHeader), Equals, "from-the-client")
+}
+
+func (s *ProxySuite) TestRequestIdIsReturnedWithRouterErrors(c *C) {
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "unknown"
+	x.WriteRequest(req)
+
+	resp, _ := x.ReadResponse()
+	c.Check(resp.StatusCode, Equals, http.StatusNotFound)
+	c.Check(resp.Header.Get(RequestIdHeader), Matches, "[0-9a-f]{32}")
+}
+
+func (s *ProxySuite) TestIsValidRequestId(c *C) {
+	c.Check(isValidRequestId("6b1a5e3c-0f7d-4c8e-9a2b-1d3e5f7a9b0c"), Equals, true)
+	c.Check(isValidRequestId(""), Equals, false)
+	c.Check(isValidRequestId("with space"), Equals, false)
+	c.Check(isValidRequestId("caf\u00e9"), Equals, false)
+	c.Check(isValidRequestId(strings.Repeat("a", 201)), Equals, false)
+}
+
+func (s *ProxySuite) TestRequestIsTraced(c *C) {
+	spans := make(chanWriter, 1)
+	s.p.Tracer = tracing.NewTracer(tracing.NewWriterExporter(spans, 16), 1)
+
+	traceparents := make(chan string, 1)
+
+	s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		traceparents <- req.Header.Get(tracing.TraceparentHeader)
+
+		x.WriteResponse(newResponse(http.StatusOK))
+		x.Close()
+	})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	req.Header.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	x.WriteRequest(req)
+	x.ReadResponse()
+
+	var span struct {
+		TraceId    string            `json:"trace_id"`
+		SpanId     string            `json:"span_id"`
+		ParentId   string            `json:"parent_id"`
+		Attributes map[string]string `json:"attributes"`
+		Events     []struct {
+			Name string `json:"name"`
+		} `json:"events"`
+	}
+
+	select {
+	case line := <-spans:
+		c.Assert(json.Unmarshal([]byte(line), &span), IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("no span exported")
+	}
+
+	c.Check(span.TraceId, Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Check(span.ParentId, Equals, "00f067aa0ba902b7")
+	c.Check(<-traceparents, Equals, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+span.SpanId+"-01")
+
+	c.Check(span.Attributes["http.status_code"], Equals, "200")
+	c.Check(span.Attributes["http.host"], Equals, "app")
+	c.Check(span.Attributes["router.attempts"], Equals, "1")
+
+	events := []string{}
+	for _, e := range span.Events {
+		events = append(events, e.Name)
+	}
+	c.Check(events, DeepEquals, []string{"lookup", "dial_start", "dial_done", "first_byte"})
+}
+
+func (s *ProxySuite) TestXForwardedProtoIsHttpsWhenTerminatingTLS(c *C) {
+	done := make(chan bool)
+
+	s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Header.Get("X-Forwarded-Proto"), Equals, "https")
+		done <- true
+	})
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{test.GenerateTLSCertificate("app")},
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	server := Server{Handler: s.p}
+	go server.Serve(ln)
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	x := newConn(conn, c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "app"
+	req.Header.Set("X-Forwarded-Proto", "http")
+	x.WriteRequest(req)
+
+	<-done
+}
+
+func (s *ProxySuite) registerTLSHandler(c *C, u string, tlsConfig *tls.Config, h http.HandlerFunc) net.Listener {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	c.Assert(err, IsNil)
+
+	go http.Serve(ln, h)
+
+	_, p, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(p)
+
+	s.r.Register(route.Uri(u), &route.Endpoint{Host: "127.0.0.1", Port: 1, TLSPort: uint16(port)})
+
+	return ln
+}
+
+func (s *ProxySuite) TestProxiesToTLSEndpointWithClientCertificate(c *C) {
+	dir := c.MkDir()
+	endpointCertFile, endpointKeyFile := test.WriteCertificate(dir, "127.0.0.1")
+	routerCertFile, routerKeyFile := test.WriteCertificate(dir, "router.internal")
+
+	endpointCert, err := tls.LoadX509KeyPair(endpointCertFile, endpointKeyFile)
+	c.Assert(err, IsNil)
+
+	routerCA, err := ioutil.ReadFile(routerCertFile)
+	c.Assert(err, IsNil)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(routerCA)
+
+	ln := s.registerTLSHandler(c, "secure", &tls.Config{
+		Certificates: []tls.Certificate{endpointCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	})
+	defer ln.Close()
+
+	x := config.DefaultConfig()
+	x.BackendTLS = config.BackendTLSConfig{
+		CACertsFile: endpointCertFile,
+		CertFile:    routerCertFile,
+		KeyFile:     routerKeyFile,
+	}
+
+	p := NewProxy(x, s.r, nullVarz{})
+
+	req, _ := http.NewRequest("GET", "http://secure/", nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Equals, "router.internal")
+}
+
+func (s *ProxySuite) TestRespondsWith502WhenTLSEndpointIsNotTrusted(c *C) {
+	ln := s.registerTLSHandler(c, "untrusted", &tls.Config{
+		Certificates: []tls.Certificate{test.GenerateTLSCertificate("127.0.0.1")},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		c.Error("request should not reach an untrusted endpoint")
+	})
+	defer ln.Close()
+
+	req, _ := http.NewRequest("GET", "http://untrusted/", nil)
+	resp := httptest.NewRecorder()
+	s.p.ServeHTTP(resp, req)
+
+	c.Check(resp.Code, Equals, http.StatusBadGateway)
+}
+
+func (s *ProxySuite) TestEndpointConnectionIsKeptAlive(c *C) {
+	connections := 0
+
+	s.RegisterHandler(c, "keep-alive", func(x *httpConn) {
+		connections++
+
+		for {
+			_, err := http.ReadRequest(x.reader)
+			if err != nil {
+				x.Close()
+				return
+			}
+
+			resp := newResponse(http.StatusOK)
+			resp.Header.Set("Connection", "keep-alive")
+			x.WriteResponse(resp)
+		}
+	})
+
+	for i := 0; i < 2; i++ {
+		x := s.DialProxy(c)
+
+		req := x.NewRequest("GET", "/", nil)
+		req.Host = "keep-alive"
+		x.WriteRequest(req)
+
+		resp, _ := x.ReadResponse()
+		c.Check(resp.StatusCode, Equals, http.StatusOK)
+		c.Check(resp.Header.Get("Connection"), Equals, "")
+
+		x.Close()
+	}
+
+	c.Check(connections, Equals, 1)
+}
+
+func (s *ProxySuite) TestEndpointConnectionsAreEvictedOnUnregister(c *C) {
+	ln := s.RegisterHandler(c, "evict", func(x *httpConn) {
+		x.ReadRequest()
+		x.WriteResponse(newResponse(http.StatusOK))
+	})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/", nil)
+	req.Host = "evict"
+	x.WriteRequest(req)
+	x.ReadResponse()
+
+	c.Check(s.p.NumTransports(), Equals, 1)
+
+	h, p, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(p)
+	s.r.Unregister("evict", &route.Endpoint{Host: h, Port: uint16(port)})
+
+	c.Check(s.p.NumTransports(), Equals, 0)
+}
+
 func (s *ProxySuite) TestWebSocketUpgrade(c *C) {
 	s.RegisterHandler(c, "ws", func(x *httpConn) {
 		req, _ := x.ReadRequest()
@@ -454,6 +1209,157 @@ func (s *ProxySuite) TestWebSocketUpgrade(c *C) {
 	x.CheckLine("hello from server")
 }
 
+func (s *ProxySuite) TestWebSocketUpgradeIsLogged(c *C) {
+	records := s.captureAccessLog(c)
+
+	s.RegisterHandler(c, "ws", func(x *httpConn) {
+		x.ReadRequest()
+
+		resp := newResponse(http.StatusSwitchingProtocols)
+		resp.Header.Set("Upgrade", "websocket")
+		resp.Header.Set("Connection", "Upgrade")
+		x.WriteResponse(resp)
+
+		x.CheckLine("hello from client")
+		x.WriteLine("bye")
+		x.Close()
+	})
+
+	x := s.DialProxy(c)
+
+	req := x.NewRequest("GET", "/chat", nil)
+	req.Host = "ws"
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	x.WriteRequest(req)
+
+	x.ReadResponse()
+	time.Sleep(50 * time.Millisecond)
+	x.WriteLine("hello from client")
+
+	record := s.nextAccessLogRecord(c, records)
+	c.Check(record["status"], Equals, float64(http.StatusSwitchingProtocols))
+	c.Check(record["body_bytes_sent"].(float64) > 0, Equals, true)
+	c.Check(record["response_time"].(float64) >= 0.05, Equals, true)
+}
+
+func (s *ProxySuite) TestProxiesHTTP2ToHTTP1Endpoints(c *C) {
+	s.RegisterHandler(c, "app", func(x *httpConn) {
+		req, _ := x.ReadRequest()
+		c.Check(req.Proto, Equals, "HTTP/1.1")
+		c.Check(req.Header.Get("X-Forwarded-Proto"), Equals, "http")
+
+		resp := newResponse(http.StatusOK)
+		resp.Header.Set("Connection", "close")
+		resp.Body = ioutil.NopCloser(strings.NewReader("hello"))
+		resp.ContentLength = 5
+		x.WriteResponse(resp)
+		x.Close()
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	go (&Server{Handler: s.p, H2C: true}).Serve(ln)
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+	req.Host = "app"
+
+	resp, err := client.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	c.Check(resp.ProtoMajor, Equals, 2)
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(string(body), Equals, "hello")
+}
+
+func (s *ProxySuite) TestProxiesGrpcToH2CEndpoints(c *C) {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+
+	backend := &http.Server{
+		Protocols: protocols,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.Check(r.ProtoMajor, Equals, 2)
+
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+
+			// Echo every message as it arrives
+			buf := make([]byte, 5)
+			for {
+				n, err := r.Body.Read(buf)
+				if n > 0 {
+					w.Write(buf[:n])
+					w.(http.Flusher).Flush()
+				}
+				if err != nil {
+					break
+				}
+			}
+
+			w.Header().Set("Grpc-Status", "0")
+		}),
+	}
+
+	bl, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer bl.Close()
+
+	go backend.Serve(bl)
+
+	addr := bl.Addr().(*net.TCPAddr)
+	s.r.Register("grpc", &route.Endpoint{
+		Host:     addr.IP.String(),
+		Port:     uint16(addr.Port),
+		Protocol: route.ProtocolH2C,
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	go (&Server{Handler: s.p, H2C: true}).Serve(ln)
+
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	body, requestBody := io.Pipe()
+	req, _ := http.NewRequest("POST", "http://"+ln.Addr().String()+"/Echo", body)
+	req.Host = "grpc"
+	req.Header.Set("Content-Type", "application/grpc")
+
+	resp, err := client.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	// Each message is echoed before the next is sent
+	for _, message := range []string{"hello", "world"} {
+		requestBody.Write([]byte(message))
+
+		b := make([]byte, len(message))
+		_, err = io.ReadFull(resp.Body, b)
+		c.Assert(err, IsNil)
+		c.Check(string(b), Equals, message)
+	}
+
+	requestBody.Close()
+
+	_, err = ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Check(resp.Trailer.Get("Grpc-Status"), Equals, "0")
+}
+
 func (s *ProxySuite) TestTcpUpgrade(c *C) {
 	s.RegisterHandler(c, "tcp-handler", func(x *httpConn) {
 		x.WriteLine("hello")
@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/registry"
+	"github.com/cloudfoundry/gorouter/route"
+)
+
+// Tags of router.register messages overriding the rate limit of a route.
+const (
+	RateLimitTag      = "rate_limit"
+	RateLimitBurstTag = "rate_limit_burst"
+)
+
+// rateLimit allows rate requests per second, and burst more at once. A rate
+// of 0 allows any number of requests.
+type rateLimit struct {
+	rate  float64
+	burst int
+}
+
+func newRateLimit(rate float64, burst int) rateLimit {
+	// Bursts of less than a request would never let one through
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+
+	return rateLimit{rate: rate, burst: burst}
+}
+
+func (l rateLimit) unlimited() bool {
+	return l.rate <= 0
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second. Every
+// request takes a token, and is rejected when there's none left.
+type tokenBucket struct {
+	rateLimit
+
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.burst), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take takes a token if there is one, or tells how long until there is.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// buckets are the token buckets of routes or clients, by key. The number of
+// buckets is bounded; the least recently used bucket goes when there are too
+// many, so clients sending a flood of requests keep theirs.
+type buckets struct {
+	byKey map[string]*list.Element
+	lru   *list.List
+	max   int
+}
+
+type keyedBucket struct {
+	key string
+	*tokenBucket
+}
+
+func newBuckets(max int) buckets {
+	return buckets{byKey: make(map[string]*list.Element), lru: list.New(), max: max}
+}
+
+// take takes a token from the bucket of key, which is given the limit
+// returned by limit when it is created.
+func (x buckets) take(key string, limit func() rateLimit, now time.Time) (bool, time.Duration) {
+	var b *tokenBucket
+
+	e, ok := x.byKey[key]
+	if ok {
+		x.lru.MoveToFront(e)
+		b = e.Value.(keyedBucket).tokenBucket
+	} else {
+		l := limit()
+		b = &tokenBucket{rateLimit: l, tokens: float64(l.burst), last: now}
+		x.byKey[key] = x.lru.PushFront(keyedBucket{key, b})
+
+		if x.max > 0 && x.lru.Len() > x.max {
+			x.remove(x.lru.Back().Value.(keyedBucket).key)
+		}
+	}
+
+	if b.unlimited() {
+		return true, 0
+	}
+
+	return b.take(now)
+}
+
+func (x buckets) remove(key string) {
+	e, ok := x.byKey[key]
+	if !ok {
+		return
+	}
+
+	x.lru.Remove(e)
+	delete(x.byKey, key)
+}
+
+// RateLimiter limits the rate of requests to each route and from each
+// client. Its methods can be called on a nil limiter, which allows
+// everything.
+type RateLimiter struct {
+	sync.Mutex
+
+	route  rateLimit
+	client rateLimit
+
+	trustedProxies []*net.IPNet
+
+	routes  buckets
+	clients buckets
+}
+
+func NewRateLimiter(c *config.Config, r *registry.Registry) *RateLimiter {
+	trustedProxies, err := parseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		panic(err)
+	}
+
+	l := &RateLimiter{
+		route:  newRateLimit(c.RateLimit.RouteRate, c.RateLimit.RouteBurst),
+		client: newRateLimit(c.RateLimit.ClientRate, c.RateLimit.ClientBurst),
+
+		trustedProxies: trustedProxies,
+
+		// Routes are few compared to clients
+		routes:  newBuckets(0),
+		clients: newBuckets(c.RateLimit.MaxClients),
+	}
+
+	if r != nil {
+		r.OnRouteRemoved(l.forgetRoute)
+	}
+
+	return l
+}
+
+func parseTrustedProxies(xs []string) ([]*net.IPNet, error) {
+	var y []*net.IPNet
+
+	for _, x := range xs {
+		if !strings.Contains(x, "/") {
+			if strings.Contains(x, ":") {
+				x += "/128"
+			} else {
+				x += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(x)
+		if err != nil {
+			return nil, err
+		}
+
+		y = append(y, n)
+	}
+
+	return y, nil
+}
+
+// AllowClient tells whether the client sending request may make another
+// request, or how long it has to wait otherwise.
+func (l *RateLimiter) AllowClient(request *http.Request) (bool, time.Duration) {
+	if l == nil || l.client.unlimited() {
+		return true, 0
+	}
+
+	ip := l.ClientIp(request)
+	if ip == "" {
+		return true, 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	return l.clients.take(ip, l.clientLimit, time.Now())
+}
+
+func (l *RateLimiter) clientLimit() rateLimit {
+	return l.client
+}
+
+// AllowRoute tells whether a request may be routed to endpoint of the route
+// uri, as returned by Registry.PoolFor, or how long it has to wait otherwise.
+// The limit of a route is settled when it first gets a request, taken from
+// the tags of endpoint when it has them, and kept until the last endpoint of
+// the route is gone.
+func (l *RateLimiter) AllowRoute(uri route.Uri, endpoint *route.Endpoint) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	limit := func() rateLimit {
+		return l.routeLimit(endpoint)
+	}
+
+	return l.routes.take(string(uri), limit, time.Now())
+}
+
+// forgetRoute drops the bucket of a route that is gone.
+func (l *RateLimiter) forgetRoute(uri route.Uri) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.routes.remove(string(uri))
+}
+
+func (l *RateLimiter) routeLimit(endpoint *route.Endpoint) rateLimit {
+	rate, burst := l.route.rate, l.route.burst
+
+	if v, ok := endpoint.Tags[RateLimitTag]; ok {
+		if x, err := strconv.ParseFloat(v, 64); err == nil {
+			rate, burst = x, 0
+		}
+	}
+
+	if v, ok := endpoint.Tags[RateLimitBurstTag]; ok {
+		if x, err := strconv.Atoi(v); err == nil {
+			burst = x
+		}
+	}
+
+	return newRateLimit(rate, burst)
+}
+
+// ClientIp returns the address of the client a request comes from: the
+// address of the connection, unless that is a trusted proxy, in which case
+// the last address in X-Forwarded-For that isn't one.
+func (l *RateLimiter) ClientIp(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+
+	if !l.isTrustedProxy(host) {
+		return host
+	}
+
+	// Addresses are appended by every proxy on the way, so only those
+	// after the last untrusted one can be believed
+	xff := strings.Join(request.Header["X-Forwarded-For"], ",")
+	addrs := strings.Split(xff, ",")
+	for i := len(addrs) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(addrs[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+
+		host = addr
+		if !l.isTrustedProxy(addr) {
+			break
+		}
+	}
+
+	return host
+}
+
+func (l *RateLimiter) isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range l.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry/yagnats/fakeyagnats"
+	. "launchpad.net/gocheck"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/registry"
+	"github.com/cloudfoundry/gorouter/route"
+)
+
+type RateLimiterSuite struct{}
+
+var _ = Suite(&RateLimiterSuite{})
+
+func (s *RateLimiterSuite) TestTokenBucket(c *C) {
+	now := time.Now()
+	b := &tokenBucket{rateLimit: newRateLimit(2, 3), tokens: 3, last: now}
+
+	for i := 0; i < 3; i++ {
+		ok, _ := b.take(now)
+		c.Check(ok, Equals, true)
+	}
+
+	ok, wait := b.take(now)
+	c.Check(ok, Equals, false)
+	c.Check(wait, Equals, 500*time.Millisecond)
+
+	ok, _ = b.take(now.Add(500 * time.Millisecond))
+	c.Check(ok, Equals, true)
+
+	// Tokens don't pile up beyond the burst
+	for i := 0; i < 3; i++ {
+		ok, _ = b.take(now.Add(time.Hour))
+		c.Check(ok, Equals, true)
+	}
+
+	ok, _ = b.take(now.Add(time.Hour))
+	c.Check(ok, Equals, false)
+}
+
+func (s *RateLimiterSuite) TestBurstIsAtLeastTheRate(c *C) {
+	c.Check(newRateLimit(0.1, 0).burst, Equals, 1)
+	c.Check(newRateLimit(2.5, 0).burst, Equals, 3)
+	c.Check(newRateLimit(2.5, 10).burst, Equals, 10)
+}
+
+func (s *RateLimiterSuite) TestBucketsAreBounded(c *C) {
+	now := time.Now()
+	x := newBuckets(2)
+	l := func() rateLimit { return newRateLimit(1, 1) }
+
+	x.take("a", l, now)
+	x.take("b", l, now)
+	x.take("a", l, now)
+
+	// b was used least recently, and goes first
+	x.take("c", l, now)
+	c.Check(x.byKey, HasLen, 2)
+	c.Check(x.byKey["b"], IsNil)
+
+	// a is still out of tokens
+	ok, _ := x.take("a", l, now)
+	c.Check(ok, Equals, false)
+
+	x.take("d", l, now)
+	c.Check(x.byKey, HasLen, 2)
+	c.Check(x.lru.Len(), Equals, 2)
+	c.Check(x.byKey["c"], IsNil)
+	c.Check(x.byKey["d"], NotNil)
+}
+
+func (s *RateLimiterSuite) TestRouteLimitFromTags(c *C) {
+	x := config.DefaultConfig()
+	x.RateLimit.RouteRate = 100
+	x.RateLimit.RouteBurst = 200
+	l := NewRateLimiter(x, nil)
+
+	c.Check(l.routeLimit(&route.Endpoint{}), Equals, rateLimit{100, 200})
+
+	e := &route.Endpoint{Tags: map[string]string{RateLimitTag: "10"}}
+	c.Check(l.routeLimit(e), Equals, rateLimit{10, 10})
+
+	e = &route.Endpoint{Tags: map[string]string{RateLimitTag: "10", RateLimitBurstTag: "50"}}
+	c.Check(l.routeLimit(e), Equals, rateLimit{10, 50})
+
+	e = &route.Endpoint{Tags: map[string]string{RateLimitTag: "0"}}
+	c.Check(l.routeLimit(e).unlimited(), Equals, true)
+
+	// Invalid tags are ignored
+	e = &route.Endpoint{Tags: map[string]string{RateLimitTag: "lots"}}
+	c.Check(l.routeLimit(e), Equals, rateLimit{100, 200})
+}
+
+func (s *RateLimiterSuite) TestRoutesAreLimitedSeparately(c *C) {
+	x := config.DefaultConfig()
+	x.RateLimit.RouteRate = 0.01
+	r := registry.NewRegistry(x, fakeyagnats.New())
+	l := NewRateLimiter(x, r)
+
+	e := &route.Endpoint{Host: "1.2.3.4", Port: 1234}
+	r.Register("foo", e)
+	r.Register("bar", e)
+
+	allow := func(host string) bool {
+		uri, _, _ := r.PoolFor(route.Uri(host))
+		ok, _ := l.AllowRoute(uri, e)
+		return ok
+	}
+
+	c.Check(allow("foo"), Equals, true)
+	c.Check(allow("foo"), Equals, false)
+	c.Check(allow("bar"), Equals, true)
+}
+
+func (s *RateLimiterSuite) TestRouteLimitIsKeptWhileRouteIsRegistered(c *C) {
+	x := config.DefaultConfig()
+	r := registry.NewRegistry(x, fakeyagnats.New())
+	l := NewRateLimiter(x, r)
+
+	e1 := &route.Endpoint{Host: "1.2.3.4", Port: 1234, Tags: map[string]string{RateLimitTag: "0.01"}}
+	e2 := &route.Endpoint{Host: "1.2.3.4", Port: 1235}
+	r.Register("foo", e1)
+	r.Register("foo", e2)
+
+	allow := func(e *route.Endpoint) bool {
+		uri, _, _ := r.PoolFor("foo")
+		ok, _ := l.AllowRoute(uri, e)
+		return ok
+	}
+
+	c.Check(allow(e1), Equals, true)
+
+	// Endpoints without the tag don't lift the limit of the route
+	c.Check(allow(e2), Equals, false)
+	c.Check(allow(e1), Equals, false)
+
+	// Nor does anything of the route remain once it's gone
+	r.Unregister("foo", e1)
+	c.Check(l.routes.byKey, HasLen, 1)
+	r.Unregister("foo", e2)
+	c.Check(l.routes.byKey, HasLen, 0)
+	c.Check(l.routes.lru.Len(), Equals, 0)
+
+	r.Register("foo", e2)
+	c.Check(allow(e2), Equals, true)
+	c.Check(allow(e2), Equals, true)
+}
+
+func (s *RateLimiterSuite) TestClientIp(c *C) {
+	x := config.DefaultConfig()
+	x.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1"}
+	l := NewRateLimiter(x, nil)
+
+	clientIp := func(remoteAddr string, xff ...string) string {
+		req := &http.Request{RemoteAddr: remoteAddr, Header: http.Header{}}
+		for _, v := range xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+
+		return l.ClientIp(req)
+	}
+
+	c.Check(clientIp("1.2.3.4:5678"), Equals, "1.2.3.4")
+	c.Check(clientIp("1.2.3.4:5678", "5.6.7.8"), Equals, "1.2.3.4")
+	c.Check(clientIp("10.1.2.3:5678", "5.6.7.8"), Equals, "5.6.7.8")
+	c.Check(clientIp("192.168.1.1:5678", "9.9.9.9, 5.6.7.8, 10.0.0.1"), Equals, "5.6.7.8")
+	c.Check(clientIp("192.168.1.1:5678", "9.9.9.9", "5.6.7.8"), Equals, "5.6.7.8")
+	c.Check(clientIp("192.168.1.2:5678", "5.6.7.8"), Equals, "192.168.1.2")
+
+	// Garbage stops the walk at the last address that could be believed
+	c.Check(clientIp("10.1.2.3:5678", "5.6.7.8, garbage, 10.0.0.1"), Equals, "10.0.0.1")
+	c.Check(clientIp("10.1.2.3:5678"), Equals, "10.1.2.3")
+}
+
+func (s *RateLimiterSuite) TestPanicsOnInvalidTrustedProxies(c *C) {
+	x := config.DefaultConfig()
+	x.TrustedProxies = []string{"10.0.0.0/99"}
+
+	c.Check(func() { NewRateLimiter(x, nil) }, PanicMatches, ".*invalid CIDR address.*")
+}
+
+func (s *RateLimiterSuite) TestNilLimiterAllowsEverything(c *C) {
+	var l *RateLimiter
+
+	ok, _ := l.AllowClient(&http.Request{RemoteAddr: "1.2.3.4:5678"})
+	c.Check(ok, Equals, true)
+
+	ok, _ = l.AllowRoute("foo", &route.Endpoint{})
+	c.Check(ok, Equals, true)
+}
@@ -2,14 +2,22 @@ package proxy
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	vcap "github.com/cloudfoundry/gorouter/common"
+	"github.com/cloudfoundry/gorouter/log"
 	"github.com/cloudfoundry/gorouter/route"
+	"github.com/cloudfoundry/gorouter/tracing"
 	steno "github.com/cloudfoundry/gosteno"
 )
 
@@ -17,6 +25,11 @@ const (
 	VcapBackendHeader     = "X-Vcap-Backend"
 	CfRouteEndpointHeader = "X-Cf-RouteEndpoint"
 	VcapRouterHeader      = "X-Vcap-Router"
+	RouterErrorHeader     = "X-Cf-RouterError"
+	RequestIdHeader       = "X-Request-Id"
+
+	// Longest incoming request id that is passed on as is
+	maxRequestIdLength = 200
 )
 
 type RequestHandler struct {
@@ -24,12 +37,112 @@ type RequestHandler struct {
 
 	request  *http.Request
 	response http.ResponseWriter
+	recorder *responseRecorder
+
+	span *tracing.Span
 
 	transport *http.Transport
+
+	body             *replayableBody
+	limitedBody      *limitedBody
+	xForwardedForSet bool
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedBody fails reads past the largest body the router accepts,
+// remembering that it did.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Bodies exactly as large as allowed are fine
+		var x [1]byte
+		n, err := b.ReadCloser.Read(x[:])
+		if n > 0 {
+			b.exceeded = true
+			return 0, errBodyTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// replayableBody keeps the transport from closing the client's request body
+// when a round trip fails, and remembers whether any of it has been sent, so
+// that the request can be retried against another endpoint.
+type replayableBody struct {
+	io.ReadCloser
+	bytesRead int64
+}
+
+func (b *replayableBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytesRead += int64(n)
+	return n, err
+}
+
+func (b *replayableBody) Close() error {
+	// The server closes the underlying body once the request is done
+	return nil
+}
+
+// responseRecorder remembers what was written to the client, for the access
+// log.
+type responseRecorder struct {
+	http.ResponseWriter
+
+	status    int
+	bytesSent int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	n, err := r.ResponseWriter.Write(b)
+	r.bytesSent += int64(n)
+
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		panic("response writer cannot hijack")
+	}
+
+	return hijacker.Hijack()
 }
 
 func NewRequestHandler(request *http.Request, response http.ResponseWriter) RequestHandler {
-	logger := steno.NewLogger("router.proxy.request-handler")
+	logger := log.NewLogger("router.proxy.request-handler")
 
 	logger.Set("RemoteAddr", request.RemoteAddr)
 	logger.Set("Host", request.Host)
@@ -37,15 +150,96 @@ func NewRequestHandler(request *http.Request, response http.ResponseWriter) Requ
 	logger.Set("X-Forwarded-For", request.Header["X-Forwarded-For"])
 	logger.Set("X-Forwarded-Proto", request.Header["X-Forwarded-Proto"])
 
+	recorder := &responseRecorder{ResponseWriter: response}
+
 	return RequestHandler{
 		logger: logger,
 
 		request:  request,
-		response: response,
+		response: recorder,
+		recorder: recorder,
 	}
 }
 
-func (h *RequestHandler) HandleHeartbeat() {
+// StatusCode returns the status of the response sent to the client, or 0 if
+// none has been sent.
+func (h *RequestHandler) StatusCode() int {
+	return h.recorder.status
+}
+
+// BytesSent returns the number of body bytes sent to the client, including
+// those forwarded from endpoints over upgraded connections.
+func (h *RequestHandler) BytesSent() int64 {
+	return h.recorder.bytesSent
+}
+
+// RouterError returns why the router rather than an endpoint responded to
+// the request, if it did.
+func (h *RequestHandler) RouterError() string {
+	return h.response.Header().Get(RouterErrorHeader)
+}
+
+// SetRequestId makes sure the request carries an id that ties together the
+// router's logs, the access log and the endpoint's logs. An incoming id is
+// kept only if it is trusted, and a new one is generated otherwise. The id is
+// returned to the client on the response too.
+func (h *RequestHandler) SetRequestId(trusted bool) string {
+	id := h.request.Header.Get(RequestIdHeader)
+	if !trusted || !isValidRequestId(id) {
+		id = vcap.GenerateUUID()
+	}
+
+	h.request.Header.Set(RequestIdHeader, id)
+	h.response.Header().Set(RequestIdHeader, id)
+	h.logger.Set(RequestIdHeader, id)
+
+	return id
+}
+
+// SetSpan makes the handler record the router-side timings of dialing
+// endpoints and waiting for their responses in span.
+func (h *RequestHandler) SetSpan(span *tracing.Span) {
+	h.span = span
+	if span == nil {
+		return
+	}
+
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			span.AddEvent("dial_start")
+		},
+		ConnectDone: func(network, addr string, err error) {
+			span.AddEvent("dial_done")
+		},
+		GotFirstResponseByte: func() {
+			span.AddEvent("first_byte")
+		},
+	}
+
+	h.request = h.request.WithContext(httptrace.WithClientTrace(h.request.Context(), trace))
+}
+
+func isValidRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (h *RequestHandler) HandleHeartbeat(draining bool) {
+	if draining {
+		h.response.WriteHeader(http.StatusServiceUnavailable)
+		h.response.Write([]byte("draining\n"))
+		return
+	}
+
 	h.response.WriteHeader(http.StatusOK)
 	h.response.Write([]byte("ok\n"))
 }
@@ -60,42 +254,124 @@ func (h *RequestHandler) HandleUnsupportedProtocol() {
 	fmt.Fprintf(connection, "HTTP/1.0 400 Bad Request\r\n\r\n")
 	connection.Flush()
 	client.Close()
+
+	h.recorder.status = http.StatusBadRequest
 }
 
 func (h *RequestHandler) HandleMissingRoute() {
 	h.logger.Warnf("proxy.endpoint.not-found")
-	h.response.Header().Set("X-Cf-RouterError", "unknown_route")
+	h.response.Header().Set(RouterErrorHeader, "unknown_route")
 	message := fmt.Sprintf("Requested route ('%s') does not exist.", h.request.Host)
 	h.writeStatus(http.StatusNotFound, message)
 }
 
+// HandleRateLimited rejects a request over the rate limit, telling the client
+// to retry after wait. limited says what was limited, "route" or "client".
+func (h *RequestHandler) HandleRateLimited(limited string, wait time.Duration) {
+	h.logger.Set("Limited", limited)
+	h.logger.Warnf("proxy.rate-limited")
+
+	retryAfter := int64(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+
+	h.response.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	h.response.Header().Set(RouterErrorHeader, "rate_limited")
+
+	message := "Too many requests to this route."
+	if limited == "client" {
+		message = "Too many requests from this client."
+	}
+
+	h.writeStatus(http.StatusTooManyRequests, message)
+}
+
+// HandleConcurrencyLimited turns away a request that waited too long for
+// others to finish. limited says what had too many requests in flight.
+func (h *RequestHandler) HandleConcurrencyLimited(limited string) {
+	h.logger.Set("Limited", limited)
+	h.logger.Warnf("proxy.concurrency-limited")
+
+	h.response.Header().Set(RouterErrorHeader, "concurrency_limited")
+
+	var message string
+	switch limited {
+	case LimitedByEndpoint:
+		message = "Registered endpoints are busy."
+	case LimitedByRoute:
+		message = "Too many requests in progress for this route."
+	default:
+		message = "Too many requests in progress."
+	}
+
+	h.writeStatus(http.StatusServiceUnavailable, message)
+}
+
+// LimitBody limits the body of the request to max bytes, if max is positive.
+// It tells whether the body may be within the limit; requests declaring a
+// larger body are rejected before any of it is read.
+func (h *RequestHandler) LimitBody(max int64) bool {
+	if max <= 0 || h.request.ContentLength == 0 {
+		return true
+	}
+
+	if h.request.ContentLength > max {
+		return false
+	}
+
+	h.limitedBody = &limitedBody{ReadCloser: h.request.Body, remaining: max}
+	h.request.Body = h.limitedBody
+
+	return true
+}
+
+// BodyTooLarge tells whether the client sent more of a body than allowed.
+func (h *RequestHandler) BodyTooLarge() bool {
+	return h.limitedBody != nil && h.limitedBody.exceeded
+}
+
+func (h *RequestHandler) HandleRequestTooLarge() {
+	h.logger.Warnf("proxy.request-too-large")
+	h.response.Header().Set(RouterErrorHeader, "request_too_large")
+
+	// The rest of the body isn't worth reading
+	if h.request.ProtoMajor < 2 {
+		h.response.Header().Set("Connection", "close")
+	}
+
+	h.writeStatus(http.StatusRequestEntityTooLarge, "Request body is too large.")
+}
+
 func (h *RequestHandler) HandleBadGateway(err error) {
 	h.logger.Set("Error", err.Error())
 	h.logger.Warnf("proxy.endpoint.failed")
-	h.response.Header().Set("X-Cf-RouterError", "endpoint_failure")
+	h.response.Header().Set(RouterErrorHeader, "endpoint_failure")
 	h.writeStatus(http.StatusBadGateway, "Registered endpoint failed to handle the request.")
 }
 
-func (h *RequestHandler) HandleTcpRequest(endpoint *route.Endpoint) {
+func (h *RequestHandler) HandleTcpRequest(transport *BackendTransport, endpoint *route.Endpoint) {
 	h.logger.Set("Upgrade", "tcp")
 
-	err := h.serveTcp(endpoint)
+	err := h.serveTcp(transport, endpoint)
 	if err != nil {
 		h.logger.Set("Error", err.Error())
 		h.logger.Warn("proxy.tcp.failed")
+		h.response.Header().Set(RouterErrorHeader, "endpoint_failure")
 		h.writeStatus(http.StatusBadRequest, "TCP forwarding to endpoint failed.")
 	}
 }
 
-func (h *RequestHandler) HandleWebSocketRequest(endpoint *route.Endpoint) {
+func (h *RequestHandler) HandleWebSocketRequest(transport *BackendTransport, endpoint *route.Endpoint) {
 	h.setupRequest(endpoint)
 
 	h.logger.Set("Upgrade", "websocket")
 
-	err := h.serveWebSocket(endpoint)
+	err := h.serveWebSocket(transport, endpoint)
 	if err != nil {
 		h.logger.Set("Error", err.Error())
 		h.logger.Warn("proxy.websocket.failed")
+		h.response.Header().Set(RouterErrorHeader, "endpoint_failure")
 		h.writeStatus(http.StatusBadRequest, "WebSocket request to endpoint failed.")
 	}
 }
@@ -106,6 +382,11 @@ func (h *RequestHandler) HandleHttpRequest(transport *http.Transport, endpoint *
 	h.setupRequest(endpoint)
 	h.setupConnection()
 
+	if h.body == nil && h.request.ContentLength != 0 {
+		h.body = &replayableBody{ReadCloser: h.request.Body}
+		h.request.Body = h.body
+	}
+
 	endpointResponse, err := transport.RoundTrip(h.request)
 	if err != nil {
 		return endpointResponse, err
@@ -118,6 +399,22 @@ func (h *RequestHandler) HandleHttpRequest(transport *http.Transport, endpoint *
 	return endpointResponse, err
 }
 
+// CanRetry reports whether a request that failed with err can safely be sent
+// to another endpoint: either it never left the router, or it is idempotent
+// and none of its body has been consumed.
+func (h *RequestHandler) CanRetry(err error) bool {
+	if h.body != nil && h.body.bytesRead > 0 {
+		return false
+	}
+
+	// Busy endpoints weren't sent anything
+	if isDialError(err) || err == errEndpointBusy {
+		return true
+	}
+
+	return isIdempotent(h.request)
+}
+
 func (h *RequestHandler) SetTraceHeaders(routerIp, addr string) {
 	h.response.Header().Set(VcapRouterHeader, routerIp)
 	h.response.Header().Set(VcapBackendHeader, addr)
@@ -127,16 +424,32 @@ func (h *RequestHandler) SetTraceHeaders(routerIp, addr string) {
 func (h *RequestHandler) WriteResponse(endpointResponse *http.Response) int64 {
 	h.response.WriteHeader(endpointResponse.StatusCode)
 
-	bytesSent, err := h.copyToResponse(endpointResponse.Body)
+	// Streamed gRPC messages can't wait to be batched
+	latency := 50 * time.Millisecond
+	if isGrpc(endpointResponse.Header) {
+		latency = 0
+	}
+
+	bytesSent, err := h.copyToResponse(endpointResponse.Body, latency)
 	if err != nil {
 		h.logger.Set("Error", err.Error())
 		h.logger.Warnf("proxy.response.copy-failed")
 	}
 
+	// Trailers are known once the body has been read. They only reach
+	// clients whose connection can carry them, such as HTTP/2 ones.
+	for k, vv := range endpointResponse.Trailer {
+		for _, v := range vv {
+			h.response.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+
 	return bytesSent
 }
 
-func (h *RequestHandler) copyToResponse(src io.ReadCloser) (int64, error) {
+// copyToResponse copies src to the client, flushing at least every latency,
+// or after every write when latency is 0.
+func (h *RequestHandler) copyToResponse(src io.ReadCloser, latency time.Duration) (int64, error) {
 	if src == nil {
 		return 0, nil
 	}
@@ -145,9 +458,16 @@ func (h *RequestHandler) copyToResponse(src io.ReadCloser) (int64, error) {
 
 	// Use MaxLatencyFlusher if needed
 	if v, ok := h.response.(writeFlusher); ok {
-		u := NewMaxLatencyWriter(v, 50*time.Millisecond)
-		defer u.Stop()
-		dst = u
+		if latency == 0 {
+			// Send the headers right away too, as the endpoint may be
+			// waiting on the client before writing anything
+			v.Flush()
+			dst = flushingWriter{v}
+		} else {
+			u := NewMaxLatencyWriter(v, latency)
+			defer u.Stop()
+			dst = u
+		}
 	}
 
 	copied, err := io.Copy(dst, src)
@@ -160,16 +480,29 @@ func (h *RequestHandler) copyToResponse(src io.ReadCloser) (int64, error) {
 }
 
 func (h *RequestHandler) setupRequest(endpoint *route.Endpoint) {
-	h.setRequestURL(endpoint.CanonicalAddr())
+	h.setRequestURL(endpoint)
 	h.setRequestXForwardedFor()
+	h.setRequestXForwardedProto()
 }
 
-func (h *RequestHandler) setRequestURL(addr string) {
-	h.request.URL.Scheme = "http"
-	h.request.URL.Host = addr
+func (h *RequestHandler) setRequestURL(endpoint *route.Endpoint) {
+	if endpoint.UsesTLS() {
+		h.request.URL.Scheme = "https"
+	} else {
+		h.request.URL.Scheme = "http"
+	}
+
+	h.request.URL.Host = endpoint.BackendAddr()
 }
 
 func (h *RequestHandler) setRequestXForwardedFor() {
+	// Retries must not append the client address again
+	if h.xForwardedForSet {
+		return
+	}
+
+	h.xForwardedForSet = true
+
 	if host, _, err := net.SplitHostPort(h.request.RemoteAddr); err == nil {
 		// We assume there is a trusted upstream (L7 LB) that properly
 		// strips client's XFF header
@@ -182,14 +515,24 @@ func (h *RequestHandler) setRequestXForwardedFor() {
 	}
 }
 
+func (h *RequestHandler) setRequestXForwardedProto() {
+	// TLS terminated here always wins; otherwise keep what a trusted upstream
+	// that terminated TLS itself told us
+	if h.request.TLS != nil {
+		h.request.Header.Set("X-Forwarded-Proto", "https")
+	} else if h.request.Header.Get("X-Forwarded-Proto") == "" {
+		h.request.Header.Set("X-Forwarded-Proto", "http")
+	}
+}
+
 func (h *RequestHandler) setupConnection() {
-	// Use a new connection for every request
-	// Keep-alive can be bolted on later, if we want to
-	h.request.Close = true
+	// Connections to endpoints are pooled by the transport, independently
+	// of whether the client wants to keep its own connection alive
+	h.request.Close = false
 	h.request.Header.Del("Connection")
 }
 
-func (h *RequestHandler) serveTcp(endpoint *route.Endpoint) error {
+func (h *RequestHandler) serveTcp(transport *BackendTransport, endpoint *route.Endpoint) error {
 	var err error
 
 	client, _, err := h.hijack()
@@ -197,7 +540,9 @@ func (h *RequestHandler) serveTcp(endpoint *route.Endpoint) error {
 		return err
 	}
 
-	connection, err := net.Dial("tcp", endpoint.CanonicalAddr())
+	h.span.AddEvent("dial_start")
+	connection, err := transport.Dial(endpoint)
+	h.span.AddEvent("dial_done")
 	if err != nil {
 		return err
 	}
@@ -205,12 +550,13 @@ func (h *RequestHandler) serveTcp(endpoint *route.Endpoint) error {
 	defer client.Close()
 	defer connection.Close()
 
-	forwardIO(client, connection)
+	h.recorder.status = http.StatusSwitchingProtocols
+	h.recorder.bytesSent = forwardIO(client, connection)
 
 	return nil
 }
 
-func (h *RequestHandler) serveWebSocket(endpoint *route.Endpoint) error {
+func (h *RequestHandler) serveWebSocket(transport *BackendTransport, endpoint *route.Endpoint) error {
 	var err error
 
 	client, _, err := h.hijack()
@@ -218,7 +564,9 @@ func (h *RequestHandler) serveWebSocket(endpoint *route.Endpoint) error {
 		return err
 	}
 
-	connection, err := net.Dial("tcp", endpoint.CanonicalAddr())
+	h.span.AddEvent("dial_start")
+	connection, err := transport.Dial(endpoint)
+	h.span.AddEvent("dial_done")
 	if err != nil {
 		return err
 	}
@@ -231,13 +579,25 @@ func (h *RequestHandler) serveWebSocket(endpoint *route.Endpoint) error {
 		return err
 	}
 
-	forwardIO(client, connection)
+	// The endpoint's response is forwarded as is, whatever its status
+	h.recorder.status = http.StatusSwitchingProtocols
+	h.recorder.bytesSent = forwardIO(client, connection)
 
 	return nil
 }
 
 func (h *RequestHandler) forwardResponseHeaders(endpointResponse *http.Response) {
 	for k, vv := range endpointResponse.Header {
+		// The endpoint's connection is not the client's connection
+		if k == "Connection" || k == "Keep-Alive" {
+			continue
+		}
+
+		// The router's request id is the one the client sees
+		if k == RequestIdHeader {
+			continue
+		}
+
 		for _, v := range vv {
 			h.response.Header().Add(k, v)
 		}
@@ -281,7 +641,23 @@ func (h *RequestHandler) hijack() (client net.Conn, io *bufio.ReadWriter, err er
 	return hijacker.Hijack()
 }
 
-func forwardIO(a, b net.Conn) {
+func isGrpc(h http.Header) bool {
+	return strings.HasPrefix(h.Get("Content-Type"), "application/grpc")
+}
+
+type flushingWriter struct {
+	writeFlusher
+}
+
+func (w flushingWriter) Write(b []byte) (int, error) {
+	n, err := w.writeFlusher.Write(b)
+	w.Flush()
+	return n, err
+}
+
+// forwardIO copies between a and b until either side is done, returning the
+// number of bytes copied from b to a by then.
+func forwardIO(a, b net.Conn) int64 {
 	done := make(chan bool, 2)
 
 	copy := func(dst io.Writer, src io.Reader) {
@@ -290,8 +666,52 @@ func forwardIO(a, b net.Conn) {
 		done <- true
 	}
 
-	go copy(a, b)
+	toA := &countingWriter{Writer: a}
+
+	go copy(toA, b)
 	go copy(b, a)
 
 	<-done
+
+	return toA.Count()
+}
+
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	atomic.AddInt64(&w.n, int64(n))
+	return n, err
+}
+
+func (w *countingWriter) Count() int64 {
+	return atomic.LoadInt64(&w.n)
+}
+
+func isDialError(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// isEndpointFailure tells errors caused by the endpoint being unreachable or
+// unresponsive apart from errors in the exchange itself.
+func isEndpointFailure(err error) bool {
+	if isDialError(err) {
+		return true
+	}
+
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func isIdempotent(request *http.Request) bool {
+	switch request.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+
+	return false
 }
@@ -36,6 +36,7 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -45,6 +46,7 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -54,6 +56,7 @@ var (
 	ErrBodyNotAllowed  = errors.New("http: request method or response status code does not allow body")
 	ErrHijacked        = errors.New("Conn has been hijacked")
 	ErrContentLength   = errors.New("Conn.Write wrote more than the declared Content-Length")
+	ErrDraining        = errors.New("http: Server is draining")
 )
 
 // A ResponseWriter interface is used by an HTTP handler to
@@ -104,12 +107,14 @@ type Hijacker interface {
 
 // A conn represents the server side of an HTTP connection.
 type conn struct {
-	remoteAddr string            // network address of remote side
-	server     *Server           // the Server on which the connection arrived
-	rwc        net.Conn          // i/o connection
-	lr         *io.LimitedReader // io.LimitReader(rwc)
-	buf        *bufio.ReadWriter // buffered(lr,rwc), reading from bufio->limitReader->rwc
-	hijacked   bool              // connection has been hijacked by handler
+	remoteAddr string               // network address of remote side
+	server     *Server              // the Server on which the connection arrived
+	rwc        net.Conn             // i/o connection
+	netConn    net.Conn             // rwc, kept when rwc is closed or hijacked
+	lr         *io.LimitedReader    // io.LimitReader(rwc)
+	buf        *bufio.ReadWriter    // buffered(lr,rwc), reading from bufio->limitReader->rwc
+	hijacked   bool                 // connection has been hijacked by handler
+	tlsState   *tls.ConnectionState // or nil when not using TLS
 }
 
 type request struct {
@@ -205,6 +210,7 @@ func (srv *Server) newConn(rwc net.Conn) (c *conn, err error) {
 	c.remoteAddr = rwc.RemoteAddr().String()
 	c.server = srv
 	c.rwc = rwc
+	c.netConn = rwc
 	c.lr = io.LimitReader(rwc, noLimit).(*io.LimitedReader)
 	br := bufio.NewReader(c.lr)
 	bw := bufio.NewWriter(rwc)
@@ -217,6 +223,13 @@ func (srv *Server) newConn(rwc net.Conn) (c *conn, err error) {
 // This can be overridden by setting Server.MaxHeaderBytes.
 const DefaultMaxHeaderBytes = 1 << 20 // 1 MB
 
+func (srv *Server) idleTimeout() time.Duration {
+	if srv.IdleTimeout != 0 {
+		return srv.IdleTimeout
+	}
+	return srv.ReadTimeout
+}
+
 func (srv *Server) maxHeaderBytes() int {
 	if srv.MaxHeaderBytes > 0 {
 		return srv.MaxHeaderBytes
@@ -262,6 +275,20 @@ func (c *conn) readRequest() (r *request, w *response, err error) {
 	if c.hijacked {
 		return nil, nil, ErrHijacked
 	}
+
+	// The request, body included, must be read within the read timeout,
+	// and the response written within the write timeout from then on
+	var readDeadline time.Time
+	if d := c.server.ReadTimeout; d != 0 {
+		readDeadline = time.Now().Add(d)
+	}
+	c.rwc.SetReadDeadline(readDeadline)
+	if d := c.server.WriteTimeout; d != 0 {
+		defer func() {
+			c.rwc.SetWriteDeadline(time.Now().Add(d))
+		}()
+	}
+
 	c.lr.N = int64(c.server.maxHeaderBytes()) + 4096 /* bufio slop */
 	var req *http.Request
 	if req, err = http.ReadRequest(c.buf.Reader); err != nil {
@@ -273,6 +300,7 @@ func (c *conn) readRequest() (r *request, w *response, err error) {
 	c.lr.N = noLimit
 
 	req.RemoteAddr = c.remoteAddr
+	req.TLS = c.tlsState
 
 	w = new(response)
 	w.conn = c
@@ -344,7 +372,7 @@ func (w *response) WriteHeader(code int) {
 		w.closeAfterReply = true
 	}
 
-	if w.header.Get("Connection") == "close" {
+	if w.header.Get("Connection") == "close" || w.conn.server.isDraining() {
 		w.closeAfterReply = true
 	}
 
@@ -553,6 +581,7 @@ func (c *conn) close() {
 
 // Serve a new connection.
 func (c *conn) serve() {
+	defer c.server.trackConn(c, false)
 	defer func() {
 		err := recover()
 		if err == nil {
@@ -569,7 +598,36 @@ func (c *conn) serve() {
 		}
 	}()
 
-	for {
+	if tlsConn, ok := c.rwc.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			c.close()
+			return
+		}
+		c.tlsState = new(tls.ConnectionState)
+		*c.tlsState = tlsConn.ConnectionState()
+
+		if c.tlsState.NegotiatedProtocol == "h2" {
+			c.server.serveHTTP2(c.rwc)
+			c.rwc = nil
+			c.buf = nil
+			return
+		}
+	} else if c.server.H2C && c.hasHTTP2Preface() {
+		c.server.serveHTTP2(&bufferedConn{Conn: c.rwc, r: c.buf.Reader})
+		c.rwc = nil
+		c.buf = nil
+		return
+	}
+
+	for first := true; ; first = false {
+		if c.server.setConnIdle(c, true) {
+			break
+		}
+
+		if !first && !c.waitForRequest() {
+			break
+		}
+
 		req, w, err := c.readRequest()
 		if err != nil {
 			msg := "400 Bad Request"
@@ -589,6 +647,16 @@ func (c *conn) serve() {
 			break
 		}
 
+		// HTTP/2 requests are only served on HTTP/2 connections
+		if req.ProtoMajor > 1 {
+			fmt.Fprintf(c.rwc, "HTTP/1.1 505 HTTP Version Not Supported\r\n\r\n")
+			break
+		}
+
+		if c.server.setConnIdle(c, false) {
+			w.closeAfterReply = true
+		}
+
 		// Expect 100 Continue support
 		if req.expectsContinue() {
 			if req.ProtoAtLeast(1, 1) {
@@ -643,6 +711,20 @@ func (c *conn) serve() {
 	c.close()
 }
 
+// waitForRequest waits for the next request on a kept-alive connection, for
+// at most the idle timeout, telling whether one arrived.
+func (c *conn) waitForRequest() bool {
+	d := c.server.idleTimeout()
+	if d == 0 {
+		return true
+	}
+
+	c.rwc.SetReadDeadline(time.Now().Add(d))
+
+	_, err := c.buf.Reader.Peek(1)
+	return err == nil
+}
+
 // Hijack implements the Hijacker.Hijack method. Our response is both a ResponseWriter
 // and a Hijacker.
 func (w *response) Hijack() (rwc net.Conn, buf *bufio.ReadWriter, err error) {
@@ -652,6 +734,10 @@ func (w *response) Hijack() (rwc net.Conn, buf *bufio.ReadWriter, err error) {
 	w.conn.hijacked = true
 	rwc = w.conn.rwc
 	buf = w.conn.buf
+
+	// Hijacked connections are for the handler to time out
+	rwc.SetDeadline(time.Time{})
+
 	w.conn.rwc = nil
 	w.conn.buf = nil
 	return
@@ -663,7 +749,113 @@ type Server struct {
 	Handler        http.Handler  // handler to invoke, http.DefaultServeMux if nil
 	ReadTimeout    time.Duration // maximum duration before timing out read of the request
 	WriteTimeout   time.Duration // maximum duration before timing out write of the response
+	IdleTimeout    time.Duration // maximum duration to wait for the next request, ReadTimeout if 0
 	MaxHeaderBytes int           // maximum size of request headers, DefaultMaxHeaderBytes if 0
+
+	// HTTP/2 is served to TLS clients negotiating it via ALPN, and to
+	// cleartext clients sending the HTTP/2 connection preface if H2C is set.
+	H2C                  bool
+	MaxConcurrentStreams int // per HTTP/2 connection, DefaultMaxConcurrentStreams if 0
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[*conn]bool // open connections; true while idle between requests
+	draining  bool
+
+	h2once     sync.Once
+	h2         *http.Server
+	h2listener *connListener
+	h2stats    http2Stats
+}
+
+// Drain stops the server from accepting connections and waits up to timeout
+// for the open ones to be done. Idle connections are closed right away, the
+// others once their current request is done, or when a hijacked connection's
+// handler returns. It reports whether all connections were closed in time.
+func (srv *Server) Drain(timeout time.Duration) bool {
+	srv.mu.Lock()
+	srv.draining = true
+	for l := range srv.listeners {
+		l.Close()
+	}
+	for c, idle := range srv.conns {
+		if idle {
+			c.netConn.Close()
+		}
+	}
+	srv.mu.Unlock()
+
+	go srv.drainHTTP2(timeout)
+
+	deadline := time.Now().Add(timeout)
+	for srv.NumConns() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+func (srv *Server) NumConns() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return len(srv.conns) + srv.h2stats.conns
+}
+
+func (srv *Server) isDraining() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.draining
+}
+
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]bool)
+	}
+
+	if !add {
+		delete(srv.listeners, l)
+	} else if !srv.draining {
+		srv.listeners[l] = true
+	}
+
+	return srv.draining
+}
+
+func (srv *Server) trackConn(c *conn, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.conns == nil {
+		srv.conns = make(map[*conn]bool)
+	}
+
+	if !add {
+		delete(srv.conns, c)
+	} else if !srv.draining {
+		srv.conns[c] = false
+	}
+
+	return srv.draining
+}
+
+// setConnIdle records whether c is waiting for its next request, reporting
+// whether the server is draining.
+func (srv *Server) setConnIdle(c *conn, idle bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.conns[c] = idle
+
+	return srv.draining
 }
 
 // Serve accepts incoming connections on the Listener l, creating a
@@ -671,10 +863,17 @@ type Server struct {
 // then call srv.Handler to reply to them.
 func (srv *Server) Serve(l net.Listener) error {
 	defer l.Close()
+	if srv.trackListener(l, true) {
+		return ErrDraining
+	}
+	defer srv.trackListener(l, false)
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
 		rw, e := l.Accept()
 		if e != nil {
+			if srv.isDraining() {
+				return ErrDraining
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -701,6 +900,10 @@ func (srv *Server) Serve(l net.Listener) error {
 		if err != nil {
 			continue
 		}
+		if srv.trackConn(c, true) {
+			rw.Close()
+			continue
+		}
 		go c.serve()
 	}
 	panic("not reached")
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The server only speaks HTTP/1. Connections that negotiate HTTP/2 via ALPN,
+// or that start with the HTTP/2 connection preface when H2C is set, are
+// handed to a net/http server serving the same handler.
+
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Streams a client may have open at once on an HTTP/2 connection, unless set
+// otherwise.
+const DefaultMaxConcurrentStreams = 100
+
+var errHTTP2ListenerClosed = errors.New("http2: listener closed")
+
+// http2Stats are guarded by the server's mutex.
+type http2Stats struct {
+	conns         int
+	streams       int64
+	activeStreams int
+}
+
+func (srv *Server) http2Server() *http.Server {
+	srv.h2once.Do(func() {
+		protocols := new(http.Protocols)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+
+		maxStreams := srv.MaxConcurrentStreams
+		if maxStreams <= 0 {
+			maxStreams = DefaultMaxConcurrentStreams
+		}
+
+		h2 := &http.Server{
+			Handler:        http.HandlerFunc(srv.serveHTTP2Stream),
+			Protocols:      protocols,
+			HTTP2:          &http.HTTP2Config{MaxConcurrentStreams: maxStreams},
+			ReadTimeout:    srv.ReadTimeout,
+			WriteTimeout:   srv.WriteTimeout,
+			IdleTimeout:    srv.IdleTimeout,
+			MaxHeaderBytes: srv.MaxHeaderBytes,
+			ConnState:      srv.trackHTTP2Conn,
+			ErrorLog:       log.New(ioutil.Discard, "", 0),
+		}
+
+		srv.h2listener = newConnListener()
+		go h2.Serve(srv.h2listener)
+
+		srv.mu.Lock()
+		srv.h2 = h2
+		srv.mu.Unlock()
+	})
+
+	return srv.h2
+}
+
+// serveHTTP2 hands rwc over to the HTTP/2 server, which owns it from then on.
+func (srv *Server) serveHTTP2(rwc net.Conn) {
+	srv.http2Server()
+
+	// The HTTP/2 server times out connections and streams itself
+	rwc.SetDeadline(time.Time{})
+
+	srv.mu.Lock()
+	if srv.draining {
+		srv.mu.Unlock()
+		rwc.Close()
+		return
+	}
+
+	// Counted until the HTTP/2 server reports the connection closed, so
+	// that it's never missing from NumConns while being handed over
+	srv.h2stats.conns++
+	srv.mu.Unlock()
+
+	if !srv.h2listener.hand(rwc) {
+		srv.trackHTTP2Conn(rwc, http.StateClosed)
+	}
+}
+
+func (srv *Server) trackHTTP2Conn(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.h2stats.conns--
+}
+
+func (srv *Server) serveHTTP2Stream(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	srv.h2stats.streams++
+	srv.h2stats.activeStreams++
+	srv.mu.Unlock()
+
+	defer func() {
+		srv.mu.Lock()
+		srv.h2stats.activeStreams--
+		srv.mu.Unlock()
+	}()
+
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+
+	handler.ServeHTTP(w, r)
+}
+
+// drainHTTP2 tells HTTP/2 clients to go away, and closes their connections
+// once their streams are done.
+func (srv *Server) drainHTTP2(timeout time.Duration) {
+	srv.mu.Lock()
+	h2 := srv.h2
+	srv.mu.Unlock()
+
+	if h2 == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	h2.Shutdown(ctx)
+}
+
+// Http2Conns returns the number of open HTTP/2 connections.
+func (srv *Server) Http2Conns() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.h2stats.conns
+}
+
+// Http2Streams returns the number of HTTP/2 streams served.
+func (srv *Server) Http2Streams() int64 {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.h2stats.streams
+}
+
+// Http2ActiveStreams returns the number of HTTP/2 streams being served.
+func (srv *Server) Http2ActiveStreams() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.h2stats.activeStreams
+}
+
+// hasHTTP2Preface tells whether c starts with the HTTP/2 connection preface,
+// without consuming it. Only as much as the shortest HTTP/1 request line is
+// read before deciding, so that HTTP/1 clients are never kept waiting.
+func (c *conn) hasHTTP2Preface() bool {
+	for _, n := range []int{len("PRI * HTTP/2.0"), len(http2Preface)} {
+		b, err := c.buf.Reader.Peek(n)
+		if err != nil || !bytes.Equal(b, []byte(http2Preface[:n])) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bufferedConn replays what was read into r before reading from the
+// connection itself.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connListener is a listener that accepts the connections handed to it.
+type connListener struct {
+	conns     chan net.Conn
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan bool),
+	}
+}
+
+func (l *connListener) hand(c net.Conn) bool {
+	select {
+	case l.conns <- c:
+		return true
+	case <-l.closed:
+		c.Close()
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errHTTP2ListenerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/test"
+	. "launchpad.net/gocheck"
+)
+
+type ServerSuite struct {
+	server   *Server
+	listener net.Listener
+
+	// Slow requests signal started and wait for release to be closed
+	started chan bool
+	release chan bool
+}
+
+var _ = Suite(&ServerSuite{})
+
+func (s *ServerSuite) SetUpTest(c *C) {
+	s.started = make(chan bool, 1)
+	s.release = make(chan bool)
+
+	s.server = &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				s.started <- true
+				<-s.release
+			}
+
+			w.Header().Set("X-Proto", r.Proto)
+			w.Write([]byte("done"))
+		}),
+	}
+
+	var err error
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	go s.server.Serve(s.listener)
+}
+
+func (s *ServerSuite) dial(c *C) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	c.Assert(err, IsNil)
+
+	return conn, bufio.NewReader(conn)
+}
+
+func (s *ServerSuite) get(c *C, conn net.Conn, r *bufio.Reader, path string) *http.Response {
+	req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+	c.Assert(req.Write(conn), IsNil)
+
+	resp, err := http.ReadResponse(r, req)
+	c.Assert(err, IsNil)
+
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	return resp
+}
+
+func (s *ServerSuite) waitForConns(c *C, n int) {
+	for i := 0; i < 100 && s.server.NumConns() != n; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	c.Assert(s.server.NumConns(), Equals, n)
+}
+
+func (s *ServerSuite) TestDrainClosesIdleConnections(c *C) {
+	conn, r := s.dial(c)
+	defer conn.Close()
+
+	s.get(c, conn, r, "/")
+	s.waitForConns(c, 1)
+
+	c.Check(s.server.Drain(time.Second), Equals, true)
+	c.Check(s.server.NumConns(), Equals, 0)
+
+	_, err := r.ReadByte()
+	c.Check(err, NotNil)
+}
+
+func (s *ServerSuite) TestDrainWaitsForActiveRequests(c *C) {
+	conn, r := s.dial(c)
+	defer conn.Close()
+
+	responses := make(chan *http.Response)
+	go func() {
+		responses <- s.get(c, conn, r, "/slow")
+	}()
+
+	<-s.started
+
+	drained := make(chan bool)
+	go func() {
+		drained <- s.server.Drain(time.Second)
+	}()
+
+	// New connections are refused once draining
+	time.Sleep(20 * time.Millisecond)
+	_, err := net.Dial("tcp", s.listener.Addr().String())
+	c.Check(err, NotNil)
+
+	close(s.release)
+
+	resp := <-responses
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.Close, Equals, true)
+
+	c.Check(<-drained, Equals, true)
+}
+
+func (s *ServerSuite) TestDrainGivesUpAfterTimeout(c *C) {
+	conn, _ := s.dial(c)
+	defer conn.Close()
+
+	req, _ := http.NewRequest("GET", "http://localhost/slow", nil)
+	c.Assert(req.Write(conn), IsNil)
+
+	<-s.started
+
+	c.Check(s.server.Drain(50*time.Millisecond), Equals, false)
+	c.Check(s.server.NumConns(), Equals, 1)
+
+	close(s.release)
+}
+
+func (s *ServerSuite) TestServeReturnsWhenDraining(c *C) {
+	s.server.Drain(time.Second)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	c.Check(s.server.Serve(listener), Equals, ErrDraining)
+}
+
+// http2Client returns a client speaking HTTP/2 only, with TLS if tlsConfig
+// isn't nil and without it otherwise.
+func (s *ServerSuite) TestIdleTimeoutClosesKeptAliveConnections(c *C) {
+	s.server.IdleTimeout = 50 * time.Millisecond
+
+	conn, r := s.dial(c)
+	defer conn.Close()
+
+	s.get(c, conn, r, "/")
+
+	// Give up well after the idle timeout, rather than hang
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, err := r.ReadByte()
+	c.Check(err, Equals, io.EOF)
+}
+
+func (s *ServerSuite) TestReadTimeoutClosesSlowClients(c *C) {
+	s.server.ReadTimeout = 50 * time.Millisecond
+
+	conn, r := s.dial(c)
+	defer conn.Close()
+
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\n"))
+	c.Assert(err, IsNil)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, err = r.ReadByte()
+	c.Check(err, Equals, io.EOF)
+}
+
+func (s *ServerSuite) TestRejectsLargeHeaders(c *C) {
+	s.server.MaxHeaderBytes = 1024
+
+	conn, r := s.dial(c)
+	defer conn.Close()
+
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("X-Large", strings.Repeat("x", 8192))
+	c.Assert(req.Write(conn), IsNil)
+
+	resp, err := http.ReadResponse(r, req)
+	c.Assert(err, IsNil)
+	c.Check(resp.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+}
+
+func http2Client(tlsConfig *tls.Config) *http.Client {
+	protocols := new(http.Protocols)
+	if tlsConfig != nil {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Protocols:       protocols,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+}
+
+func (s *ServerSuite) http2Get(c *C, client *http.Client, url string) *http.Response {
+	resp, err := client.Get(url)
+	c.Assert(err, IsNil)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Check(string(body), Equals, "done")
+	resp.Body.Close()
+
+	return resp
+}
+
+func (s *ServerSuite) TestServesHTTP2OverTLS(c *C) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{test.GenerateTLSCertificate("localhost")},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	go s.server.Serve(ln)
+
+	url := "https://" + ln.Addr().String() + "/"
+
+	client := http2Client(&tls.Config{InsecureSkipVerify: true})
+	resp := s.http2Get(c, client, url)
+	c.Check(resp.ProtoMajor, Equals, 2)
+	c.Check(resp.Header.Get("X-Proto"), Equals, "HTTP/2.0")
+
+	s.http2Get(c, client, url)
+	c.Check(s.server.Http2Conns(), Equals, 1)
+	c.Check(s.server.Http2Streams(), Equals, int64(2))
+	c.Check(s.server.Http2ActiveStreams(), Equals, 0)
+
+	// Clients not negotiating HTTP/2 still get HTTP/1.1
+	http1 := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp = s.http2Get(c, http1, url)
+	c.Check(resp.Header.Get("X-Proto"), Equals, "HTTP/1.1")
+}
+
+func (s *ServerSuite) TestServesH2C(c *C) {
+	s.server.H2C = true
+
+	resp := s.http2Get(c, http2Client(nil), "http://"+s.listener.Addr().String()+"/")
+	c.Check(resp.ProtoMajor, Equals, 2)
+	c.Check(resp.Header.Get("X-Proto"), Equals, "HTTP/2.0")
+
+	// HTTP/1 clients are unaffected
+	conn, r := s.dial(c)
+	defer conn.Close()
+
+	resp = s.get(c, conn, r, "/")
+	c.Check(resp.Header.Get("X-Proto"), Equals, "HTTP/1.1")
+}
+
+func (s *ServerSuite) TestRejectsH2CUnlessEnabled(c *C) {
+	_, err := http2Client(nil).Get("http://" + s.listener.Addr().String() + "/")
+	c.Check(err, NotNil)
+}
+
+func (s *ServerSuite) TestRejectsHTTP2RequestsOverHTTP1(c *C) {
+	conn, r := s.dial(c)
+	defer conn.Close()
+
+	conn.Write([]byte("GET / HTTP/2.0\r\nHost: localhost\r\n\r\n"))
+
+	line, err := r.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Check(line, Equals, "HTTP/1.1 505 HTTP Version Not Supported\r\n")
+}
+
+func (s *ServerSuite) TestDrainWaitsForHTTP2Streams(c *C) {
+	s.server.H2C = true
+
+	done := make(chan *http.Response)
+	go func() {
+		resp, _ := http2Client(nil).Get("http://" + s.listener.Addr().String() + "/slow")
+		done <- resp
+	}()
+
+	<-s.started
+	c.Check(s.server.Http2ActiveStreams(), Equals, 1)
+
+	drained := make(chan bool)
+	go func() {
+		drained <- s.server.Drain(time.Second)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	close(s.release)
+
+	resp := <-done
+	c.Assert(resp, NotNil)
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	c.Check(<-drained, Equals, true)
+	c.Check(s.server.NumConns(), Equals, 0)
+}
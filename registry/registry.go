@@ -26,8 +26,20 @@ type Registry struct {
 
 	table map[tableKey]*tableEntry
 
+	// Number of routes each endpoint address is registered under
+	addrRefs map[string]int
+
+	endpointRemovedCallbacks []func(*route.Endpoint)
+	routeRemovedCallbacks    []func(route.Uri)
+
 	pruneStaleDropletsInterval time.Duration
 	dropletStaleThreshold      time.Duration
+	pruneIntervalChanged       chan bool
+
+	loadBalancing string
+
+	endpointFailureThreshold int
+	endpointFailureBackoff   time.Duration
 
 	messageBus yagnats.NATSClient
 
@@ -47,7 +59,7 @@ type tableEntry struct {
 func NewRegistry(c *config.Config, mbus yagnats.NATSClient) *Registry {
 	r := &Registry{}
 
-	r.Logger = steno.NewLogger("router.registry")
+	r.Logger = log.NewLogger("router.registry")
 
 	r.ActiveApps = stats.NewActiveApps()
 	r.TopApps = stats.NewTopApps()
@@ -55,9 +67,17 @@ func NewRegistry(c *config.Config, mbus yagnats.NATSClient) *Registry {
 	r.byUri = make(map[route.Uri]*route.Pool)
 
 	r.table = make(map[tableKey]*tableEntry)
+	r.addrRefs = make(map[string]int)
 
 	r.pruneStaleDropletsInterval = c.PruneStaleDropletsInterval
 	r.dropletStaleThreshold = c.DropletStaleThreshold
+	r.pruneIntervalChanged = make(chan bool, 1)
+
+	// Validated along with the rest of the config
+	r.loadBalancing = c.LoadBalancing
+
+	r.endpointFailureThreshold = c.EndpointFailureThreshold
+	r.endpointFailureBackoff = c.EndpointFailureBackoff
 
 	r.messageBus = mbus
 
@@ -68,7 +88,7 @@ func (registry *Registry) Register(uri route.Uri, endpoint *route.Endpoint) {
 	registry.Lock()
 	defer registry.Unlock()
 
-	uri = uri.ToLower()
+	uri = uri.RouteKey()
 
 	key := tableKey{
 		addr: endpoint.CanonicalAddr(),
@@ -80,19 +100,33 @@ func (registry *Registry) Register(uri route.Uri, endpoint *route.Endpoint) {
 	entry, found := registry.table[key]
 	if found {
 		endpointToRegister = entry.endpoint
+
+		// Re-registering updates the endpoint's share of the route. The
+		// rest of the endpoint is in use by requests, and only changes
+		// once it has been unregistered or pruned.
+		endpointToRegister.Weight = endpoint.Weight
 	} else {
 		endpointToRegister = endpoint
 		entry = &tableEntry{endpoint: endpoint}
 
 		registry.table[key] = entry
+		registry.addrRefs[key.addr]++
 	}
 
 	pool, found := registry.byUri[uri]
 	if !found {
 		pool = route.NewPool()
+		pool.SetLoadBalancing(registry.loadBalancing)
 		registry.byUri[uri] = pool
 	}
 
+	if endpoint.LoadBalancing != "" {
+		err := pool.SetLoadBalancing(endpoint.LoadBalancing)
+		if err != nil {
+			registry.Warnf("Ignoring load balancing for %s: %s", uri, err)
+		}
+	}
+
 	pool.Add(endpointToRegister)
 
 	entry.updatedAt = time.Now()
@@ -104,7 +138,7 @@ func (registry *Registry) Unregister(uri route.Uri, endpoint *route.Endpoint) {
 	registry.Lock()
 	defer registry.Unlock()
 
-	uri = uri.ToLower()
+	uri = uri.RouteKey()
 
 	key := tableKey{
 		addr: endpoint.CanonicalAddr(),
@@ -135,19 +169,141 @@ func (r *Registry) LookupByPrivateInstanceId(uri route.Uri, p string) (*route.En
 		return nil, false
 	}
 
-	return pool.FindByPrivateInstanceId(p)
+	endpoint, ok := pool.FindByPrivateInstanceId(p)
+	if !ok || !endpoint.Claim() {
+		return nil, false
+	}
+
+	return endpoint, true
+}
+
+// PoolFor returns the route requests for uri are routed to, and its pool.
+func (r *Registry) PoolFor(uri route.Uri) (route.Uri, *route.Pool, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.matchUri(uri)
+}
+
+// Sample picks an endpoint of pool, as returned by PoolFor.
+func (r *Registry) Sample(pool *route.Pool) (*route.Endpoint, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	return pool.Sample()
+}
+
+// SampleExcluding picks an endpoint of pool other than the excluded ones.
+func (r *Registry) SampleExcluding(pool *route.Pool, excluded []*route.Endpoint) (*route.Endpoint, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	return pool.SampleExcluding(excluded)
+}
+
+// SampleByPrivateInstanceId picks the endpoint of pool with the given private
+// instance id, if there is one and it can be sent a request.
+func (r *Registry) SampleByPrivateInstanceId(pool *route.Pool, p string) (*route.Endpoint, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	endpoint, ok := pool.FindByPrivateInstanceId(p)
+	if !ok || !endpoint.Claim() {
+		return nil, false
+	}
+
+	return endpoint, true
 }
 
 func (r *Registry) lookupByUri(uri route.Uri) (*route.Pool, bool) {
-	uri = uri.ToLower()
-	pool, ok := r.byUri[uri]
+	_, pool, ok := r.matchUri(uri)
 	return pool, ok
 }
 
+// matchUri finds the route matching uri, and its pool. Routes for the exact
+// host name take precedence, followed by wildcard routes from the most to the
+// least specific, e.g. "*.foo.example.com" before "*.example.com". Among the
+// routes for a host name the one with the longest matching path prefix wins.
+func (r *Registry) matchUri(uri route.Uri) (route.Uri, *route.Pool, bool) {
+	uri = uri.RouteKey()
+
+	host, path := uri.Host(), uri.Path()
+
+	for {
+		key, pool, ok := r.matchPath(host + route.Uri(path))
+		if ok {
+			return key, pool, true
+		}
+
+		host, ok = host.NextWildcard()
+		if !ok {
+			return "", nil, false
+		}
+	}
+}
+
+// matchPath finds the route with the longest path prefix matching uri, down
+// to a route for the host name alone.
+func (r *Registry) matchPath(uri route.Uri) (route.Uri, *route.Pool, bool) {
+	for {
+		pool, ok := r.byUri[uri]
+		if ok {
+			return uri, pool, true
+		}
+
+		uri, ok = uri.Parent()
+		if !ok {
+			return "", nil, false
+		}
+	}
+}
+
+// OnEndpointRemoved registers a function to be called once an endpoint is no
+// longer registered under any route, either because it was unregistered or
+// because it was pruned. It is called with the registry locked, so it must
+// not call back into the registry.
+func (registry *Registry) OnEndpointRemoved(callback func(*route.Endpoint)) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.endpointRemovedCallbacks = append(registry.endpointRemovedCallbacks, callback)
+}
+
+// OnRouteRemoved registers a function to be called once the last endpoint
+// of a route is gone. Like OnEndpointRemoved callbacks, it is called with the
+// registry locked.
+func (registry *Registry) OnRouteRemoved(callback func(route.Uri)) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.routeRemovedCallbacks = append(registry.routeRemovedCallbacks, callback)
+}
+
 func (registry *Registry) StartPruningCycle() {
 	go registry.checkAndPrune()
 }
 
+// SetPruneStaleDroplets changes how often stale droplets are pruned and how
+// long it takes for a droplet to become stale. An interval of 0 stops pruning.
+func (registry *Registry) SetPruneStaleDroplets(interval, staleThreshold time.Duration) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	previous := registry.pruneStaleDropletsInterval
+
+	registry.pruneStaleDropletsInterval = interval
+	registry.dropletStaleThreshold = staleThreshold
+
+	if interval == previous {
+		return
+	}
+
+	select {
+	case registry.pruneIntervalChanged <- true:
+	default:
+	}
+}
+
 func (registry *Registry) PruneStaleDroplets() {
 	if registry.isStateStale() {
 		log.Info("State is stale; NOT pruning")
@@ -168,6 +324,22 @@ func (r *Registry) CaptureRoutingRequest(x *route.Endpoint, t time.Time) {
 	}
 }
 
+// CaptureEndpointFailure is called by the proxy when an endpoint could not be
+// reached or timed out.
+func (r *Registry) CaptureEndpointFailure(x *route.Endpoint) {
+	if r.endpointFailureThreshold == 0 {
+		return
+	}
+
+	if x.MarkFailed(r.endpointFailureThreshold, r.endpointFailureBackoff) {
+		r.Warnf("Endpoint %s failed %d times in a row; excluding it for %s", x.CanonicalAddr(), r.endpointFailureThreshold, r.endpointFailureBackoff)
+	}
+}
+
+func (r *Registry) CaptureEndpointSuccess(x *route.Endpoint) {
+	x.MarkSucceeded()
+}
+
 func (registry *Registry) NumUris() int {
 	registry.RLock()
 	defer registry.RUnlock()
@@ -183,12 +355,21 @@ func (r *Registry) NumEndpoints() int {
 	r.RLock()
 	defer r.RUnlock()
 
-	mapForSize := make(map[string]bool)
-	for _, entry := range r.table {
-		mapForSize[entry.endpoint.CanonicalAddr()] = true
+	return len(r.addrRefs)
+}
+
+// EndpointsByAddr returns every registered endpoint, grouped by address. The
+// same address registered under several routes has an endpoint per route.
+func (r *Registry) EndpointsByAddr() map[string][]*route.Endpoint {
+	r.RLock()
+	defer r.RUnlock()
+
+	endpoints := make(map[string][]*route.Endpoint)
+	for key, entry := range r.table {
+		endpoints[key.addr] = append(endpoints[key.addr], entry.endpoint)
 	}
 
-	return len(mapForSize)
+	return endpoints
 }
 
 func (r *Registry) MarshalJSON() ([]byte, error) {
@@ -224,16 +405,22 @@ func (registry *Registry) pauseStaleTracker() {
 }
 
 func (r *Registry) checkAndPrune() {
-	if r.pruneStaleDropletsInterval == 0 {
-		return
-	}
-
-	tick := time.Tick(r.pruneStaleDropletsInterval)
 	for {
+		r.RLock()
+		interval := r.pruneStaleDropletsInterval
+		r.RUnlock()
+
+		// Pruning is disabled until the interval changes
+		var tick <-chan time.Time
+		if interval != 0 {
+			tick = time.After(interval)
+		}
+
 		select {
 		case <-tick:
 			log.Debug("Start to check and prune stale droplets")
 			r.PruneStaleDroplets()
+		case <-r.pruneIntervalChanged:
 		}
 	}
 }
@@ -250,8 +437,21 @@ func (registry *Registry) unregisterUri(key tableKey) {
 
 		if endpoints.IsEmpty() {
 			delete(registry.byUri, key.uri)
+
+			for _, callback := range registry.routeRemovedCallbacks {
+				callback(key.uri)
+			}
 		}
 	}
 
 	delete(registry.table, key)
+
+	registry.addrRefs[key.addr]--
+	if registry.addrRefs[key.addr] <= 0 {
+		delete(registry.addrRefs, key.addr)
+
+		for _, callback := range registry.endpointRemovedCallbacks {
+			callback(entry.endpoint)
+		}
+	}
 }
@@ -137,6 +137,21 @@ func (s *RegistrySuite) TestRegisterDoesntReplaceSameEndpoint(c *C) {
 	c.Check(s.NumEndpoints(), Equals, 1)
 }
 
+func (s *RegistrySuite) TestRegisterUpdatesWeight(c *C) {
+	s.Register("foo", &route.Endpoint{Host: "192.168.1.1", Port: 1234, Weight: 95})
+
+	b, ok := s.Lookup("foo")
+	c.Assert(ok, Equals, true)
+	c.Check(b.Weight, Equals, 95)
+
+	s.Register("foo", &route.Endpoint{Host: "192.168.1.1", Port: 1234, Weight: 50})
+
+	b, ok = s.Lookup("foo")
+	c.Assert(ok, Equals, true)
+	c.Check(b.Weight, Equals, 50)
+	c.Check(s.NumEndpoints(), Equals, 1)
+}
+
 func (s *RegistrySuite) TestUnregister(c *C) {
 	s.Register("bar", barEndpoint)
 	s.Register("baar", barEndpoint)
@@ -215,6 +230,138 @@ func (s *RegistrySuite) TestLookup(c *C) {
 	c.Check(b.CanonicalAddr(), Equals, "192.168.1.1:1234")
 }
 
+func (s *RegistrySuite) TestLookupPathRoutes(c *C) {
+	root := &route.Endpoint{Host: "192.168.1.1", Port: 1234}
+	api := &route.Endpoint{Host: "192.168.1.2", Port: 1234}
+	v2 := &route.Endpoint{Host: "192.168.1.3", Port: 1234}
+
+	s.Register("foo.com", root)
+	s.Register("foo.com/api", api)
+	s.Register("foo.com/api/v2/", v2)
+
+	lookup := func(uri route.Uri) string {
+		b, ok := s.Lookup(uri)
+		c.Assert(ok, Equals, true)
+		return b.CanonicalAddr()
+	}
+
+	c.Check(lookup("foo.com"), Equals, "192.168.1.1:1234")
+	c.Check(lookup("foo.com/"), Equals, "192.168.1.1:1234")
+	c.Check(lookup("foo.com/apiary"), Equals, "192.168.1.1:1234")
+	c.Check(lookup("foo.com/api"), Equals, "192.168.1.2:1234")
+	c.Check(lookup("foo.com/API/users/1"), Equals, "192.168.1.2:1234")
+	c.Check(lookup("foo.com/api/v2"), Equals, "192.168.1.3:1234")
+	c.Check(lookup("foo.com/api/v2/users"), Equals, "192.168.1.3:1234")
+}
+
+func (s *RegistrySuite) TestLookupPathRouteWithoutHostRoute(c *C) {
+	s.Register("foo.com/api", &route.Endpoint{Host: "192.168.1.1", Port: 1234})
+
+	_, ok := s.Lookup("foo.com")
+	c.Check(ok, Equals, false)
+
+	_, ok = s.Lookup("foo.com/other")
+	c.Check(ok, Equals, false)
+
+	_, ok = s.Lookup("foo.com/api/users")
+	c.Check(ok, Equals, true)
+}
+
+func (s *RegistrySuite) TestPoolFor(c *C) {
+	s.Register("foo.com", &route.Endpoint{Host: "192.168.1.1", Port: 1234})
+	s.Register("foo.com/api", &route.Endpoint{Host: "192.168.1.2", Port: 1234})
+	s.Register("*.bar.com", &route.Endpoint{Host: "192.168.1.3", Port: 1234})
+
+	uri, _, ok := s.PoolFor("FOO.com/api/users")
+	c.Check(ok, Equals, true)
+	c.Check(uri, Equals, route.Uri("foo.com/api"))
+
+	uri, _, ok = s.PoolFor("foo.com/apiary")
+	c.Check(ok, Equals, true)
+	c.Check(uri, Equals, route.Uri("foo.com"))
+
+	uri, _, ok = s.PoolFor("app.bar.com/")
+	c.Check(ok, Equals, true)
+	c.Check(uri, Equals, route.Uri("*.bar.com"))
+
+	_, _, ok = s.PoolFor("baz.com")
+	c.Check(ok, Equals, false)
+}
+
+func (s *RegistrySuite) TestLookupWildcardRoutes(c *C) {
+	apps := &route.Endpoint{Host: "192.168.1.1", Port: 1234}
+	foo := &route.Endpoint{Host: "192.168.1.2", Port: 1234}
+	exact := &route.Endpoint{Host: "192.168.1.3", Port: 1234}
+
+	s.Register("*.apps.com", apps)
+	s.Register("*.foo.apps.com", foo)
+	s.Register("exact.apps.com", exact)
+
+	lookup := func(uri route.Uri) string {
+		b, ok := s.Lookup(uri)
+		c.Assert(ok, Equals, true)
+		return b.CanonicalAddr()
+	}
+
+	c.Check(lookup("bar.apps.com"), Equals, "192.168.1.1:1234")
+	c.Check(lookup("BAR.APPS.COM/path"), Equals, "192.168.1.1:1234")
+	c.Check(lookup("a.b.apps.com"), Equals, "192.168.1.1:1234")
+	c.Check(lookup("bar.foo.apps.com"), Equals, "192.168.1.2:1234")
+	c.Check(lookup("exact.apps.com"), Equals, "192.168.1.3:1234")
+
+	_, ok := s.Lookup("apps.com")
+	c.Check(ok, Equals, false)
+
+	_, ok = s.Lookup("bar.other.com")
+	c.Check(ok, Equals, false)
+}
+
+func (s *RegistrySuite) TestLookupExactHostBeforeWildcardPathRoute(c *C) {
+	wildcardApi := &route.Endpoint{Host: "192.168.1.1", Port: 1234}
+	exact := &route.Endpoint{Host: "192.168.1.2", Port: 1234}
+
+	s.Register("*.apps.com/api", wildcardApi)
+	s.Register("exact.apps.com", exact)
+
+	b, ok := s.Lookup("exact.apps.com/api")
+	c.Assert(ok, Equals, true)
+	c.Check(b.CanonicalAddr(), Equals, "192.168.1.2:1234")
+
+	b, ok = s.Lookup("other.apps.com/api/users")
+	c.Assert(ok, Equals, true)
+	c.Check(b.CanonicalAddr(), Equals, "192.168.1.1:1234")
+
+	_, ok = s.Lookup("other.apps.com/")
+	c.Check(ok, Equals, false)
+}
+
+func (s *RegistrySuite) TestUnregisterWildcardRoute(c *C) {
+	m := &route.Endpoint{Host: "192.168.1.1", Port: 1234}
+
+	s.Register("*.apps.com", m)
+	s.Unregister("*.APPS.com", m)
+
+	_, ok := s.Lookup("foo.apps.com")
+	c.Check(ok, Equals, false)
+	c.Check(s.NumUris(), Equals, 0)
+}
+
+func (s *RegistrySuite) TestUnregisterPathRoute(c *C) {
+	m := &route.Endpoint{Host: "192.168.1.1", Port: 1234}
+
+	s.Register("foo.com", m)
+	s.Register("foo.com/api", m)
+	c.Check(s.NumUris(), Equals, 2)
+	c.Check(s.NumEndpoints(), Equals, 1)
+
+	s.Unregister("foo.com/api/", m)
+	c.Check(s.NumUris(), Equals, 1)
+	c.Check(s.NumEndpoints(), Equals, 1)
+
+	_, ok := s.Lookup("foo.com/api")
+	c.Check(ok, Equals, true)
+}
+
 func (s *RegistrySuite) TestLookupDoubleRegister(c *C) {
 	m1 := &route.Endpoint{
 		Host: "192.168.1.2",
@@ -256,6 +403,29 @@ func (s *RegistrySuite) TestPruneStaleApps(c *C) {
 	c.Check(s.NumEndpoints(), Equals, 1)
 }
 
+func (s *RegistrySuite) TestSetPruneStaleDroplets(c *C) {
+	configObj := config.DefaultConfig()
+	configObj.PruneStaleDropletsInterval = 0
+
+	r := NewRegistry(configObj, s.messageBus)
+	r.StartPruningCycle()
+
+	r.Register("foo", fooEndpoint)
+
+	r.SetPruneStaleDroplets(5*time.Millisecond, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	c.Check(r.NumUris(), Equals, 0)
+
+	r.SetPruneStaleDroplets(0, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	r.Register("foo", fooEndpoint)
+	time.Sleep(20 * time.Millisecond)
+
+	c.Check(r.NumUris(), Equals, 1)
+}
+
 func (s *RegistrySuite) TestPruningIsByUriNotJustAddr(c *C) {
 	endpoint := &route.Endpoint{
 		Host: "192.168.1.1",
@@ -348,5 +518,173 @@ func (s *RegistrySuite) TestInfoMarshalling(c *C) {
 	marshalled, err := json.Marshal(s)
 	c.Check(err, IsNil)
 
-	c.Check(string(marshalled), Equals, "{\"foo\":[\"192.168.1.1:1234\"]}")
+	c.Check(string(marshalled), Equals, `{"foo":{"endpoints":[{"address":"192.168.1.1:1234","state":"healthy","weight":1,"in_flight":0}],"in_flight":0,"queued":0}}`)
+}
+
+func (s *RegistrySuite) TestInfoMarshallingPathRoutes(c *C) {
+	m := &route.Endpoint{
+		Host: "192.168.1.1",
+		Port: 1234,
+	}
+
+	s.Register("foo/Bar/", m)
+	marshalled, err := json.Marshal(s)
+	c.Check(err, IsNil)
+
+	c.Check(string(marshalled), Equals, `{"foo/bar":{"endpoints":[{"address":"192.168.1.1:1234","state":"healthy","weight":1,"in_flight":0}],"in_flight":0,"queued":0}}`)
+}
+
+func (s *RegistrySuite) TestLoadBalancingDefaultsToConfig(c *C) {
+	configObj := config.DefaultConfig()
+	configObj.LoadBalancing = "round_robin"
+
+	r := NewRegistry(configObj, s.messageBus)
+	r.Register("foo", fooEndpoint)
+
+	pool, _ := r.lookupByUri("foo")
+	c.Check(pool.LoadBalancing(), Equals, "round_robin")
+}
+
+func (s *RegistrySuite) TestLoadBalancingOverriddenByEndpoint(c *C) {
+	m := &route.Endpoint{
+		Host: "192.168.1.1",
+		Port: 1234,
+
+		LoadBalancing: "least_connections",
+	}
+
+	s.Register("foo", fooEndpoint)
+	s.Register("foo", m)
+
+	pool, _ := s.lookupByUri("foo")
+	c.Check(pool.LoadBalancing(), Equals, "least_connections")
+
+	// Registrations that don't ask for a strategy leave the override alone
+	s.Register("foo", fooEndpoint)
+	c.Check(pool.LoadBalancing(), Equals, "least_connections")
+
+	m.LoadBalancing = "bogus"
+	s.Register("foo", m)
+	c.Check(pool.LoadBalancing(), Equals, "least_connections")
+}
+
+func (s *RegistrySuite) TestOnEndpointRemoved(c *C) {
+	removed := []string{}
+	s.OnEndpointRemoved(func(e *route.Endpoint) {
+		removed = append(removed, e.CanonicalAddr())
+	})
+
+	s.Register("foo", fooEndpoint)
+	s.Register("fooo", fooEndpoint)
+	s.Register("bar", barEndpoint)
+
+	s.Unregister("foo", fooEndpoint)
+	c.Check(removed, DeepEquals, []string{})
+
+	s.Unregister("fooo", fooEndpoint)
+	c.Check(removed, DeepEquals, []string{"192.168.1.1:1234"})
+
+	time.Sleep(s.dropletStaleThreshold + 1*time.Millisecond)
+	s.PruneStaleDroplets()
+
+	c.Check(removed, DeepEquals, []string{"192.168.1.1:1234", "192.168.1.2:4321"})
+}
+
+func (s *RegistrySuite) TestOnRouteRemoved(c *C) {
+	removed := []route.Uri{}
+	s.OnRouteRemoved(func(uri route.Uri) {
+		removed = append(removed, uri)
+	})
+
+	s.Register("foo", fooEndpoint)
+	s.Register("foo", barEndpoint)
+	s.Register("bar", barEndpoint)
+
+	s.Unregister("foo", fooEndpoint)
+	c.Check(removed, DeepEquals, []route.Uri{})
+
+	s.Unregister("FOO", barEndpoint)
+	c.Check(removed, DeepEquals, []route.Uri{"foo"})
+
+	time.Sleep(s.dropletStaleThreshold + 1*time.Millisecond)
+	s.PruneStaleDroplets()
+
+	c.Check(removed, DeepEquals, []route.Uri{"foo", "bar"})
+}
+
+func (s *RegistrySuite) TestSampleExcluding(c *C) {
+	s.Register("bar", barEndpoint)
+	s.Register("bar", bar2Endpoint)
+
+	_, pool, ok := s.PoolFor("BAR")
+	c.Assert(ok, Equals, true)
+
+	b, ok := s.SampleExcluding(pool, []*route.Endpoint{barEndpoint})
+	c.Assert(ok, Equals, true)
+	c.Check(b, Equals, bar2Endpoint)
+
+	_, ok = s.SampleExcluding(pool, []*route.Endpoint{barEndpoint, bar2Endpoint})
+	c.Check(ok, Equals, false)
+}
+
+func (s *RegistrySuite) TestSampleByPrivateInstanceId(c *C) {
+	barEndpoint.PrivateInstanceId = "bar-instance"
+
+	s.Register("bar", barEndpoint)
+	s.Register("bar", bar2Endpoint)
+
+	_, pool, ok := s.PoolFor("bar")
+	c.Assert(ok, Equals, true)
+
+	b, ok := s.SampleByPrivateInstanceId(pool, "bar-instance")
+	c.Assert(ok, Equals, true)
+	c.Check(b, Equals, barEndpoint)
+
+	_, ok = s.SampleByPrivateInstanceId(pool, "unknown")
+	c.Check(ok, Equals, false)
+}
+
+func (s *RegistrySuite) TestCaptureEndpointFailure(c *C) {
+	s.endpointFailureThreshold = 2
+	s.endpointFailureBackoff = 10 * time.Millisecond
+
+	fooEndpoint.PrivateInstanceId = "foo-instance"
+
+	s.Register("foo", fooEndpoint)
+	s.Register("foo", barEndpoint)
+
+	s.CaptureEndpointFailure(fooEndpoint)
+	s.CaptureEndpointSuccess(fooEndpoint)
+	s.CaptureEndpointFailure(fooEndpoint)
+	c.Check(fooEndpoint.State(), Equals, route.EndpointHealthy)
+
+	s.CaptureEndpointFailure(fooEndpoint)
+	c.Check(fooEndpoint.State(), Equals, route.EndpointFailed)
+
+	for i := 0; i < 10; i++ {
+		b, ok := s.Lookup("foo")
+		c.Assert(ok, Equals, true)
+		c.Check(b, Equals, barEndpoint)
+	}
+
+	_, ok := s.LookupByPrivateInstanceId("foo", "foo-instance")
+	c.Check(ok, Equals, false)
+
+	time.Sleep(s.endpointFailureBackoff + 1*time.Millisecond)
+
+	b, ok := s.LookupByPrivateInstanceId("foo", "foo-instance")
+	c.Check(ok, Equals, true)
+	c.Check(b, Equals, fooEndpoint)
+}
+
+func (s *RegistrySuite) TestCaptureEndpointFailureDisabled(c *C) {
+	s.endpointFailureThreshold = 0
+
+	s.Register("foo", fooEndpoint)
+
+	for i := 0; i < 10; i++ {
+		s.CaptureEndpointFailure(fooEndpoint)
+	}
+
+	c.Check(fooEndpoint.State(), Equals, route.EndpointHealthy)
 }
@@ -0,0 +1,112 @@
+package router
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/cloudfoundry/gorouter/config"
+)
+
+type ReloadSuite struct {
+	Config *config.Config
+	router *Router
+}
+
+var _ = Suite(&ReloadSuite{})
+
+func (s *ReloadSuite) SetUpTest(c *C) {
+	s.Config = SpecConfig(nextAvailPort(), nextAvailPort(), nextAvailPort())
+	s.Config.AccessLog = filepath.Join(c.MkDir(), "access.log")
+
+	s.router = NewRouter(s.Config)
+
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", s.router.component.Host)
+		if err == nil {
+			conn.Close()
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Fatal("status server did not come up")
+}
+
+func (s *ReloadSuite) reloaded() *config.Config {
+	c := *s.Config
+	return &c
+}
+
+func (s *ReloadSuite) TestReloadsTraceKey(c *C) {
+	x := s.reloaded()
+	x.TraceKey = "new_trace_key"
+
+	s.router.Reload(x)
+
+	c.Check(s.router.reloadedConfig.TraceKey, Equals, "new_trace_key")
+}
+
+func (s *ReloadSuite) TestReloadsEndpointTimeout(c *C) {
+	x := s.reloaded()
+	x.EndpointTimeoutInSeconds = 7
+	x.Process()
+
+	s.router.Reload(x)
+
+	c.Check(s.router.reloadedConfig.EndpointTimeout, Equals, 7*time.Second)
+}
+
+func (s *ReloadSuite) TestReloadsStatusCredentials(c *C) {
+	x := s.reloaded()
+	x.Status.User = "new-user"
+	x.Status.Pass = "new-pass"
+
+	s.router.Reload(x)
+
+	req, _ := http.NewRequest("GET", "http://"+s.router.component.Host+"/healthz", nil)
+	req.SetBasicAuth("new-user", "new-pass")
+
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *ReloadSuite) TestReloadsAccessLogFormat(c *C) {
+	x := s.reloaded()
+	x.AccessLogFormat = "json"
+
+	s.router.Reload(x)
+	c.Check(s.router.reloadedConfig.AccessLogFormat, Equals, "json")
+
+	x = s.reloaded()
+	x.AccessLogFormat = "{{.Unknown}}"
+
+	s.router.Reload(x)
+	c.Check(s.router.reloadedConfig.AccessLogFormat, Equals, "json")
+}
+
+func (s *ReloadSuite) TestKeepsFailedChange(c *C) {
+	x := s.reloaded()
+	x.Logging.Level = "unknown"
+
+	s.router.Reload(x)
+
+	c.Check(s.router.reloadedConfig.Logging.Level, Equals, s.Config.Logging.Level)
+}
+
+func (s *ReloadSuite) TestIgnoresChangesRequiringRestart(c *C) {
+	x := s.reloaded()
+	x.Port = x.Port + 1
+	x.TraceKey = "new_trace_key"
+
+	s.router.Reload(x)
+
+	c.Check(s.router.reloadedConfig.Port, Equals, s.Config.Port)
+	c.Check(s.router.reloadedConfig.TraceKey, Equals, "new_trace_key")
+}
@@ -4,9 +4,31 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Protocols endpoints can be proxied to with; HTTP/1.1 unless they ask for
+// HTTP/2, which is spoken over TLS when the endpoint has a TLS port and in
+// cleartext otherwise.
+const (
+	ProtocolHTTP1 = "http1"
+	ProtocolH2    = "h2"
+	ProtocolH2C   = "h2c"
+)
+
+const (
+	EndpointHealthy   = "healthy"
+	EndpointFailed    = "failed"
+	EndpointHalfOpen  = "half_open"
+	EndpointUnhealthy = "unhealthy"
 )
 
 type Endpoint struct {
+	// Number of requests currently being proxied to this endpoint. Kept as
+	// the first field so it is 64-bit aligned for sync/atomic.
+	inFlight int64
+
 	sync.Mutex
 
 	ApplicationId     string
@@ -14,6 +36,39 @@ type Endpoint struct {
 	Port              uint16
 	Tags              map[string]string
 	PrivateInstanceId string
+
+	// Load balancing strategy requested for the routes this endpoint
+	// registers, overriding the router default when set.
+	LoadBalancing string
+
+	// Path to GET when actively health checking the endpoint. Without it
+	// the health check only opens a TCP connection.
+	HealthCheckPath string
+
+	// Port on which the endpoint accepts TLS. When set, requests are proxied
+	// over TLS to this port instead of Port, verifying the endpoint's
+	// certificate against ServerName (or Host when empty).
+	TLSPort    uint16
+	ServerName string
+
+	// Protocol spoken to the endpoint, one of the Protocol* constants.
+	Protocol string
+
+	// Relative share of the route's requests the endpoint receives; values
+	// below 1 count as 1. Guarded by the registry lock.
+	Weight int
+
+	// Passive health tracking, guarded by the mutex
+	consecutiveFailures int
+	failed              bool
+	failedUntil         time.Time
+	backoff             time.Duration
+
+	// Set while a request probes a half-open endpoint, guarded by the mutex
+	probing bool
+
+	// Result of the last active health check, guarded by the mutex
+	unhealthy bool
 }
 
 func (e *Endpoint) MarshalJSON() ([]byte, error) {
@@ -24,6 +79,155 @@ func (e *Endpoint) CanonicalAddr() string {
 	return fmt.Sprintf("%s:%d", e.Host, e.Port)
 }
 
+func (e *Endpoint) weight() int {
+	if e.Weight < 1 {
+		return 1
+	}
+
+	return e.Weight
+}
+
+func (e *Endpoint) UsesTLS() bool {
+	return e.TLSPort != 0
+}
+
+func (e *Endpoint) UsesHTTP2() bool {
+	return e.Protocol == ProtocolH2 || e.Protocol == ProtocolH2C
+}
+
+// BackendAddr is the address requests are proxied to.
+func (e *Endpoint) BackendAddr() string {
+	if e.UsesTLS() {
+		return fmt.Sprintf("%s:%d", e.Host, e.TLSPort)
+	}
+
+	return e.CanonicalAddr()
+}
+
+func (e *Endpoint) InFlight() int64 {
+	return atomic.LoadInt64(&e.inFlight)
+}
+
+func (e *Endpoint) IncrementInFlight() {
+	atomic.AddInt64(&e.inFlight, 1)
+}
+
+func (e *Endpoint) DecrementInFlight() {
+	atomic.AddInt64(&e.inFlight, -1)
+}
+
+// MarkFailed records a failed attempt to reach the endpoint. Once threshold
+// consecutive attempts have failed the endpoint is taken out of rotation for
+// the backoff duration, after which it is half-open: the next request claiming
+// it decides whether it is healthy again or failed for another backoff. It
+// returns true if the endpoint just transitioned to failed.
+func (e *Endpoint) MarkFailed(threshold int, backoff time.Duration) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	now := time.Now()
+
+	if e.failed {
+		if e.probing || !now.Before(e.failedUntil) {
+			// Probe in half-open state failed
+			e.probing = false
+			e.failedUntil = now.Add(backoff)
+		}
+
+		return false
+	}
+
+	e.consecutiveFailures++
+	if e.consecutiveFailures < threshold {
+		return false
+	}
+
+	e.failed = true
+	e.failedUntil = now.Add(backoff)
+	e.backoff = backoff
+
+	return true
+}
+
+// MarkSucceeded records a successful attempt to reach the endpoint and puts it
+// back into rotation.
+func (e *Endpoint) MarkSucceeded() {
+	e.Lock()
+	defer e.Unlock()
+
+	e.consecutiveFailures = 0
+	e.failed = false
+	e.probing = false
+}
+
+// Claim tells whether a request picked the endpoint may be sent to it. Only
+// one request at a time probes a half-open endpoint; others are turned away
+// until the probe succeeds or fails, or for another backoff if it never says.
+func (e *Endpoint) Claim() bool {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.unhealthy {
+		return false
+	}
+
+	if !e.failed {
+		return true
+	}
+
+	now := time.Now()
+	if now.Before(e.failedUntil) {
+		return false
+	}
+
+	e.probing = true
+	e.failedUntil = now.Add(e.backoff)
+
+	return true
+}
+
+// MarkHealthCheck records the result of an active health check. Endpoints
+// failing their health check are out of rotation until they pass again.
+func (e *Endpoint) MarkHealthCheck(healthy bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.unhealthy = !healthy
+}
+
+func (e *Endpoint) State() string {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.unhealthy {
+		return EndpointUnhealthy
+	}
+
+	if !e.failed {
+		return EndpointHealthy
+	}
+
+	// Being probed
+	if e.probing {
+		return EndpointHalfOpen
+	}
+
+	if time.Now().Before(e.failedUntil) {
+		return EndpointFailed
+	}
+
+	return EndpointHalfOpen
+}
+
+// IsAvailable tells whether the endpoint can be claimed; a half-open
+// endpoint is unavailable while it is being probed.
+func (e *Endpoint) IsAvailable() bool {
+	e.Lock()
+	defer e.Unlock()
+
+	return !e.unhealthy && (!e.failed || !time.Now().Before(e.failedUntil))
+}
+
 func (e *Endpoint) ToLogData() interface{} {
 	return struct {
 		ApplicationId string
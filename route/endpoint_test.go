@@ -0,0 +1,92 @@
+package route
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type EndpointSuite struct{}
+
+func init() {
+	Suite(&EndpointSuite{})
+}
+
+func (s *EndpointSuite) TestEndpointIsHealthyInitially(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 5678}
+
+	c.Check(e.State(), Equals, EndpointHealthy)
+	c.Check(e.IsAvailable(), Equals, true)
+}
+
+func (s *EndpointSuite) TestEndpointFailsAfterThreshold(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 5678}
+
+	c.Check(e.MarkFailed(3, time.Minute), Equals, false)
+	c.Check(e.MarkFailed(3, time.Minute), Equals, false)
+	c.Check(e.State(), Equals, EndpointHealthy)
+
+	c.Check(e.MarkFailed(3, time.Minute), Equals, true)
+	c.Check(e.State(), Equals, EndpointFailed)
+	c.Check(e.IsAvailable(), Equals, false)
+
+	// Already failed
+	c.Check(e.MarkFailed(3, time.Minute), Equals, false)
+}
+
+func (s *EndpointSuite) TestEndpointSuccessResetsFailures(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 5678}
+
+	e.MarkFailed(2, time.Minute)
+	e.MarkSucceeded()
+	e.MarkFailed(2, time.Minute)
+
+	c.Check(e.State(), Equals, EndpointHealthy)
+}
+
+func (s *EndpointSuite) TestEndpointIsHalfOpenAfterBackoff(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 5678}
+
+	e.MarkFailed(1, 10*time.Millisecond)
+	c.Check(e.State(), Equals, EndpointFailed)
+
+	time.Sleep(11 * time.Millisecond)
+	c.Check(e.State(), Equals, EndpointHalfOpen)
+	c.Check(e.IsAvailable(), Equals, true)
+
+	// A failed probe takes the endpoint out for another backoff
+	c.Check(e.Claim(), Equals, true)
+	e.MarkFailed(1, 10*time.Millisecond)
+	c.Check(e.State(), Equals, EndpointFailed)
+
+	time.Sleep(11 * time.Millisecond)
+	c.Check(e.State(), Equals, EndpointHalfOpen)
+
+	// A successful probe reinstates it
+	c.Check(e.Claim(), Equals, true)
+	e.MarkSucceeded()
+	c.Check(e.State(), Equals, EndpointHealthy)
+}
+
+func (s *EndpointSuite) TestOnlyOneRequestProbesHalfOpenEndpoint(c *C) {
+	e := &Endpoint{Host: "1.2.3.4", Port: 5678}
+
+	e.MarkFailed(1, 10*time.Millisecond)
+	c.Check(e.Claim(), Equals, false)
+
+	time.Sleep(11 * time.Millisecond)
+	c.Check(e.Claim(), Equals, true)
+
+	c.Check(e.State(), Equals, EndpointHalfOpen)
+	c.Check(e.IsAvailable(), Equals, false)
+	c.Check(e.Claim(), Equals, false)
+
+	// Probes that never say how they went don't keep it out for good
+	time.Sleep(11 * time.Millisecond)
+	c.Check(e.Claim(), Equals, true)
+	c.Check(e.Claim(), Equals, false)
+
+	e.MarkSucceeded()
+	c.Check(e.Claim(), Equals, true)
+	c.Check(e.Claim(), Equals, true)
+}
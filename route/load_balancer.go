@@ -0,0 +1,146 @@
+package route
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+const (
+	LoadBalancingRandom            = "random"
+	LoadBalancingRoundRobin        = "round_robin"
+	LoadBalancingLeastConnections  = "least_connections"
+	LoadBalancingPowerOfTwoChoices = "power_of_two_choices"
+)
+
+type LoadBalancer interface {
+	// Next picks an endpoint from a non-empty slice of endpoints, in
+	// proportion to their weights.
+	Next(endpoints []*Endpoint) *Endpoint
+}
+
+func NewLoadBalancer(name string) (LoadBalancer, error) {
+	switch name {
+	case "", LoadBalancingRandom:
+		return &RandomLoadBalancer{}, nil
+	case LoadBalancingRoundRobin:
+		return &RoundRobinLoadBalancer{}, nil
+	case LoadBalancingLeastConnections:
+		return &LeastConnectionsLoadBalancer{}, nil
+	case LoadBalancingPowerOfTwoChoices:
+		return &PowerOfTwoChoicesLoadBalancer{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown load balancing strategy: %s", name)
+}
+
+type RandomLoadBalancer struct{}
+
+func (lb *RandomLoadBalancer) Next(endpoints []*Endpoint) *Endpoint {
+	total, uniform := totalWeight(endpoints)
+	if uniform {
+		return endpoints[rand.Intn(len(endpoints))]
+	}
+
+	return weightedEndpoint(endpoints, rand.Intn(total))
+}
+
+type RoundRobinLoadBalancer struct {
+	next uint32
+}
+
+// Next cycles through the endpoints, picking each one as many times in a row
+// as its weight.
+func (lb *RoundRobinLoadBalancer) Next(endpoints []*Endpoint) *Endpoint {
+	n := atomic.AddUint32(&lb.next, 1) - 1
+
+	total, uniform := totalWeight(endpoints)
+	if uniform {
+		return endpoints[n%uint32(len(endpoints))]
+	}
+
+	return weightedEndpoint(endpoints, int(n%uint32(total)))
+}
+
+type LeastConnectionsLoadBalancer struct{}
+
+func (lb *LeastConnectionsLoadBalancer) Next(endpoints []*Endpoint) *Endpoint {
+	// Start at a random offset so ties don't always go to the same endpoint
+	offset := rand.Intn(len(endpoints))
+
+	var best *Endpoint
+	for i := range endpoints {
+		e := endpoints[(offset+i)%len(endpoints)]
+		if best == nil || lessLoaded(e, best) {
+			best = e
+		}
+	}
+
+	return best
+}
+
+type PowerOfTwoChoicesLoadBalancer struct{}
+
+func (lb *PowerOfTwoChoicesLoadBalancer) Next(endpoints []*Endpoint) *Endpoint {
+	n := len(endpoints)
+	if n == 1 {
+		return endpoints[0]
+	}
+
+	var a, b *Endpoint
+
+	total, uniform := totalWeight(endpoints)
+	if uniform {
+		i := rand.Intn(n)
+		j := rand.Intn(n - 1)
+		if j >= i {
+			j++
+		}
+
+		a, b = endpoints[i], endpoints[j]
+	} else {
+		a = weightedEndpoint(endpoints, rand.Intn(total))
+		b = weightedEndpoint(endpoints, rand.Intn(total))
+	}
+
+	if lessLoaded(b, a) {
+		return b
+	}
+
+	return a
+}
+
+// lessLoaded compares the requests in flight to two endpoints relative to
+// their weights. Counting the request about to be sent keeps idle endpoints
+// from comparing equal regardless of their weights.
+func lessLoaded(a, b *Endpoint) bool {
+	return (a.InFlight()+1)*int64(b.weight()) < (b.InFlight()+1)*int64(a.weight())
+}
+
+func totalWeight(endpoints []*Endpoint) (total int, uniform bool) {
+	uniform = true
+
+	for _, e := range endpoints {
+		w := e.weight()
+		if w != endpoints[0].weight() {
+			uniform = false
+		}
+
+		total += w
+	}
+
+	return total, uniform
+}
+
+// weightedEndpoint returns the endpoint n falls on when each endpoint takes
+// up as many slots as its weight; n must be less than the total weight.
+func weightedEndpoint(endpoints []*Endpoint, n int) *Endpoint {
+	for _, e := range endpoints {
+		n -= e.weight()
+		if n < 0 {
+			return e
+		}
+	}
+
+	return endpoints[len(endpoints)-1]
+}
@@ -0,0 +1,138 @@
+package route
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type LoadBalancerSuite struct{}
+
+func init() {
+	Suite(&LoadBalancerSuite{})
+}
+
+func (s *LoadBalancerSuite) TestNewLoadBalancer(c *C) {
+	for _, name := range []string{"", "random", "round_robin", "least_connections", "power_of_two_choices"} {
+		lb, err := NewLoadBalancer(name)
+		c.Check(err, IsNil)
+		c.Check(lb, NotNil)
+	}
+
+	_, err := NewLoadBalancer("unknown")
+	c.Check(err, ErrorMatches, "unknown load balancing strategy: unknown")
+}
+
+func (s *LoadBalancerSuite) TestRoundRobin(c *C) {
+	endpoints := []*Endpoint{
+		&Endpoint{Host: "1.2.3.4", Port: 1234},
+		&Endpoint{Host: "5.6.7.8", Port: 5678},
+		&Endpoint{Host: "9.0.1.2", Port: 9012},
+	}
+
+	lb := &RoundRobinLoadBalancer{}
+
+	for i := 0; i < 6; i++ {
+		c.Check(lb.Next(endpoints), Equals, endpoints[i%3])
+	}
+}
+
+func (s *LoadBalancerSuite) TestLeastConnections(c *C) {
+	busy := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	idle := &Endpoint{Host: "5.6.7.8", Port: 5678}
+
+	busy.IncrementInFlight()
+	busy.IncrementInFlight()
+	idle.IncrementInFlight()
+
+	lb := &LeastConnectionsLoadBalancer{}
+
+	for i := 0; i < 10; i++ {
+		c.Check(lb.Next([]*Endpoint{busy, idle}), Equals, idle)
+	}
+
+	idle.IncrementInFlight()
+	idle.IncrementInFlight()
+
+	c.Check(lb.Next([]*Endpoint{busy, idle}), Equals, busy)
+}
+
+func (s *LoadBalancerSuite) TestPowerOfTwoChoices(c *C) {
+	busy := &Endpoint{Host: "1.2.3.4", Port: 1234}
+	idle := &Endpoint{Host: "5.6.7.8", Port: 5678}
+
+	busy.IncrementInFlight()
+
+	lb := &PowerOfTwoChoicesLoadBalancer{}
+
+	// With only two endpoints both are always compared
+	for i := 0; i < 10; i++ {
+		c.Check(lb.Next([]*Endpoint{busy, idle}), Equals, idle)
+	}
+
+	c.Check(lb.Next([]*Endpoint{busy}), Equals, busy)
+}
+
+func (s *LoadBalancerSuite) TestWeightedRoundRobin(c *C) {
+	endpoints := []*Endpoint{
+		&Endpoint{Host: "1.2.3.4", Port: 1234, Weight: 3},
+		&Endpoint{Host: "5.6.7.8", Port: 5678, Weight: 1},
+	}
+
+	lb := &RoundRobinLoadBalancer{}
+
+	counts := map[*Endpoint]int{}
+	for i := 0; i < 40; i++ {
+		counts[lb.Next(endpoints)]++
+	}
+
+	c.Check(counts[endpoints[0]], Equals, 30)
+	c.Check(counts[endpoints[1]], Equals, 10)
+}
+
+func (s *LoadBalancerSuite) TestWeightedRandom(c *C) {
+	endpoints := []*Endpoint{
+		&Endpoint{Host: "1.2.3.4", Port: 1234, Weight: 95},
+		&Endpoint{Host: "5.6.7.8", Port: 5678, Weight: 5},
+	}
+
+	lb := &RandomLoadBalancer{}
+
+	counts := map[*Endpoint]int{}
+	for i := 0; i < 10000; i++ {
+		counts[lb.Next(endpoints)]++
+	}
+
+	c.Check(counts[endpoints[1]] > 300, Equals, true)
+	c.Check(counts[endpoints[1]] < 700, Equals, true)
+}
+
+func (s *LoadBalancerSuite) TestWeightedLeastConnections(c *C) {
+	heavy := &Endpoint{Host: "1.2.3.4", Port: 1234, Weight: 4}
+	light := &Endpoint{Host: "5.6.7.8", Port: 5678, Weight: 1}
+
+	lb := &LeastConnectionsLoadBalancer{}
+
+	// Idle endpoints are compared by weight
+	c.Check(lb.Next([]*Endpoint{heavy, light}), Equals, heavy)
+
+	heavy.IncrementInFlight()
+	heavy.IncrementInFlight()
+
+	c.Check(lb.Next([]*Endpoint{heavy, light}), Equals, heavy)
+
+	heavy.IncrementInFlight()
+	heavy.IncrementInFlight()
+
+	c.Check(lb.Next([]*Endpoint{heavy, light}), Equals, light)
+}
+
+func (s *LoadBalancerSuite) TestWeightsBelowOneCountAsOne(c *C) {
+	endpoints := []*Endpoint{
+		&Endpoint{Host: "1.2.3.4", Port: 1234, Weight: 0},
+		&Endpoint{Host: "5.6.7.8", Port: 5678, Weight: -2},
+		&Endpoint{Host: "9.0.1.2", Port: 9012, Weight: 1},
+	}
+
+	total, uniform := totalWeight(endpoints)
+	c.Check(total, Equals, 3)
+	c.Check(uniform, Equals, true)
+}
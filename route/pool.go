@@ -2,25 +2,88 @@ package route
 
 import (
 	"encoding/json"
-	"math/rand"
+	"sync/atomic"
 )
 
 type Pool struct {
-	endpoints map[string]*Endpoint
+	// Requests being proxied to the route and waiting to be, as last set
+	// by the proxy. Kept first so they are 64-bit aligned for sync/atomic.
+	inFlight int64
+	queued   int64
+
+	endpoints []*Endpoint
+	index     map[string]int
+
+	loadBalancing string
+	loadBalancer  LoadBalancer
 }
 
 func NewPool() *Pool {
 	return &Pool{
-		endpoints: make(map[string]*Endpoint),
+		index: make(map[string]int),
+
+		loadBalancing: LoadBalancingRandom,
+		loadBalancer:  &RandomLoadBalancer{},
+	}
+}
+
+func (p *Pool) LoadBalancing() string {
+	return p.loadBalancing
+}
+
+// SetLoadBalancing switches the pool to the named strategy. The current
+// balancer (and any state it carries) is kept if the strategy is unchanged.
+func (p *Pool) SetLoadBalancing(name string) error {
+	if name == "" {
+		name = LoadBalancingRandom
 	}
+
+	if name == p.loadBalancing {
+		return nil
+	}
+
+	lb, err := NewLoadBalancer(name)
+	if err != nil {
+		return err
+	}
+
+	p.loadBalancing = name
+	p.loadBalancer = lb
+
+	return nil
 }
 
 func (p *Pool) Add(endpoint *Endpoint) {
-	p.endpoints[endpoint.CanonicalAddr()] = endpoint
+	addr := endpoint.CanonicalAddr()
+
+	if i, found := p.index[addr]; found {
+		p.endpoints[i] = endpoint
+		return
+	}
+
+	p.index[addr] = len(p.endpoints)
+	p.endpoints = append(p.endpoints, endpoint)
 }
 
 func (p *Pool) Remove(endpoint *Endpoint) {
-	delete(p.endpoints, endpoint.CanonicalAddr())
+	addr := endpoint.CanonicalAddr()
+
+	i, found := p.index[addr]
+	if !found {
+		return
+	}
+
+	// Move the last endpoint into the vacated slot
+	last := len(p.endpoints) - 1
+	if i != last {
+		p.endpoints[i] = p.endpoints[last]
+		p.index[p.endpoints[i].CanonicalAddr()] = i
+	}
+
+	p.endpoints[last] = nil
+	p.endpoints = p.endpoints[:last]
+
+	delete(p.index, addr)
 }
 
 func (p *Pool) Sample() (*Endpoint, bool) {
@@ -28,18 +91,48 @@ func (p *Pool) Sample() (*Endpoint, bool) {
 		return nil, false
 	}
 
-	index := rand.Intn(len(p.endpoints))
+	endpoint := p.loadBalancer.Next(p.endpoints)
+	if endpoint.Claim() {
+		return endpoint, true
+	}
+
+	return p.SampleExcluding(nil)
+}
+
+// SampleExcluding picks an endpoint like Sample, skipping the given endpoints.
+// Failed endpoints, and half-open ones already being probed, are skipped as
+// well, unless no other endpoint is left.
+func (p *Pool) SampleExcluding(excluded []*Endpoint) (*Endpoint, bool) {
+	candidates := make([]*Endpoint, 0, len(p.endpoints))
+	available := make([]*Endpoint, 0, len(p.endpoints))
 
-	ticker := 0
 	for _, endpoint := range p.endpoints {
-		if ticker == index {
+		if containsEndpoint(excluded, endpoint) {
+			continue
+		}
+
+		candidates = append(candidates, endpoint)
+
+		if endpoint.IsAvailable() {
+			available = append(available, endpoint)
+		}
+	}
+
+	for len(available) > 0 {
+		endpoint := p.loadBalancer.Next(available)
+		if endpoint.Claim() {
 			return endpoint, true
 		}
 
-		ticker += 1
+		// Another request got to probe it first
+		available = removeEndpoint(available, endpoint)
+	}
+
+	if len(candidates) > 0 {
+		return p.loadBalancer.Next(candidates), true
 	}
 
-	panic("unreachable")
+	return nil, false
 }
 
 func (p *Pool) FindByPrivateInstanceId(id string) (*Endpoint, bool) {
@@ -56,12 +149,76 @@ func (p *Pool) IsEmpty() bool {
 	return len(p.endpoints) == 0
 }
 
+// SetConcurrency records the number of requests being proxied to the route,
+// and waiting to be.
+func (p *Pool) SetConcurrency(inFlight, queued int) {
+	atomic.StoreInt64(&p.inFlight, int64(inFlight))
+	atomic.StoreInt64(&p.queued, int64(queued))
+}
+
+func (p *Pool) InFlight() int64 {
+	return atomic.LoadInt64(&p.inFlight)
+}
+
+func (p *Pool) Queued() int64 {
+	return atomic.LoadInt64(&p.queued)
+}
+
+type endpointInfo struct {
+	Address string `json:"address"`
+	State   string `json:"state"`
+	Weight  int    `json:"weight"`
+
+	// Requests being proxied to the endpoint
+	InFlight int64 `json:"in_flight"`
+}
+
+type poolInfo struct {
+	Endpoints []endpointInfo `json:"endpoints"`
+
+	// Requests being proxied to the route, and waiting to be
+	InFlight int64 `json:"in_flight"`
+	Queued   int64 `json:"queued"`
+}
+
 func (p *Pool) MarshalJSON() ([]byte, error) {
-	addresses := []string{}
+	endpoints := []endpointInfo{}
+
+	for _, endpoint := range p.endpoints {
+		endpoints = append(endpoints, endpointInfo{
+			Address: endpoint.CanonicalAddr(),
+			State:   endpoint.State(),
+			Weight:  endpoint.weight(),
+
+			InFlight: endpoint.InFlight(),
+		})
+	}
+
+	return json.Marshal(poolInfo{
+		Endpoints: endpoints,
+		InFlight:  p.InFlight(),
+		Queued:    p.Queued(),
+	})
+}
 
-	for addr, _ := range p.endpoints {
-		addresses = append(addresses, addr)
+func removeEndpoint(endpoints []*Endpoint, endpoint *Endpoint) []*Endpoint {
+	for i, e := range endpoints {
+		if e == endpoint {
+			return append(endpoints[:i], endpoints[i+1:]...)
+		}
+	}
+
+	return endpoints
+}
+
+func containsEndpoint(endpoints []*Endpoint, endpoint *Endpoint) bool {
+	addr := endpoint.CanonicalAddr()
+
+	for _, e := range endpoints {
+		if e.CanonicalAddr() == addr {
+			return true
+		}
 	}
 
-	return json.Marshal(addresses)
+	return false
 }
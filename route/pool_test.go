@@ -3,6 +3,7 @@ package route
 import (
 	. "launchpad.net/gocheck"
 	"math"
+	"time"
 )
 
 type PSuite struct{}
@@ -138,5 +139,161 @@ func (s *PSuite) TestPoolMarshalsAsJSON(c *C) {
 	json, err := pool.MarshalJSON()
 	c.Assert(err, IsNil)
 
-	c.Assert(string(json), Equals, `["1.2.3.4:5678"]`)
+	c.Assert(string(json), Equals, `{"endpoints":[{"address":"1.2.3.4:5678","state":"healthy","weight":1,"in_flight":0}],"in_flight":0,"queued":0}`)
+}
+
+func (s *PSuite) TestMarshalsRequestsInFlight(c *C) {
+	pool := NewPool()
+
+	e := &Endpoint{Host: "1.2.3.4", Port: 5678}
+	e.IncrementInFlight()
+	e.IncrementInFlight()
+	pool.Add(e)
+
+	pool.SetConcurrency(3, 1)
+
+	json, err := pool.MarshalJSON()
+	c.Assert(err, IsNil)
+	c.Check(string(json), Equals, `{"endpoints":[{"address":"1.2.3.4:5678","state":"healthy","weight":1,"in_flight":2}],"in_flight":3,"queued":1}`)
+}
+
+func (s *PSuite) TestPoolRemovingKeepsRemainingEndpoints(c *C) {
+	pool := NewPool()
+
+	endpoint1 := &Endpoint{Host: "1.2.3.4", Port: 5678}
+	endpoint2 := &Endpoint{Host: "5.6.7.8", Port: 1234}
+	endpoint3 := &Endpoint{Host: "9.0.1.2", Port: 3456}
+
+	pool.Add(endpoint1)
+	pool.Add(endpoint2)
+	pool.Add(endpoint3)
+
+	pool.Remove(endpoint1)
+
+	json, err := pool.MarshalJSON()
+	c.Assert(err, IsNil)
+	c.Check(string(json), Equals, `{"endpoints":[{"address":"9.0.1.2:3456","state":"healthy","weight":1,"in_flight":0},{"address":"5.6.7.8:1234","state":"healthy","weight":1,"in_flight":0}],"in_flight":0,"queued":0}`)
+
+	pool.Remove(endpoint3)
+	pool.Remove(endpoint2)
+
+	c.Check(pool.IsEmpty(), Equals, true)
+}
+
+func (s *PSuite) TestPoolSetLoadBalancing(c *C) {
+	pool := NewPool()
+	c.Check(pool.LoadBalancing(), Equals, "random")
+
+	err := pool.SetLoadBalancing("round_robin")
+	c.Assert(err, IsNil)
+	c.Check(pool.LoadBalancing(), Equals, "round_robin")
+
+	endpoint1 := &Endpoint{Host: "1.2.3.4", Port: 5678}
+	endpoint2 := &Endpoint{Host: "5.6.7.8", Port: 1234}
+
+	pool.Add(endpoint1)
+	pool.Add(endpoint2)
+
+	first, _ := pool.Sample()
+	second, _ := pool.Sample()
+	c.Check(first, Not(Equals), second)
+
+	err = pool.SetLoadBalancing("bogus")
+	c.Check(err, NotNil)
+	c.Check(pool.LoadBalancing(), Equals, "round_robin")
+}
+
+func (s *PSuite) TestPoolSampleExcluding(c *C) {
+	pool := NewPool()
+
+	endpoint1 := &Endpoint{Host: "1.2.3.4", Port: 5678}
+	endpoint2 := &Endpoint{Host: "5.6.7.8", Port: 1234}
+
+	pool.Add(endpoint1)
+	pool.Add(endpoint2)
+
+	for i := 0; i < 10; i++ {
+		foundEndpoint, found := pool.SampleExcluding([]*Endpoint{endpoint1})
+		c.Assert(found, Equals, true)
+		c.Check(foundEndpoint, Equals, endpoint2)
+	}
+
+	_, found := pool.SampleExcluding([]*Endpoint{endpoint1, endpoint2})
+	c.Check(found, Equals, false)
+}
+
+func (s *PSuite) TestPoolSamplingSkipsFailedEndpoints(c *C) {
+	pool := NewPool()
+
+	endpoint1 := &Endpoint{Host: "1.2.3.4", Port: 5678}
+	endpoint2 := &Endpoint{Host: "5.6.7.8", Port: 1234}
+
+	pool.Add(endpoint1)
+	pool.Add(endpoint2)
+
+	endpoint1.MarkFailed(1, time.Minute)
+
+	for i := 0; i < 10; i++ {
+		foundEndpoint, found := pool.Sample()
+		c.Assert(found, Equals, true)
+		c.Check(foundEndpoint, Equals, endpoint2)
+	}
+
+	// Failed endpoints are still used when nothing else is left
+	endpoint2.MarkFailed(1, time.Minute)
+
+	_, found := pool.Sample()
+	c.Check(found, Equals, true)
+
+	foundEndpoint, found := pool.SampleExcluding([]*Endpoint{endpoint2})
+	c.Assert(found, Equals, true)
+	c.Check(foundEndpoint, Equals, endpoint1)
+}
+
+func (s *PSuite) TestPoolSamplingProbesHalfOpenEndpointsOnce(c *C) {
+	pool := NewPool()
+
+	endpoint1 := &Endpoint{Host: "1.2.3.4", Port: 5678}
+	endpoint2 := &Endpoint{Host: "5.6.7.8", Port: 1234}
+
+	pool.Add(endpoint1)
+	pool.Add(endpoint2)
+
+	endpoint1.MarkFailed(1, 10*time.Millisecond)
+	time.Sleep(11 * time.Millisecond)
+
+	probes := 0
+	for i := 0; i < 50; i++ {
+		foundEndpoint, found := pool.Sample()
+		c.Assert(found, Equals, true)
+
+		if foundEndpoint == endpoint1 {
+			probes++
+		}
+	}
+
+	c.Check(probes, Equals, 1)
+}
+
+func (s *PSuite) TestPoolMarshalsEndpointWeight(c *C) {
+	pool := NewPool()
+	pool.Add(&Endpoint{Host: "1.2.3.4", Port: 5678, Weight: 95})
+
+	json, err := pool.MarshalJSON()
+	c.Assert(err, IsNil)
+	c.Check(string(json), Equals, `{"endpoints":[{"address":"1.2.3.4:5678","state":"healthy","weight":95,"in_flight":0}],"in_flight":0,"queued":0}`)
+}
+
+func (s *PSuite) TestPoolMarshalsEndpointState(c *C) {
+	pool := NewPool()
+
+	endpoint := &Endpoint{Host: "1.2.3.4", Port: 5678}
+	endpoint.MarkFailed(1, time.Minute)
+
+	pool.Add(endpoint)
+
+	json, err := pool.MarshalJSON()
+	c.Assert(err, IsNil)
+
+	c.Check(string(json), Equals, `{"endpoints":[{"address":"1.2.3.4:5678","state":"failed","weight":1,"in_flight":0}],"in_flight":0,"queued":0}`)
 }
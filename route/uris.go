@@ -4,8 +4,56 @@ import (
 	"strings"
 )
 
+// Uri is a route: a host name optionally followed by a path prefix, such as
+// "example.com" or "example.com/api". The host name of a route can be a
+// wildcard such as "*.example.com", matching any of its subdomains.
 type Uri string
 
 func (u Uri) ToLower() Uri {
 	return Uri(strings.ToLower(string(u)))
 }
+
+// RouteKey is the normalized form of the uri routes are stored and looked up
+// by: lower case and without trailing slashes.
+func (u Uri) RouteKey() Uri {
+	return Uri(strings.TrimRight(string(u.ToLower()), "/"))
+}
+
+// Parent strips the last path segment off the uri, returning false when only
+// the host name is left. Following parents from a request's uri visits every
+// route that could match it, longest prefix first.
+func (u Uri) Parent() (Uri, bool) {
+	i := strings.LastIndex(string(u), "/")
+	if i < 0 {
+		return "", false
+	}
+
+	return u[:i], true
+}
+
+func (u Uri) Host() Uri {
+	i := strings.Index(string(u), "/")
+	if i < 0 {
+		return u
+	}
+
+	return u[:i]
+}
+
+func (u Uri) Path() string {
+	return string(u[len(u.Host()):])
+}
+
+// NextWildcard returns the next less specific wildcard host name matching
+// the host name u: "*.example.com" for both "foo.example.com" and
+// "*.foo.example.com". It returns false when there is none left.
+func (u Uri) NextWildcard() (Uri, bool) {
+	host := strings.TrimPrefix(string(u), "*.")
+
+	i := strings.Index(host, ".")
+	if i < 0 {
+		return "", false
+	}
+
+	return Uri("*" + host[i:]), true
+}
@@ -0,0 +1,55 @@
+package route
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type UrisSuite struct{}
+
+var _ = Suite(&UrisSuite{})
+
+func (s *UrisSuite) TestRouteKey(c *C) {
+	c.Check(Uri("Example.COM").RouteKey(), Equals, Uri("example.com"))
+	c.Check(Uri("example.com/").RouteKey(), Equals, Uri("example.com"))
+	c.Check(Uri("example.com/API/v1/").RouteKey(), Equals, Uri("example.com/api/v1"))
+}
+
+func (s *UrisSuite) TestParent(c *C) {
+	u, ok := Uri("example.com/api/v1").Parent()
+	c.Check(ok, Equals, true)
+	c.Check(u, Equals, Uri("example.com/api"))
+
+	u, ok = u.Parent()
+	c.Check(ok, Equals, true)
+	c.Check(u, Equals, Uri("example.com"))
+
+	_, ok = u.Parent()
+	c.Check(ok, Equals, false)
+}
+
+func (s *UrisSuite) TestHostAndPath(c *C) {
+	c.Check(Uri("example.com").Host(), Equals, Uri("example.com"))
+	c.Check(Uri("example.com").Path(), Equals, "")
+	c.Check(Uri("example.com/api/v1").Host(), Equals, Uri("example.com"))
+	c.Check(Uri("example.com/api/v1").Path(), Equals, "/api/v1")
+}
+
+func (s *UrisSuite) TestNextWildcard(c *C) {
+	u, ok := Uri("foo.apps.example.com").NextWildcard()
+	c.Check(ok, Equals, true)
+	c.Check(u, Equals, Uri("*.apps.example.com"))
+
+	u, ok = u.NextWildcard()
+	c.Check(ok, Equals, true)
+	c.Check(u, Equals, Uri("*.example.com"))
+
+	u, ok = u.NextWildcard()
+	c.Check(ok, Equals, true)
+	c.Check(u, Equals, Uri("*.com"))
+
+	_, ok = u.NextWildcard()
+	c.Check(ok, Equals, false)
+
+	_, ok = Uri("localhost").NextWildcard()
+	c.Check(ok, Equals, false)
+}
@@ -3,6 +3,7 @@ package router
 import (
 	"bytes"
 	"compress/zlib"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -11,6 +12,7 @@ import (
 
 	vcap "github.com/cloudfoundry/gorouter/common"
 	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/healthcheck"
 	"github.com/cloudfoundry/gorouter/log"
 	"github.com/cloudfoundry/gorouter/proxy"
 	"github.com/cloudfoundry/gorouter/registry"
@@ -21,17 +23,24 @@ import (
 )
 
 type Router struct {
-	config     *config.Config
-	proxy      *proxy.Proxy
-	mbusClient *yagnats.Client
-	registry   *registry.Registry
-	varz       varz.Varz
-	component  *vcap.VcapComponent
+	config        *config.Config
+	proxy         *proxy.Proxy
+	mbusClient    *yagnats.Client
+	registry      *registry.Registry
+	healthChecker *healthcheck.HealthChecker
+	varz          varz.Varz
+	component     *vcap.VcapComponent
+	tlsConfig     *tls.Config
+	server        *proxy.Server
+
+	// Configuration as of the last reload
+	reloadedConfig *config.Config
 }
 
 func NewRouter(c *config.Config) *Router {
 	router := &Router{
-		config: c,
+		config:         c,
+		reloadedConfig: c,
 	}
 
 	// setup number of procs
@@ -39,14 +48,51 @@ func NewRouter(c *config.Config) *Router {
 		runtime.GOMAXPROCS(router.config.GoMaxProcs)
 	}
 
+	if router.config.TLS.Port != 0 {
+		tlsConfig, err := NewTLSConfig(router.config.TLS)
+		if err != nil {
+			log.Fatalf("tls: %s", err)
+			panic(err)
+		}
+
+		if router.config.HTTP2.Enabled {
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+
+		router.tlsConfig = tlsConfig
+	}
+
 	router.mbusClient = yagnats.NewClient()
 
 	router.registry = registry.NewRegistry(router.config, router.mbusClient)
 	router.registry.StartPruningCycle()
 
-	router.varz = varz.NewVarz(router.registry)
+	infoRoutes := map[string]json.Marshaler{
+		"/routes": router.registry,
+	}
+
+	router.varz = varz.NewVarz(router.config, router.registry)
 	router.proxy = proxy.NewProxy(router.config, router.registry, router.varz)
 
+	if router.config.HealthCheck.Enabled {
+		// Endpoints are checked over TLS the same way requests reach them
+		router.healthChecker = healthcheck.NewHealthChecker(router.config, router.registry, router.proxy)
+		router.healthChecker.Start()
+
+		infoRoutes["/health_checks"] = router.healthChecker
+	}
+	router.server = &proxy.Server{
+		Handler:              router.proxy,
+		ReadTimeout:          router.config.ClientReadTimeout,
+		WriteTimeout:         router.config.ClientWriteTimeout,
+		IdleTimeout:          router.config.ClientIdleTimeout,
+		MaxHeaderBytes:       router.config.MaxHeaderBytes,
+		H2C:                  router.config.HTTP2.H2C,
+		MaxConcurrentStreams: router.config.HTTP2.MaxConcurrentStreams,
+	}
+
+	router.varz.SetHttp2Counter(router.server)
+
 	var host string
 	if router.config.Status.Port != 0 {
 		host = fmt.Sprintf("%s:%d", router.config.Ip, router.config.Status.Port)
@@ -69,9 +115,7 @@ func NewRouter(c *config.Config) *Router {
 		Config:      router.config,
 		Varz:        varz,
 		Healthz:     healthz,
-		InfoRoutes: map[string]json.Marshaler{
-			"/routes": router.registry,
-		},
+		InfoRoutes:  infoRoutes,
 	}
 
 	vcap.StartComponent(router.component)
@@ -133,14 +177,124 @@ func (r *Router) Run() {
 
 	log.Infof("Listening on %s", listen.Addr())
 
-	server := proxy.Server{Handler: r.proxy}
+	go r.serve(listen)
 
-	go func() {
-		err := server.Serve(listen)
+	if r.tlsConfig != nil {
+		tlsListen, err := tls.Listen("tcp", fmt.Sprintf(":%d", r.config.TLS.Port), r.tlsConfig)
 		if err != nil {
-			log.Fatalf("proxy.Serve: %s", err)
+			log.Fatalf("tls.Listen: %s", err)
 		}
-	}()
+
+		log.Infof("Listening for TLS on %s", tlsListen.Addr())
+
+		go r.serve(tlsListen)
+	}
+}
+
+func (r *Router) serve(l net.Listener) {
+	err := r.server.Serve(l)
+	if err != nil && err != proxy.ErrDraining {
+		log.Fatalf("proxy.Serve: %s", err)
+	}
+}
+
+// ReopenAccessLog reopens the access log file after it has been moved away,
+// as by logrotate.
+func (r *Router) ReopenAccessLog() {
+	err := r.proxy.ReopenAccessLog()
+	if err != nil {
+		log.Errorf("Could not reopen access log: %s", err)
+	}
+}
+
+// Drain takes the router out of rotation and waits up to the configured drain
+// timeout for requests in flight to finish. The router can't be restarted
+// once drained.
+func (r *Router) Drain() {
+	log.Infof("Draining for up to %s", r.config.DrainTimeout)
+
+	// Fail health checks first so load balancers stop sending new requests
+	r.component.Healthz.Drain()
+	r.proxy.StartDraining()
+
+	// Keep following the routing table while requests are being drained
+	if r.server.Drain(r.config.DrainTimeout) {
+		log.Info("Drained all connections")
+	} else {
+		log.Warnf("Gave up draining with %d connections left", r.server.NumConns())
+	}
+
+	for _, subject := range []string{"router.register", "router.unregister", "router.greet", "vcap.component.discover"} {
+		r.mbusClient.UnsubscribeAll(subject)
+	}
+
+	r.mbusClient.Disconnect()
+}
+
+// Reload applies the settings of c that can be changed while the router is
+// running, and logs the changes that can only take effect after a restart.
+// It must not be called concurrently.
+func (r *Router) Reload(c *config.Config) {
+	previous := r.reloadedConfig
+	reloaded := *previous
+
+	for _, key := range previous.Changes(c) {
+		if !config.IsReloadable(key) {
+			log.Warnf("Ignoring change to %s: it requires a restart", key)
+			continue
+		}
+
+		log.Infof("Reloading %s", key)
+
+		switch key {
+		case "logging.level":
+			err := log.SetLevel(c.Logging.Level)
+			if err != nil {
+				log.Errorf("Could not reload %s: %s", key, err)
+				continue
+			}
+
+			reloaded.Logging.Level = c.Logging.Level
+		case "access_log":
+			err := r.proxy.SetAccessLog(c.AccessLog)
+			if err != nil {
+				log.Errorf("Could not reload %s: %s", key, err)
+				continue
+			}
+
+			reloaded.AccessLog = c.AccessLog
+		case "access_log_format":
+			err := r.proxy.SetAccessLogFormat(c.AccessLogFormat)
+			if err != nil {
+				log.Errorf("Could not reload %s: %s", key, err)
+				continue
+			}
+
+			reloaded.AccessLogFormat = c.AccessLogFormat
+		case "endpoint_timeout":
+			r.proxy.SetResponseHeaderTimeout(c.EndpointTimeout)
+
+			reloaded.EndpointTimeoutInSeconds = c.EndpointTimeoutInSeconds
+		case "prune_stale_droplets_interval", "droplet_stale_threshold":
+			r.registry.SetPruneStaleDroplets(c.PruneStaleDropletsInterval, c.DropletStaleThreshold)
+
+			reloaded.PruneStaleDropletsIntervalInSeconds = c.PruneStaleDropletsIntervalInSeconds
+			reloaded.DropletStaleThresholdInSeconds = c.DropletStaleThresholdInSeconds
+		case "trace_key":
+			r.proxy.SetTraceKey(c.TraceKey)
+
+			reloaded.TraceKey = c.TraceKey
+		case "status.user", "status.pass":
+			r.component.SetCredentials(c.Status.User, c.Status.Pass)
+
+			reloaded.Status.User = c.Status.User
+			reloaded.Status.Pass = c.Status.Pass
+		}
+	}
+
+	reloaded.Process()
+
+	r.reloadedConfig = &reloaded
 }
 
 func (r *Router) RegisterComponent() {
@@ -155,6 +309,17 @@ type registryMessage struct {
 	App  string            `json:"app"`
 
 	PrivateInstanceId string `json:"private_instance_id"`
+
+	LoadBalancing   string `json:"load_balancing"`
+	HealthCheckPath string `json:"health_check_path"`
+
+	TLSPort    uint16 `json:"tls_port"`
+	ServerName string `json:"server_name"`
+
+	// "h2" or "h2c" to be proxied to with HTTP/2
+	Protocol string `json:"protocol"`
+
+	Weight int `json:"weight"`
 }
 
 func (r *Router) SubscribeRegister() {
@@ -289,5 +454,14 @@ func makeRouteEndpoint(registryMessage *registryMessage) *route.Endpoint {
 		Tags:          registryMessage.Tags,
 
 		PrivateInstanceId: registryMessage.PrivateInstanceId,
+
+		LoadBalancing:   registryMessage.LoadBalancing,
+		HealthCheckPath: registryMessage.HealthCheckPath,
+
+		TLSPort:    registryMessage.TLSPort,
+		ServerName: registryMessage.ServerName,
+		Protocol:   registryMessage.Protocol,
+
+		Weight: registryMessage.Weight,
 	}
 }
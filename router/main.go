@@ -2,6 +2,9 @@ package main
 
 import (
 	"flag"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/cloudfoundry/gorouter"
 	"github.com/cloudfoundry/gorouter/config"
@@ -24,7 +27,40 @@ func main() {
 
 	log.SetupLoggerFromConfig(c)
 
-	router.NewRouter(c).Run()
+	r := router.NewRouter(c)
+	r.Run()
 
-	select {}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGUSR1)
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			reload(r)
+		case syscall.SIGUSR2:
+			log.Info("Received SIGUSR2; reopening access log")
+			r.ReopenAccessLog()
+		case syscall.SIGTERM, syscall.SIGUSR1:
+			log.Infof("Received %s; draining", sig)
+			r.Drain()
+			os.Exit(0)
+		}
+	}
+}
+
+func reload(r *router.Router) {
+	if configFile == "" {
+		log.Warn("Received SIGHUP without a configuration file to reload")
+		return
+	}
+
+	log.Infof("Received SIGHUP; reloading %s", configFile)
+
+	c, err := config.ReadConfigFromFile(configFile)
+	if err != nil {
+		log.Errorf("Could not reload configuration: %s", err)
+		return
+	}
+
+	r.Reload(c)
 }
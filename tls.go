@@ -0,0 +1,32 @@
+package router
+
+import (
+	"crypto/tls"
+	"errors"
+
+	"github.com/cloudfoundry/gorouter/config"
+)
+
+// NewTLSConfig loads the configured certificates for the TLS listener.
+// Certificates are chosen by the SNI server name the client sends, falling
+// back to a wildcard certificate for the name and then to the first one.
+func NewTLSConfig(c config.TLSConfig) (*tls.Config, error) {
+	if len(c.Certificates) == 0 {
+		return nil, errors.New("no certificates configured")
+	}
+
+	tlsConfig := &tls.Config{}
+
+	for _, cert := range c.Certificates {
+		certificate, err := tls.LoadX509KeyPair(cert.CertFile, cert.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = append(tlsConfig.Certificates, certificate)
+	}
+
+	tlsConfig.BuildNameToCertificate()
+
+	return tlsConfig, nil
+}
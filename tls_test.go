@@ -0,0 +1,98 @@
+package router
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/cloudfoundry/gorouter/config"
+	"github.com/cloudfoundry/gorouter/test"
+)
+
+type TLSSuite struct {
+	dir       string
+	tlsConfig *tls.Config
+	listener  net.Listener
+}
+
+var _ = Suite(&TLSSuite{})
+
+func (s *TLSSuite) SetUpSuite(c *C) {
+	var err error
+
+	s.dir, err = ioutil.TempDir("", "gorouter-tls")
+	c.Assert(err, IsNil)
+
+	var certificates []config.CertificateConfig
+	for _, name := range []string{"default.example.com", "exact.example.com", "*.apps.example.com"} {
+		certFile, keyFile := test.WriteCertificate(s.dir, name)
+		certificates = append(certificates, config.CertificateConfig{CertFile: certFile, KeyFile: keyFile})
+	}
+
+	s.tlsConfig, err = NewTLSConfig(config.TLSConfig{Port: 443, Certificates: certificates})
+	c.Assert(err, IsNil)
+
+	s.listener, err = tls.Listen("tcp", "127.0.0.1:0", s.tlsConfig)
+	c.Assert(err, IsNil)
+
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+}
+
+func (s *TLSSuite) TearDownSuite(c *C) {
+	s.listener.Close()
+	os.RemoveAll(s.dir)
+}
+
+func (s *TLSSuite) servedCertificateName(c *C, serverName string) string {
+	conn, err := tls.Dial("tcp", s.listener.Addr().String(), &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func (s *TLSSuite) TestSelectsCertificateByServerName(c *C) {
+	c.Check(s.servedCertificateName(c, "exact.example.com"), Equals, "exact.example.com")
+	c.Check(s.servedCertificateName(c, "default.example.com"), Equals, "default.example.com")
+}
+
+func (s *TLSSuite) TestSelectsWildcardCertificate(c *C) {
+	c.Check(s.servedCertificateName(c, "foo.apps.example.com"), Equals, "*.apps.example.com")
+	c.Check(s.servedCertificateName(c, "bar.apps.example.com"), Equals, "*.apps.example.com")
+}
+
+func (s *TLSSuite) TestFallsBackToFirstCertificate(c *C) {
+	c.Check(s.servedCertificateName(c, "unknown.example.org"), Equals, "default.example.com")
+	c.Check(s.servedCertificateName(c, "foo.bar.apps.example.com"), Equals, "default.example.com")
+}
+
+func (s *TLSSuite) TestRequiresCertificates(c *C) {
+	_, err := NewTLSConfig(config.TLSConfig{Port: 443})
+	c.Check(err, ErrorMatches, "no certificates configured")
+}
+
+func (s *TLSSuite) TestFailsOnMissingCertificate(c *C) {
+	_, err := NewTLSConfig(config.TLSConfig{
+		Port:         443,
+		Certificates: []config.CertificateConfig{{CertFile: "/does/not/exist.crt", KeyFile: "/does/not/exist.key"}},
+	})
+	c.Check(err, NotNil)
+}
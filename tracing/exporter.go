@@ -0,0 +1,175 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/log"
+)
+
+const (
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// Exporter sends finished spans to wherever traces are collected.
+type Exporter interface {
+	Export(s *Span) error
+}
+
+// NewExporter returns the built-in exporter with the given name, queueing up
+// to bufferSize spans. The file exporter appends to the file at path.
+func NewExporter(name, path string, bufferSize int) (Exporter, error) {
+	switch name {
+	case "", ExporterStdout:
+		return NewWriterExporter(os.Stdout, bufferSize), nil
+	case ExporterFile:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewWriterExporter(f, bufferSize), nil
+	}
+
+	return nil, fmt.Errorf("unknown span exporter %q", name)
+}
+
+// Most spans written at once
+const exporterMaxBatch = 64
+
+// WriterExporter writes spans as lines of JSON. Spans are queued as they
+// finish and written in the background, so requests don't wait on the
+// writer; they are dropped while the queue is full.
+type WriterExporter struct {
+	// Updated atomically, and first in the struct to be 64-bit aligned
+	exported int64
+	dropped  int64
+
+	w    io.Writer
+	c    chan []byte
+	done chan bool
+}
+
+func NewWriterExporter(w io.Writer, bufferSize int) *WriterExporter {
+	e := &WriterExporter{
+		w:    w,
+		c:    make(chan []byte, bufferSize),
+		done: make(chan bool),
+	}
+
+	go e.run()
+
+	return e
+}
+
+type jsonEvent struct {
+	Name string `json:"name"`
+
+	// Seconds since the start of the span
+	Offset float64 `json:"offset"`
+}
+
+type jsonSpan struct {
+	TraceId    string            `json:"trace_id"`
+	SpanId     string            `json:"span_id"`
+	ParentId   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	StartedAt  string            `json:"started_at"`
+	Duration   float64           `json:"duration"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Events     []jsonEvent       `json:"events,omitempty"`
+}
+
+func (e *WriterExporter) Export(s *Span) error {
+	s.Lock()
+
+	y := jsonSpan{
+		TraceId:    s.TraceId,
+		SpanId:     s.SpanId,
+		ParentId:   s.ParentId,
+		Name:       s.Name,
+		StartedAt:  s.StartedAt.Format(time.RFC3339Nano),
+		Duration:   s.FinishedAt.Sub(s.StartedAt).Seconds(),
+		Attributes: s.Attributes,
+	}
+
+	for _, x := range s.Events {
+		y.Events = append(y.Events, jsonEvent{
+			Name:   x.Name,
+			Offset: x.At.Sub(s.StartedAt).Seconds(),
+		})
+	}
+
+	b, err := json.Marshal(y)
+	s.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	select {
+	case e.c <- append(b, '\n'):
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+
+	return nil
+}
+
+func (e *WriterExporter) run() {
+	defer close(e.done)
+
+	var b bytes.Buffer
+
+	for line := range e.c {
+		b.Reset()
+		b.Write(line)
+		n := 1
+
+		// Write the spans that queued up in the meantime along with it
+	queued:
+		for n < exporterMaxBatch {
+			select {
+			case line, ok := <-e.c:
+				if !ok {
+					break queued
+				}
+
+				b.Write(line)
+				n++
+			default:
+				break queued
+			}
+		}
+
+		_, err := b.WriteTo(e.w)
+		if err != nil {
+			log.Warnf("Could not write spans: %s", err)
+			continue
+		}
+
+		atomic.AddInt64(&e.exported, int64(n))
+	}
+}
+
+// Stop writes the spans queued and returns. Nothing may be exported after.
+func (e *WriterExporter) Stop() {
+	close(e.c)
+	<-e.done
+}
+
+// Exported returns the number of spans written.
+func (e *WriterExporter) Exported() int64 {
+	return atomic.LoadInt64(&e.exported)
+}
+
+// Dropped returns the number of spans dropped because the queue was full.
+func (e *WriterExporter) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
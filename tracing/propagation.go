@@ -0,0 +1,196 @@
+package tracing
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Headers of W3C Trace Context and Zipkin B3 propagation.
+const (
+	TraceparentHeader = "Traceparent"
+
+	B3Header             = "B3"
+	B3TraceIdHeader      = "X-B3-TraceId"
+	B3SpanIdHeader       = "X-B3-SpanId"
+	B3ParentSpanIdHeader = "X-B3-ParentSpanId"
+	B3SampledHeader      = "X-B3-Sampled"
+	B3FlagsHeader        = "X-B3-Flags"
+)
+
+// Whether an incoming span was sampled; B3 lets the receiver decide.
+type sampling int
+
+const (
+	samplingDeferred sampling = iota
+	samplingAccept
+	samplingDeny
+)
+
+// extract returns the incoming span a request continues, if any. Trace
+// Context takes precedence over B3, and the single B3 header over the
+// multiple ones.
+func extract(h http.Header) (SpanContext, sampling, bool) {
+	if v := h.Get(TraceparentHeader); v != "" {
+		return parseTraceparent(v)
+	}
+
+	if v := h.Get(B3Header); v != "" {
+		return parseB3(v)
+	}
+
+	return parseB3Headers(h)
+}
+
+func parseTraceparent(v string) (SpanContext, sampling, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 {
+		return SpanContext{}, samplingDeferred, false
+	}
+
+	version := parts[0]
+	if !isHex(version, 2) || version == "ff" {
+		return SpanContext{}, samplingDeferred, false
+	}
+
+	// Later versions may add fields, but must keep the first four
+	if version == "00" && len(parts) != 4 {
+		return SpanContext{}, samplingDeferred, false
+	}
+
+	traceId, spanId, flags := parts[1], parts[2], parts[3]
+	if !isId(traceId, 32) || !isId(spanId, 16) || !isHex(flags, 2) {
+		return SpanContext{}, samplingDeferred, false
+	}
+
+	var f int
+	fmt.Sscanf(flags, "%x", &f)
+
+	s := samplingDeny
+	if f&1 == 1 {
+		s = samplingAccept
+	}
+
+	return SpanContext{TraceId: traceId, SpanId: spanId}, s, true
+}
+
+// parseB3 parses the single B3 header: {trace}-{span}[-{sampled}[-{parent}]].
+// A header holding only a sampling decision carries no span to continue.
+func parseB3(v string) (SpanContext, sampling, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 2 || len(parts) > 4 {
+		return SpanContext{}, samplingDeferred, false
+	}
+
+	s := samplingDeferred
+	if len(parts) > 2 {
+		var ok bool
+
+		s, ok = parseB3Sampled(parts[2])
+		if !ok {
+			return SpanContext{}, samplingDeferred, false
+		}
+	}
+
+	return b3SpanContext(parts[0], parts[1], s)
+}
+
+func parseB3Headers(h http.Header) (SpanContext, sampling, bool) {
+	s := samplingDeferred
+
+	if v := h.Get(B3SampledHeader); v != "" {
+		var ok bool
+
+		s, ok = parseB3Sampled(v)
+		if !ok {
+			return SpanContext{}, samplingDeferred, false
+		}
+	}
+
+	// Debug implies accept
+	if h.Get(B3FlagsHeader) == "1" {
+		s = samplingAccept
+	}
+
+	return b3SpanContext(h.Get(B3TraceIdHeader), h.Get(B3SpanIdHeader), s)
+}
+
+func parseB3Sampled(v string) (sampling, bool) {
+	switch v {
+	case "1", "true", "d":
+		return samplingAccept, true
+	case "0", "false":
+		return samplingDeny, true
+	}
+
+	return samplingDeferred, false
+}
+
+func b3SpanContext(traceId, spanId string, s sampling) (SpanContext, sampling, bool) {
+	traceId = strings.ToLower(traceId)
+	spanId = strings.ToLower(spanId)
+
+	// B3 trace ids may be 64 bits long
+	if isId(traceId, 16) {
+		traceId = strings.Repeat("0", 16) + traceId
+	}
+
+	if !isId(traceId, 32) || !isId(spanId, 16) {
+		return SpanContext{}, samplingDeferred, false
+	}
+
+	return SpanContext{TraceId: traceId, SpanId: spanId}, s, true
+}
+
+// inject replaces the propagation headers of h with ones for sc. Both
+// formats are sent, so that endpoints understanding either continue the
+// trace; the single B3 header is only rewritten if it was there already.
+func inject(h http.Header, sc SpanContext, parentId string) {
+	flags, sampled := "00", "0"
+	if sc.Sampled {
+		flags, sampled = "01", "1"
+	}
+
+	h.Set(TraceparentHeader, "00-"+sc.TraceId+"-"+sc.SpanId+"-"+flags)
+
+	h.Set(B3TraceIdHeader, sc.TraceId)
+	h.Set(B3SpanIdHeader, sc.SpanId)
+	h.Set(B3SampledHeader, sampled)
+	h.Del(B3FlagsHeader)
+
+	if parentId != "" {
+		h.Set(B3ParentSpanIdHeader, parentId)
+	} else {
+		h.Del(B3ParentSpanIdHeader)
+	}
+
+	if h.Get(B3Header) != "" {
+		b3 := sc.TraceId + "-" + sc.SpanId + "-" + sampled
+		if parentId != "" {
+			b3 += "-" + parentId
+		}
+
+		h.Set(B3Header, b3)
+	}
+}
+
+// isId tells whether s is a valid id of n lowercase hex digits, which must
+// not all be zero.
+func isId(s string, n int) bool {
+	return isHex(s, n) && s != strings.Repeat("0", n)
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
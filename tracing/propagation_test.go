@@ -0,0 +1,148 @@
+package tracing
+
+import (
+	"net/http"
+
+	. "launchpad.net/gocheck"
+)
+
+type PropagationSuite struct{}
+
+var _ = Suite(&PropagationSuite{})
+
+const (
+	traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	spanId  = "00f067aa0ba902b7"
+)
+
+func header(kv ...string) http.Header {
+	h := http.Header{}
+	for i := 0; i < len(kv); i += 2 {
+		h.Set(kv[i], kv[i+1])
+	}
+
+	return h
+}
+
+func (s *PropagationSuite) TestTraceparent(c *C) {
+	sc, sampling, ok := extract(header(TraceparentHeader, "00-"+traceId+"-"+spanId+"-01"))
+	c.Assert(ok, Equals, true)
+	c.Check(sc.TraceId, Equals, traceId)
+	c.Check(sc.SpanId, Equals, spanId)
+	c.Check(sampling, Equals, samplingAccept)
+
+	_, sampling, ok = extract(header(TraceparentHeader, "00-"+traceId+"-"+spanId+"-00"))
+	c.Assert(ok, Equals, true)
+	c.Check(sampling, Equals, samplingDeny)
+}
+
+func (s *PropagationSuite) TestTraceparentOfLaterVersion(c *C) {
+	sc, _, ok := extract(header(TraceparentHeader, "01-"+traceId+"-"+spanId+"-01-extra"))
+	c.Assert(ok, Equals, true)
+	c.Check(sc.TraceId, Equals, traceId)
+}
+
+func (s *PropagationSuite) TestInvalidTraceparent(c *C) {
+	for _, v := range []string{
+		"",
+		"00-" + traceId + "-" + spanId,
+		"00-" + traceId + "-" + spanId + "-01-extra",
+		"ff-" + traceId + "-" + spanId + "-01",
+		"00-00000000000000000000000000000000-" + spanId + "-01",
+		"00-" + traceId + "-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanId + "-01",
+		"00-" + traceId + "-" + spanId + "-x1",
+	} {
+		_, _, ok := parseTraceparent(v)
+		c.Check(ok, Equals, false, Commentf("%q", v))
+	}
+}
+
+func (s *PropagationSuite) TestTraceparentTakesPrecedence(c *C) {
+	sc, _, ok := extract(header(
+		TraceparentHeader, "00-"+traceId+"-"+spanId+"-01",
+		B3TraceIdHeader, "463ac35c9f6413ad48485a3953bb6124",
+		B3SpanIdHeader, "a2fb4a1d1a96d312",
+	))
+	c.Assert(ok, Equals, true)
+	c.Check(sc.TraceId, Equals, traceId)
+}
+
+func (s *PropagationSuite) TestB3Headers(c *C) {
+	sc, sampling, ok := extract(header(
+		B3TraceIdHeader, "463ac35c9f6413ad48485a3953bb6124",
+		B3SpanIdHeader, "a2fb4a1d1a96d312",
+		B3SampledHeader, "1",
+	))
+	c.Assert(ok, Equals, true)
+	c.Check(sc.TraceId, Equals, "463ac35c9f6413ad48485a3953bb6124")
+	c.Check(sc.SpanId, Equals, "a2fb4a1d1a96d312")
+	c.Check(sampling, Equals, samplingAccept)
+}
+
+func (s *PropagationSuite) TestB3HeadersWithShortTraceId(c *C) {
+	sc, sampling, ok := extract(header(
+		B3TraceIdHeader, "48485a3953bb6124",
+		B3SpanIdHeader, "a2fb4a1d1a96d312",
+	))
+	c.Assert(ok, Equals, true)
+	c.Check(sc.TraceId, Equals, "000000000000000048485a3953bb6124")
+	c.Check(sampling, Equals, samplingDeferred)
+}
+
+func (s *PropagationSuite) TestB3DebugFlag(c *C) {
+	_, sampling, ok := extract(header(
+		B3TraceIdHeader, "48485a3953bb6124",
+		B3SpanIdHeader, "a2fb4a1d1a96d312",
+		B3FlagsHeader, "1",
+	))
+	c.Assert(ok, Equals, true)
+	c.Check(sampling, Equals, samplingAccept)
+}
+
+func (s *PropagationSuite) TestSingleB3Header(c *C) {
+	sc, sampling, ok := extract(header(B3Header, "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-0-05e3ac9a4f6e3b90"))
+	c.Assert(ok, Equals, true)
+	c.Check(sc.TraceId, Equals, "80f198ee56343ba864fe8b2a57d3eff7")
+	c.Check(sc.SpanId, Equals, "e457b5a2e4d86bd1")
+	c.Check(sampling, Equals, samplingDeny)
+
+	// Only a sampling decision
+	_, _, ok = extract(header(B3Header, "0"))
+	c.Check(ok, Equals, false)
+}
+
+func (s *PropagationSuite) TestInject(c *C) {
+	h := header(B3Header, "0", B3FlagsHeader, "1")
+
+	inject(h, SpanContext{TraceId: traceId, SpanId: spanId, Sampled: true}, "a2fb4a1d1a96d312")
+
+	c.Check(h.Get(TraceparentHeader), Equals, "00-"+traceId+"-"+spanId+"-01")
+	c.Check(h.Get(B3TraceIdHeader), Equals, traceId)
+	c.Check(h.Get(B3SpanIdHeader), Equals, spanId)
+	c.Check(h.Get(B3ParentSpanIdHeader), Equals, "a2fb4a1d1a96d312")
+	c.Check(h.Get(B3SampledHeader), Equals, "1")
+	c.Check(h.Get(B3FlagsHeader), Equals, "")
+	c.Check(h.Get(B3Header), Equals, traceId+"-"+spanId+"-1-a2fb4a1d1a96d312")
+}
+
+func (s *PropagationSuite) TestInjectedHeadersAreExtracted(c *C) {
+	h := http.Header{}
+	sc := SpanContext{TraceId: traceId, SpanId: spanId}
+
+	inject(h, sc, "")
+	c.Check(h.Get(B3ParentSpanIdHeader), Equals, "")
+	c.Check(h.Get(B3Header), Equals, "")
+
+	extracted, sampling, ok := extract(h)
+	c.Assert(ok, Equals, true)
+	c.Check(extracted, Equals, sc)
+	c.Check(sampling, Equals, samplingDeny)
+
+	h.Del(TraceparentHeader)
+
+	extracted, sampling, ok = extract(h)
+	c.Assert(ok, Equals, true)
+	c.Check(extracted, Equals, sc)
+	c.Check(sampling, Equals, samplingDeny)
+}
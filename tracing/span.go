@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/log"
+)
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	// 32 and 16 lowercase hex digits respectively
+	TraceId string
+	SpanId  string
+
+	Sampled bool
+}
+
+// Event marks the time something happened during a span.
+type Event struct {
+	Name string
+	At   time.Time
+}
+
+// Span is the part of a trace the router is responsible for. Its methods can
+// be called on a nil span, which is what a nil tracer starts, so that code
+// doesn't need to check whether tracing is enabled.
+type Span struct {
+	sync.Mutex
+	SpanContext
+
+	ParentId   string
+	Name       string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Attributes map[string]string
+	Events     []Event
+
+	tracer *Tracer
+}
+
+func (s *Span) SetAttribute(k, v string) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.Attributes[k] = v
+}
+
+// AddEvent records the named event as happening now. Events can be added
+// from any goroutine.
+func (s *Span) AddEvent(name string) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.Events = append(s.Events, Event{Name: name, At: time.Now()})
+}
+
+// Inject sets the headers that make the next hop continue the trace as a
+// child of this span.
+func (s *Span) Inject(h http.Header) {
+	if s == nil {
+		return
+	}
+
+	inject(h, s.SpanContext, s.ParentId)
+}
+
+// Finish ends the span, exporting it if it is sampled.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	s.FinishedAt = time.Now()
+	s.Unlock()
+
+	if !s.Sampled {
+		return
+	}
+
+	err := s.tracer.Export(s)
+	if err != nil {
+		log.Errorf("Could not export span %s: %s", s.SpanId, err)
+	}
+}
@@ -0,0 +1,82 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+	"net/http"
+	"time"
+)
+
+// Tracer starts spans and exports the sampled ones. A nil tracer starts nil
+// spans, which record nothing.
+type Tracer struct {
+	Exporter
+
+	// Fraction of new traces that are sampled; incoming traces keep the
+	// decision made upstream.
+	sampleRate float64
+}
+
+func NewTracer(e Exporter, sampleRate float64) *Tracer {
+	return &Tracer{
+		Exporter:   e,
+		sampleRate: sampleRate,
+	}
+}
+
+// StartSpan starts a span continuing the trace propagated in h, or a new
+// trace if h doesn't carry one.
+func (t *Tracer) StartSpan(name string, h http.Header) *Span {
+	if t == nil {
+		return nil
+	}
+
+	s := &Span{
+		Name:       name,
+		StartedAt:  time.Now(),
+		Attributes: make(map[string]string),
+		tracer:     t,
+	}
+
+	parent, sampling, ok := extract(h)
+	if ok {
+		s.TraceId = parent.TraceId
+		s.ParentId = parent.SpanId
+	} else {
+		s.TraceId = newId(16)
+	}
+
+	s.SpanId = newId(8)
+
+	switch sampling {
+	case samplingAccept:
+		s.Sampled = true
+	case samplingDeny:
+		s.Sampled = false
+	default:
+		s.Sampled = t.sample()
+	}
+
+	return s
+}
+
+func (t *Tracer) sample() bool {
+	return t.sampleRate >= 1 || mathrand.Float64() < t.sampleRate
+}
+
+// newId returns a random id of n bytes in hex.
+func newId(n int) string {
+	b := make([]byte, n)
+
+	for {
+		rand.Read(b)
+
+		// All zero ids are invalid
+		for _, x := range b {
+			if x != 0 {
+				return hex.EncodeToString(b)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	. "launchpad.net/gocheck"
+)
+
+type TracerSuite struct {
+	*Tracer
+
+	exporter *WriterExporter
+	out      *bytes.Buffer
+}
+
+var _ = Suite(&TracerSuite{})
+
+func (s *TracerSuite) SetUpTest(c *C) {
+	s.out = &bytes.Buffer{}
+	s.exporter = NewWriterExporter(s.out, 16)
+	s.Tracer = NewTracer(s.exporter, 1)
+}
+
+// exported stops the exporter, and returns the spans it wrote.
+func (s *TracerSuite) exported(c *C) []map[string]interface{} {
+	s.exporter.Stop()
+
+	spans := []map[string]interface{}{}
+
+	for _, line := range strings.Split(strings.TrimSpace(s.out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var span map[string]interface{}
+		c.Assert(json.Unmarshal([]byte(line), &span), IsNil)
+		spans = append(spans, span)
+	}
+
+	return spans
+}
+
+func (s *TracerSuite) TestStartsNewTrace(c *C) {
+	span := s.StartSpan("router", http.Header{})
+
+	c.Check(isId(span.TraceId, 32), Equals, true)
+	c.Check(isId(span.SpanId, 16), Equals, true)
+	c.Check(span.ParentId, Equals, "")
+	c.Check(span.Sampled, Equals, true)
+}
+
+func (s *TracerSuite) TestContinuesTrace(c *C) {
+	span := s.StartSpan("router", header(TraceparentHeader, "00-"+traceId+"-"+spanId+"-00"))
+
+	c.Check(span.TraceId, Equals, traceId)
+	c.Check(span.ParentId, Equals, spanId)
+	c.Check(span.SpanId, Not(Equals), spanId)
+	c.Check(span.Sampled, Equals, false)
+}
+
+func (s *TracerSuite) TestSampleRate(c *C) {
+	s.Tracer = NewTracer(s.exporter, 0)
+
+	c.Check(s.StartSpan("router", http.Header{}).Sampled, Equals, false)
+
+	// Upstream decisions are kept
+	span := s.StartSpan("router", header(TraceparentHeader, "00-"+traceId+"-"+spanId+"-01"))
+	c.Check(span.Sampled, Equals, true)
+}
+
+func (s *TracerSuite) TestExportsSampledSpans(c *C) {
+	span := s.StartSpan("router", header(TraceparentHeader, "00-"+traceId+"-"+spanId+"-01"))
+	span.AddEvent("lookup")
+	span.SetAttribute("http.method", "GET")
+	span.Finish()
+
+	spans := s.exported(c)
+	c.Assert(spans, HasLen, 1)
+	c.Check(spans[0]["trace_id"], Equals, traceId)
+	c.Check(spans[0]["span_id"], Equals, span.SpanId)
+	c.Check(spans[0]["parent_id"], Equals, spanId)
+	c.Check(spans[0]["name"], Equals, "router")
+	c.Check(spans[0]["duration"].(float64) >= 0, Equals, true)
+	c.Check(spans[0]["attributes"], DeepEquals, map[string]interface{}{"http.method": "GET"})
+
+	events := spans[0]["events"].([]interface{})
+	c.Assert(events, HasLen, 1)
+	c.Check(events[0].(map[string]interface{})["name"], Equals, "lookup")
+}
+
+func (s *TracerSuite) TestDoesNotExportUnsampledSpans(c *C) {
+	span := s.StartSpan("router", header(TraceparentHeader, "00-"+traceId+"-"+spanId+"-00"))
+	span.Finish()
+
+	c.Check(s.exported(c), HasLen, 0)
+}
+
+func (s *TracerSuite) TestNilTracer(c *C) {
+	var t *Tracer
+
+	span := t.StartSpan("router", http.Header{})
+	c.Check(span, IsNil)
+
+	h := http.Header{}
+
+	// None of these do anything
+	span.AddEvent("lookup")
+	span.SetAttribute("k", "v")
+	span.Inject(h)
+	span.Finish()
+
+	c.Check(h, HasLen, 0)
+}
+
+func (s *TracerSuite) TestFileExporter(c *C) {
+	path := filepath.Join(c.MkDir(), "spans.log")
+
+	e, err := NewExporter(ExporterFile, path, 16)
+	c.Assert(err, IsNil)
+
+	NewTracer(e, 1).StartSpan("router", http.Header{}).Finish()
+	e.(*WriterExporter).Stop()
+
+	b, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Matches, `\{"trace_id":"[0-9a-f]{32}".*\}\n`)
+}
+
+// blockingWriter holds up writes until released, telling when one starts.
+type blockingWriter struct {
+	started chan bool
+	release chan bool
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	w.started <- true
+	<-w.release
+	return len(b), nil
+}
+
+func (s *TracerSuite) TestDropsSpansWhileQueueIsFull(c *C) {
+	w := &blockingWriter{started: make(chan bool, 2), release: make(chan bool)}
+	e := NewWriterExporter(w, 1)
+	t := NewTracer(e, 1)
+
+	t.StartSpan("router", http.Header{}).Finish()
+	<-w.started
+
+	// One is queued while the first is being written
+	for i := 0; i < 3; i++ {
+		t.StartSpan("router", http.Header{}).Finish()
+	}
+
+	close(w.release)
+	e.Stop()
+
+	c.Check(e.Exported(), Equals, int64(2))
+	c.Check(e.Dropped(), Equals, int64(2))
+}
+
+func (s *TracerSuite) TestUnknownExporter(c *C) {
+	_, err := NewExporter("zipkin", "", 16)
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,59 @@
+package varz
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Names of the gRPC status codes, indexed by code.
+var grpcCodes = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// grpcStatus returns the name of the status of a gRPC response, taken from
+// its trailers, or from its headers when it has no body. Responses ending
+// without a status count as UNKNOWN. Other responses, including gRPC ones
+// failing at the HTTP level, aren't gRPC responses as far as varz is
+// concerned.
+func grpcStatus(response *http.Response) (string, bool) {
+	if response == nil || response.StatusCode != http.StatusOK {
+		return "", false
+	}
+
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "application/grpc") {
+		return "", false
+	}
+
+	status := response.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = response.Header.Get("Grpc-Status")
+	}
+
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 0 {
+		return grpcCodes[2], true
+	}
+
+	if code >= len(grpcCodes) {
+		return status, true
+	}
+
+	return grpcCodes[code], true
+}
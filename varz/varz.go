@@ -1,12 +1,16 @@
 package varz
 
 import (
+	"container/list"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/cloudfoundry/gorouter/common"
+	"github.com/cloudfoundry/gorouter/config"
 	"github.com/cloudfoundry/gorouter/registry"
 	"github.com/cloudfoundry/gorouter/route"
 	"github.com/cloudfoundry/gorouter/stats"
@@ -25,11 +29,36 @@ type varz struct {
 		Component TaggedHttpMetric `json:"component"`
 	} `json:"tags"`
 
+	Apps *appMetrics `json:"apps,omitempty"`
+
 	Urls     int `json:"urls"`
 	Droplets int `json:"droplets"`
 
-	BadRequests    int     `json:"bad_requests"`
-	BadGateways    int     `json:"bad_gateways"`
+	AccessLogRecordsWritten int64 `json:"access_log_records_written"`
+	AccessLogRecordsDropped int64 `json:"access_log_records_dropped"`
+
+	SpansExported int64 `json:"spans_exported"`
+	SpansDropped  int64 `json:"spans_dropped"`
+
+	Http2Connections   int   `json:"http2_connections"`
+	Http2Streams       int64 `json:"http2_streams"`
+	Http2ActiveStreams int   `json:"http2_active_streams"`
+
+	RequestsInFlight int `json:"requests_in_flight"`
+	RequestsQueued   int `json:"requests_queued"`
+
+	BadRequests int `json:"bad_requests"`
+	BadGateways int `json:"bad_gateways"`
+	Retries     int `json:"retries"`
+	RateLimited struct {
+		Clients int `json:"clients"`
+		Routes  int `json:"routes"`
+	} `json:"rate_limited"`
+	ConcurrencyLimited struct {
+		Router    int `json:"router"`
+		Routes    int `json:"routes"`
+		Endpoints int `json:"endpoints"`
+	} `json:"concurrency_limited"`
 	RequestsPerSec float64 `json:"requests_per_sec"`
 
 	TopApps []topAppsEntry `json:"top10_app_requests"`
@@ -38,8 +67,8 @@ type varz struct {
 }
 
 type httpMetric struct {
-	Requests int64      `json:"requests"`
-	Rate     [3]float64 `json:"rate"`
+	Requests int64     `json:"requests"`
+	Rate     []float64 `json:"rate,omitempty"`
 
 	Responses2xx int64              `json:"responses_2xx"`
 	Responses3xx int64              `json:"responses_3xx"`
@@ -47,11 +76,16 @@ type httpMetric struct {
 	Responses5xx int64              `json:"responses_5xx"`
 	ResponsesXxx int64              `json:"responses_xxx"`
 	Latency      map[string]float64 `json:"latency"`
+
+	GrpcResponses map[string]int64 `json:"grpc_responses,omitempty"`
 }
 
 type HttpMetric struct {
 	Requests metrics.Counter
-	Rate     metrics.Meter
+
+	// Nil for the metrics of an application; meters are never released, so
+	// they can't be dropped along with them.
+	Rate metrics.Meter
 
 	Responses2xx metrics.Counter
 	Responses3xx metrics.Counter
@@ -59,12 +93,26 @@ type HttpMetric struct {
 	Responses5xx metrics.Counter
 	ResponsesXxx metrics.Counter
 	Latency      metrics.Histogram
+
+	// gRPC responses by status code name, counted instead of by HTTP status
+	GrpcResponses map[string]metrics.Counter
+
+	// Latency in seconds, in cumulative buckets for the /metrics endpoint
+	LatencyBuckets *common.Histogram
 }
 
+// Upper bounds of the latency buckets, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
 func NewHttpMetric() *HttpMetric {
+	x := newHttpMetricWithoutRate()
+	x.Rate = metrics.NewMeter()
+	return x
+}
+
+func newHttpMetricWithoutRate() *HttpMetric {
 	x := &HttpMetric{
 		Requests: metrics.NewCounter(),
-		Rate:     metrics.NewMeter(),
 
 		Responses2xx: metrics.NewCounter(),
 		Responses3xx: metrics.NewCounter(),
@@ -72,6 +120,10 @@ func NewHttpMetric() *HttpMetric {
 		Responses5xx: metrics.NewCounter(),
 		ResponsesXxx: metrics.NewCounter(),
 		Latency:      metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015)),
+
+		GrpcResponses: make(map[string]metrics.Counter),
+
+		LatencyBuckets: common.NewHistogram(latencyBuckets),
 	}
 	return x
 }
@@ -80,9 +132,9 @@ func (x *HttpMetric) MarshalJSON() ([]byte, error) {
 	y := httpMetric{}
 
 	y.Requests = x.Requests.Count()
-	y.Rate[0] = x.Rate.Rate1()
-	y.Rate[1] = x.Rate.Rate5()
-	y.Rate[2] = x.Rate.Rate15()
+	if x.Rate != nil {
+		y.Rate = []float64{x.Rate.Rate1(), x.Rate.Rate5(), x.Rate.Rate15()}
+	}
 
 	y.Responses2xx = x.Responses2xx.Count()
 	y.Responses3xx = x.Responses3xx.Count()
@@ -90,6 +142,13 @@ func (x *HttpMetric) MarshalJSON() ([]byte, error) {
 	y.Responses5xx = x.Responses5xx.Count()
 	y.ResponsesXxx = x.ResponsesXxx.Count()
 
+	if len(x.GrpcResponses) > 0 {
+		y.GrpcResponses = make(map[string]int64)
+		for code, counter := range x.GrpcResponses {
+			y.GrpcResponses[code] = counter.Count()
+		}
+	}
+
 	p := []float64{0.50, 0.75, 0.90, 0.95, 0.99}
 	z := x.Latency.Percentiles(p)
 
@@ -107,7 +166,9 @@ func (x *HttpMetric) MarshalJSON() ([]byte, error) {
 
 func (x *HttpMetric) CaptureRequest() {
 	x.Requests.Inc(1)
-	x.Rate.Mark(1)
+	if x.Rate != nil {
+		x.Rate.Mark(1)
+	}
 }
 
 func (x *HttpMetric) CaptureResponse(response *http.Response, duration time.Duration) {
@@ -116,7 +177,13 @@ func (x *HttpMetric) CaptureResponse(response *http.Response, duration time.Dura
 		statusCode = response.StatusCode / 100
 	}
 
+	if code, ok := grpcStatus(response); ok {
+		x.grpcResponses(code).Inc(1)
+		statusCode = -1
+	}
+
 	switch statusCode {
+	case -1:
 	case 2:
 		x.Responses2xx.Inc(1)
 	case 3:
@@ -130,6 +197,73 @@ func (x *HttpMetric) CaptureResponse(response *http.Response, duration time.Dura
 	}
 
 	x.Latency.Update(duration.Nanoseconds())
+	x.LatencyBuckets.Observe(duration.Seconds())
+}
+
+func (x *HttpMetric) grpcResponses(code string) metrics.Counter {
+	y := x.GrpcResponses[code]
+	if y == nil {
+		y = metrics.NewCounter()
+		x.GrpcResponses[code] = y
+	}
+
+	return y
+}
+
+// WriteMetrics writes the request, response and latency metrics with names
+// starting with prefix.
+func (x *HttpMetric) WriteMetrics(m *common.MetricsWriter, prefix string) {
+	x.writeRequests(m, prefix, nil)
+	x.writeResponses(m, prefix, nil)
+	x.writeGrpcResponses(m, prefix, nil)
+	x.writeLatency(m, prefix, nil)
+}
+
+func (x *HttpMetric) writeRequests(m *common.MetricsWriter, prefix string, labels common.Labels) {
+	m.Counter(prefix+"requests_total", "Number of requests routed to endpoints.", float64(x.Requests.Count()), labels)
+}
+
+func (x *HttpMetric) writeResponses(m *common.MetricsWriter, prefix string, labels common.Labels) {
+	responses := []struct {
+		class   string
+		counter metrics.Counter
+	}{
+		{"2xx", x.Responses2xx},
+		{"3xx", x.Responses3xx},
+		{"4xx", x.Responses4xx},
+		{"5xx", x.Responses5xx},
+		{"xxx", x.ResponsesXxx},
+	}
+
+	for _, r := range responses {
+		l := common.Labels{"status": r.class}
+		for k, v := range labels {
+			l[k] = v
+		}
+
+		m.Counter(prefix+"responses_total", "Number of responses by status class; xxx counts requests no endpoint responded to.", float64(r.counter.Count()), l)
+	}
+}
+
+func (x *HttpMetric) writeGrpcResponses(m *common.MetricsWriter, prefix string, labels common.Labels) {
+	codes := make([]string, 0, len(x.GrpcResponses))
+	for code := range x.GrpcResponses {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	for _, code := range codes {
+		l := common.Labels{"code": code}
+		for k, v := range labels {
+			l[k] = v
+		}
+
+		m.Counter(prefix+"grpc_responses_total", "Number of gRPC responses by status code; these aren't counted by HTTP status.", float64(x.GrpcResponses[code].Count()), l)
+	}
+}
+
+func (x *HttpMetric) writeLatency(m *common.MetricsWriter, prefix string, labels common.Labels) {
+	m.Histogram(prefix+"latency_seconds", "Time taken by endpoints to respond.", x.LatencyBuckets, labels)
 }
 
 type TaggedHttpMetric map[string]*HttpMetric
@@ -149,6 +283,33 @@ func (x TaggedHttpMetric) httpMetric(t string) *HttpMetric {
 	return y
 }
 
+// WriteMetrics writes the metrics of all tags under the given name prefix,
+// labelled with the tag in the given label.
+func (x TaggedHttpMetric) WriteMetrics(m *common.MetricsWriter, prefix string, label string) {
+	tags := make([]string, 0, len(x))
+	for t := range x {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+
+	// Samples of one metric have to be written together
+	for _, t := range tags {
+		x[t].writeRequests(m, prefix, common.Labels{label: t})
+	}
+
+	for _, t := range tags {
+		x[t].writeResponses(m, prefix, common.Labels{label: t})
+	}
+
+	for _, t := range tags {
+		x[t].writeGrpcResponses(m, prefix, common.Labels{label: t})
+	}
+
+	for _, t := range tags {
+		x[t].writeLatency(m, prefix, common.Labels{label: t})
+	}
+}
+
 func (x TaggedHttpMetric) CaptureRequest(t string) {
 	x.httpMetric(t).CaptureRequest()
 }
@@ -157,27 +318,129 @@ func (x TaggedHttpMetric) CaptureResponse(t string, y *http.Response, z time.Dur
 	x.httpMetric(t).CaptureResponse(y, z)
 }
 
+// appMetrics keeps an HttpMetric for each of the most recently used
+// applications, up to a maximum number of them.
+type appMetrics struct {
+	max       int
+	evictions int64
+
+	// Most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type appMetricsEntry struct {
+	applicationId string
+	metric        *HttpMetric
+}
+
+func newAppMetrics(max int) *appMetrics {
+	return &appMetrics{
+		max:     max,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (x *appMetrics) httpMetric(applicationId string) *HttpMetric {
+	e, ok := x.entries[applicationId]
+	if ok {
+		x.lru.MoveToFront(e)
+		return e.Value.(*appMetricsEntry).metric
+	}
+
+	if x.lru.Len() >= x.max {
+		oldest := x.lru.Back()
+		x.lru.Remove(oldest)
+		delete(x.entries, oldest.Value.(*appMetricsEntry).applicationId)
+		x.evictions++
+	}
+
+	y := &appMetricsEntry{
+		applicationId: applicationId,
+		metric:        newHttpMetricWithoutRate(),
+	}
+	x.entries[applicationId] = x.lru.PushFront(y)
+
+	return y.metric
+}
+
+func (x *appMetrics) tagged() TaggedHttpMetric {
+	y := make(TaggedHttpMetric, len(x.entries))
+	for applicationId, e := range x.entries {
+		y[applicationId] = e.Value.(*appMetricsEntry).metric
+	}
+
+	return y
+}
+
+func (x *appMetrics) MarshalJSON() ([]byte, error) {
+	return json.Marshal(x.tagged())
+}
+
+// AccessLogCounter counts the records handled by an access logger.
+type AccessLogCounter interface {
+	Written() int64
+	Dropped() int64
+}
+
+// SpanCounter counts the spans handled by a span exporter.
+type SpanCounter interface {
+	Exported() int64
+	Dropped() int64
+}
+
+// Http2Counter counts the HTTP/2 connections and streams of a server.
+type Http2Counter interface {
+	Http2Conns() int
+	Http2Streams() int64
+	Http2ActiveStreams() int
+}
+
+// ConcurrencyCounter counts the requests being proxied, and those waiting to
+// be.
+type ConcurrencyCounter interface {
+	InFlight() int
+	Queued() int
+}
+
 type Varz interface {
 	json.Marshaler
 
+	SetAccessLogCounter(c AccessLogCounter)
+	SetHttp2Counter(c Http2Counter)
+	SetConcurrencyCounter(c ConcurrencyCounter)
+	SetSpanCounter(c SpanCounter)
+
 	CaptureBadRequest(req *http.Request)
 	CaptureBadGateway(req *http.Request)
+	CaptureRetry(b *route.Endpoint, req *http.Request)
+	CaptureRateLimited(req *http.Request, limited string)
+	CaptureConcurrencyLimited(req *http.Request, limited string)
 	CaptureRoutingRequest(b *route.Endpoint, req *http.Request)
 	CaptureRoutingResponse(b *route.Endpoint, res *http.Response, d time.Duration)
 }
 
 type RealVarz struct {
 	sync.Mutex
-	r *registry.Registry
+	r         *registry.Registry
+	accessLog AccessLogCounter
+	http2     Http2Counter
+	inFlight  ConcurrencyCounter
+	spans     SpanCounter
 	varz
 }
 
-func NewVarz(r *registry.Registry) Varz {
+func NewVarz(c *config.Config, r *registry.Registry) Varz {
 	x := &RealVarz{r: r}
 
 	x.All = NewHttpMetric()
 	x.Tags.Component = make(map[string]*HttpMetric)
 
+	if c.AppMetrics.Enabled {
+		x.Apps = newAppMetrics(c.AppMetrics.MaxApps)
+	}
+
 	return x
 }
 
@@ -188,6 +451,27 @@ func (x *RealVarz) MarshalJSON() ([]byte, error) {
 	x.varz.Urls = x.r.NumUris()
 	x.varz.Droplets = x.r.NumEndpoints()
 
+	if x.accessLog != nil {
+		x.varz.AccessLogRecordsWritten = x.accessLog.Written()
+		x.varz.AccessLogRecordsDropped = x.accessLog.Dropped()
+	}
+
+	if x.http2 != nil {
+		x.varz.Http2Connections = x.http2.Http2Conns()
+		x.varz.Http2Streams = x.http2.Http2Streams()
+		x.varz.Http2ActiveStreams = x.http2.Http2ActiveStreams()
+	}
+
+	if x.inFlight != nil {
+		x.varz.RequestsInFlight = x.inFlight.InFlight()
+		x.varz.RequestsQueued = x.inFlight.Queued()
+	}
+
+	if x.spans != nil {
+		x.varz.SpansExported = x.spans.Exported()
+		x.varz.SpansDropped = x.spans.Dropped()
+	}
+
 	x.varz.RequestsPerSec = x.varz.All.Rate.Rate1()
 	millis_per_nano := int64(1000000)
 	x.varz.MillisSinceLastRegistryUpdate = time.Since(x.r.TimeOfLastUpdate()).Nanoseconds() / millis_per_nano
@@ -202,6 +486,53 @@ func (x *RealVarz) MarshalJSON() ([]byte, error) {
 	return json.Marshal(d)
 }
 
+func (x *RealVarz) WriteMetrics(m *common.MetricsWriter) {
+	x.Lock()
+	defer x.Unlock()
+
+	x.varz.All.WriteMetrics(m, "")
+	x.varz.Tags.Component.WriteMetrics(m, "component_", "component")
+
+	if x.varz.Apps != nil {
+		x.varz.Apps.tagged().WriteMetrics(m, "app_", "app")
+		m.Counter("app_metrics_evictions_total", "Number of applications whose metrics were dropped to stay within max_apps.", float64(x.varz.Apps.evictions), nil)
+	}
+
+	m.Counter("bad_requests_total", "Number of requests that couldn't be routed.", float64(x.varz.BadRequests), nil)
+	m.Counter("bad_gateways_total", "Number of requests no endpoint responded to.", float64(x.varz.BadGateways), nil)
+	m.Counter("retries_total", "Number of requests retried against another endpoint.", float64(x.varz.Retries), nil)
+	m.Counter("rate_limited_total", "Number of requests rejected for going over the rate limit.", float64(x.varz.RateLimited.Clients), common.Labels{"limit": "client"})
+	m.Counter("rate_limited_total", "Number of requests rejected for going over the rate limit.", float64(x.varz.RateLimited.Routes), common.Labels{"limit": "route"})
+	m.Counter("concurrency_limited_total", "Number of requests turned away for having too many requests in flight.", float64(x.varz.ConcurrencyLimited.Router), common.Labels{"limit": "router"})
+	m.Counter("concurrency_limited_total", "Number of requests turned away for having too many requests in flight.", float64(x.varz.ConcurrencyLimited.Routes), common.Labels{"limit": "route"})
+	m.Counter("concurrency_limited_total", "Number of requests turned away for having too many requests in flight.", float64(x.varz.ConcurrencyLimited.Endpoints), common.Labels{"limit": "endpoint"})
+
+	if x.accessLog != nil {
+		m.Counter("access_log_records_written_total", "Number of records written to the access log.", float64(x.accessLog.Written()), nil)
+		m.Counter("access_log_records_dropped_total", "Number of access log records dropped because the queue was full.", float64(x.accessLog.Dropped()), nil)
+	}
+
+	if x.http2 != nil {
+		m.Gauge("http2_connections", "Number of open HTTP/2 connections from clients.", float64(x.http2.Http2Conns()), nil)
+		m.Counter("http2_streams_total", "Number of HTTP/2 streams served.", float64(x.http2.Http2Streams()), nil)
+		m.Gauge("http2_active_streams", "Number of HTTP/2 streams being served.", float64(x.http2.Http2ActiveStreams()), nil)
+	}
+
+	if x.inFlight != nil {
+		m.Gauge("requests_in_flight", "Number of requests being proxied.", float64(x.inFlight.InFlight()), nil)
+		m.Gauge("requests_queued", "Number of requests waiting for others to finish before being proxied.", float64(x.inFlight.Queued()), nil)
+	}
+
+	if x.spans != nil {
+		m.Counter("spans_exported_total", "Number of spans written by the span exporter.", float64(x.spans.Exported()), nil)
+		m.Counter("spans_dropped_total", "Number of spans dropped because the exporter's queue was full.", float64(x.spans.Dropped()), nil)
+	}
+
+	m.Gauge("urls", "Number of URIs in the routing table.", float64(x.r.NumUris()), nil)
+	m.Gauge("droplets", "Number of endpoints in the routing table.", float64(x.r.NumEndpoints()), nil)
+	m.Gauge("seconds_since_last_registry_update", "Time since the routing table last changed.", time.Since(x.r.TimeOfLastUpdate()).Seconds(), nil)
+}
+
 func (x *RealVarz) updateTop() {
 	t := time.Now().Add(-1 * time.Minute)
 	y := x.r.TopApps.TopSince(t, 10)
@@ -216,6 +547,34 @@ func (x *RealVarz) updateTop() {
 	}
 }
 
+func (x *RealVarz) SetAccessLogCounter(c AccessLogCounter) {
+	x.Lock()
+	defer x.Unlock()
+
+	x.accessLog = c
+}
+
+func (x *RealVarz) SetHttp2Counter(c Http2Counter) {
+	x.Lock()
+	defer x.Unlock()
+
+	x.http2 = c
+}
+
+func (x *RealVarz) SetConcurrencyCounter(c ConcurrencyCounter) {
+	x.Lock()
+	defer x.Unlock()
+
+	x.inFlight = c
+}
+
+func (x *RealVarz) SetSpanCounter(c SpanCounter) {
+	x.Lock()
+	defer x.Unlock()
+
+	x.spans = c
+}
+
 func (x *RealVarz) CaptureBadRequest(req *http.Request) {
 	x.Lock()
 	defer x.Unlock()
@@ -230,6 +589,43 @@ func (x *RealVarz) CaptureBadGateway(req *http.Request) {
 	x.BadGateways++
 }
 
+func (x *RealVarz) CaptureRetry(b *route.Endpoint, req *http.Request) {
+	x.Lock()
+	defer x.Unlock()
+
+	x.Retries++
+}
+
+// CaptureRateLimited counts a request rejected for going over the rate limit
+// of its route or client, as told by limited.
+func (x *RealVarz) CaptureRateLimited(req *http.Request, limited string) {
+	x.Lock()
+	defer x.Unlock()
+
+	if limited == "client" {
+		x.RateLimited.Clients++
+	} else {
+		x.RateLimited.Routes++
+	}
+}
+
+// CaptureConcurrencyLimited counts a request turned away because the router,
+// its route or its endpoints, as told by limited, had too many requests in
+// flight.
+func (x *RealVarz) CaptureConcurrencyLimited(req *http.Request, limited string) {
+	x.Lock()
+	defer x.Unlock()
+
+	switch limited {
+	case "router":
+		x.ConcurrencyLimited.Router++
+	case "route":
+		x.ConcurrencyLimited.Routes++
+	default:
+		x.ConcurrencyLimited.Endpoints++
+	}
+}
+
 func (x *RealVarz) CaptureRoutingRequest(b *route.Endpoint, req *http.Request) {
 	x.Lock()
 	defer x.Unlock()
@@ -242,6 +638,10 @@ func (x *RealVarz) CaptureRoutingRequest(b *route.Endpoint, req *http.Request) {
 		x.varz.Tags.Component.CaptureRequest(t)
 	}
 
+	if x.varz.Apps != nil && b.ApplicationId != "" {
+		x.varz.Apps.httpMetric(b.ApplicationId).CaptureRequest()
+	}
+
 	x.varz.All.CaptureRequest()
 }
 
@@ -257,6 +657,10 @@ func (x *RealVarz) CaptureRoutingResponse(endpoint *route.Endpoint, response *ht
 		x.varz.Tags.Component.CaptureResponse(tags, response, duration)
 	}
 
+	if x.varz.Apps != nil && endpoint.ApplicationId != "" {
+		x.varz.Apps.httpMetric(endpoint.ApplicationId).CaptureResponse(response, duration)
+	}
+
 	x.varz.All.CaptureResponse(response, duration)
 }
 
@@ -1,14 +1,17 @@
 package varz
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/cloudfoundry/yagnats/fakeyagnats"
 	. "launchpad.net/gocheck"
 
+	"github.com/cloudfoundry/gorouter/common"
 	"github.com/cloudfoundry/gorouter/config"
 	"github.com/cloudfoundry/gorouter/registry"
 	"github.com/cloudfoundry/gorouter/route"
@@ -22,9 +25,13 @@ type VarzSuite struct {
 var _ = Suite(&VarzSuite{})
 
 func (s *VarzSuite) SetUpTest(c *C) {
-	r := registry.NewRegistry(config.DefaultConfig(), fakeyagnats.New())
+	cfg := config.DefaultConfig()
+	cfg.AppMetrics.Enabled = true
+	cfg.AppMetrics.MaxApps = 2
+
+	r := registry.NewRegistry(cfg, fakeyagnats.New())
 	s.Registry = r
-	s.Varz = NewVarz(r)
+	s.Varz = NewVarz(cfg, r)
 }
 
 // Extract value using key(s) from JSON data
@@ -80,6 +87,9 @@ func (s *VarzSuite) TestMembersOfUniqueVarz(c *C) {
 		"requests",
 		"bad_requests",
 		"bad_gateways",
+		"retries",
+		"access_log_records_written",
+		"access_log_records_dropped",
 		"requests_per_sec",
 		"top10_app_requests",
 		"ms_since_last_registry_update",
@@ -99,6 +109,73 @@ func (s *VarzSuite) TestMembersOfUniqueVarz(c *C) {
 	}
 }
 
+type fakeAccessLogCounter struct{}
+
+func (f fakeAccessLogCounter) Written() int64 { return 5 }
+func (f fakeAccessLogCounter) Dropped() int64 { return 2 }
+
+func (s *VarzSuite) TestAccessLogCounts(c *C) {
+	c.Check(s.findValue("access_log_records_written"), Equals, float64(0))
+
+	s.Varz.SetAccessLogCounter(fakeAccessLogCounter{})
+
+	c.Check(s.findValue("access_log_records_written"), Equals, float64(5))
+	c.Check(s.findValue("access_log_records_dropped"), Equals, float64(2))
+}
+
+type fakeSpanCounter struct{}
+
+func (f fakeSpanCounter) Exported() int64 { return 9 }
+func (f fakeSpanCounter) Dropped() int64  { return 4 }
+
+func (s *VarzSuite) TestSpanCounts(c *C) {
+	c.Check(s.findValue("spans_exported"), Equals, float64(0))
+
+	s.Varz.SetSpanCounter(fakeSpanCounter{})
+
+	c.Check(s.findValue("spans_exported"), Equals, float64(9))
+	c.Check(s.findValue("spans_dropped"), Equals, float64(4))
+}
+
+type fakeHttp2Counter struct{}
+
+func (f fakeHttp2Counter) Http2Conns() int         { return 3 }
+func (f fakeHttp2Counter) Http2Streams() int64     { return 42 }
+func (f fakeHttp2Counter) Http2ActiveStreams() int { return 7 }
+
+func (s *VarzSuite) TestHttp2Counts(c *C) {
+	c.Check(s.findValue("http2_streams"), Equals, float64(0))
+
+	s.Varz.SetHttp2Counter(fakeHttp2Counter{})
+
+	c.Check(s.findValue("http2_connections"), Equals, float64(3))
+	c.Check(s.findValue("http2_streams"), Equals, float64(42))
+	c.Check(s.findValue("http2_active_streams"), Equals, float64(7))
+}
+
+type fakeConcurrencyCounter struct{}
+
+func (f fakeConcurrencyCounter) InFlight() int { return 12 }
+func (f fakeConcurrencyCounter) Queued() int   { return 4 }
+
+func (s *VarzSuite) TestConcurrencyCounts(c *C) {
+	c.Check(s.findValue("requests_in_flight"), Equals, float64(0))
+
+	s.Varz.SetConcurrencyCounter(fakeConcurrencyCounter{})
+
+	c.Check(s.findValue("requests_in_flight"), Equals, float64(12))
+	c.Check(s.findValue("requests_queued"), Equals, float64(4))
+
+	r := &http.Request{}
+	s.CaptureConcurrencyLimited(r, "router")
+	s.CaptureConcurrencyLimited(r, "endpoint")
+	s.CaptureConcurrencyLimited(r, "endpoint")
+
+	c.Check(s.findValue("concurrency_limited", "router"), Equals, float64(1))
+	c.Check(s.findValue("concurrency_limited", "routes"), Equals, float64(0))
+	c.Check(s.findValue("concurrency_limited", "endpoints"), Equals, float64(2))
+}
+
 func (s *VarzSuite) TestSecondsSinceLastRegistryUpdate(c *C) {
 	s.Registry.Register("foo", &route.Endpoint{})
 
@@ -147,6 +224,28 @@ func (s *VarzSuite) TestUpdateBadGateways(c *C) {
 	c.Check(s.findValue("bad_gateways"), Equals, float64(2))
 }
 
+func (s *VarzSuite) TestUpdateRetries(c *C) {
+	b := &route.Endpoint{}
+	r := &http.Request{}
+
+	s.CaptureRetry(b, r)
+	c.Check(s.findValue("retries"), Equals, float64(1))
+
+	s.CaptureRetry(b, r)
+	c.Check(s.findValue("retries"), Equals, float64(2))
+}
+
+func (s *VarzSuite) TestUpdateRateLimited(c *C) {
+	r := &http.Request{}
+
+	s.CaptureRateLimited(r, "client")
+	s.CaptureRateLimited(r, "route")
+	s.CaptureRateLimited(r, "route")
+
+	c.Check(s.findValue("rate_limited", "clients"), Equals, float64(1))
+	c.Check(s.findValue("rate_limited", "routes"), Equals, float64(2))
+}
+
 func (s *VarzSuite) TestUpdateRequests(c *C) {
 	b := &route.Endpoint{}
 	r := http.Request{}
@@ -231,6 +330,54 @@ func (s *VarzSuite) TestUpdateResponseWithTags(c *C) {
 	c.Check(s.findValue("tags", "component", "cc", "responses_4xx"), Equals, float64(2))
 }
 
+func (s *VarzSuite) TestUpdateGrpcResponse(c *C) {
+	b := &route.Endpoint{ApplicationId: "app1"}
+	var d time.Duration
+
+	grpcResponse := func(status string) *http.Response {
+		r := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/grpc+proto"}},
+			Trailer:    http.Header{},
+		}
+
+		if status != "" {
+			r.Trailer.Set("Grpc-Status", status)
+		}
+
+		return r
+	}
+
+	// Trailers-only responses carry their status in the headers
+	headersOnly := grpcResponse("")
+	headersOnly.Header.Set("Grpc-Status", "5")
+
+	s.CaptureRoutingResponse(b, grpcResponse("0"), d)
+	s.CaptureRoutingResponse(b, grpcResponse("14"), d)
+	s.CaptureRoutingResponse(b, grpcResponse("14"), d)
+	s.CaptureRoutingResponse(b, grpcResponse(""), d)
+	s.CaptureRoutingResponse(b, headersOnly, d)
+
+	// Failing at the HTTP level counts by HTTP status
+	failed := grpcResponse("")
+	failed.StatusCode = http.StatusServiceUnavailable
+	s.CaptureRoutingResponse(b, failed, d)
+
+	c.Check(s.findValue("grpc_responses", "OK"), Equals, float64(1))
+	c.Check(s.findValue("grpc_responses", "UNAVAILABLE"), Equals, float64(2))
+	c.Check(s.findValue("grpc_responses", "UNKNOWN"), Equals, float64(1))
+	c.Check(s.findValue("grpc_responses", "NOT_FOUND"), Equals, float64(1))
+	c.Check(s.findValue("responses_2xx"), Equals, float64(0))
+	c.Check(s.findValue("responses_5xx"), Equals, float64(1))
+
+	var buf bytes.Buffer
+	m := common.NewMetricsWriter(&buf, "router")
+	s.Varz.(common.MetricsCollector).WriteMetrics(m)
+	m.Flush()
+
+	c.Check(strings.Contains(buf.String(), "\nrouter_grpc_responses_total{code=\"UNAVAILABLE\"} 2\n"), Equals, true)
+}
+
 func (s *VarzSuite) TestUpdateResponseLatency(c *C) {
 	var routeEndpoint *route.Endpoint = &route.Endpoint{}
 	var duration = 1 * time.Millisecond
@@ -247,3 +394,84 @@ func (s *VarzSuite) TestUpdateResponseLatency(c *C) {
 	c.Check(s.findValue("latency", "95").(float64), Equals, float64(duration)/float64(time.Second))
 	c.Check(s.findValue("latency", "99").(float64), Equals, float64(duration)/float64(time.Second))
 }
+
+func (s *VarzSuite) TestUpdateResponseWithApplicationId(c *C) {
+	b := &route.Endpoint{ApplicationId: "app1"}
+
+	s.Varz.CaptureRoutingRequest(b, &http.Request{})
+	s.CaptureRoutingResponse(b, &http.Response{StatusCode: http.StatusBadGateway}, time.Millisecond)
+
+	c.Check(s.findValue("apps", "app1", "requests"), Equals, float64(1))
+	c.Check(s.findValue("apps", "app1", "responses_5xx"), Equals, float64(1))
+	c.Check(s.findValue("apps", "app1", "latency", "50"), Equals, 0.001)
+
+	// Meters can't be released when an application is dropped
+	app := s.findValue("apps", "app1").(map[string]interface{})
+	c.Check(app["rate"], IsNil)
+	c.Check(s.Varz.(*RealVarz).Apps.entries["app1"].Value.(*appMetricsEntry).metric.Rate, IsNil)
+}
+
+func (s *VarzSuite) TestApplicationMetricsAreLimited(c *C) {
+	for _, id := range []string{"app1", "app2", "app1", "app3"} {
+		s.Varz.CaptureRoutingRequest(&route.Endpoint{ApplicationId: id}, &http.Request{})
+	}
+
+	apps := s.findValue("apps").(map[string]interface{})
+	c.Check(apps, HasLen, 2)
+
+	// app2 was used least recently
+	c.Check(apps["app1"], NotNil)
+	c.Check(apps["app3"], NotNil)
+}
+
+func (s *VarzSuite) TestApplicationMetricsAreDisabledByDefault(c *C) {
+	v := NewVarz(config.DefaultConfig(), s.Registry)
+	v.CaptureRoutingRequest(&route.Endpoint{ApplicationId: "app1"}, &http.Request{})
+
+	b, err := json.Marshal(v)
+	c.Assert(err, IsNil)
+	c.Check(strings.Contains(string(b), `"apps"`), Equals, false)
+}
+
+func (s *VarzSuite) TestWriteMetrics(c *C) {
+	b := &route.Endpoint{
+		ApplicationId: "app1",
+		Tags: map[string]string{
+			"component": "cc",
+		},
+	}
+
+	s.Registry.Register("foo", &route.Endpoint{Host: "1.2.3.4", Port: 1234})
+
+	s.Varz.CaptureRoutingRequest(b, &http.Request{})
+	s.CaptureRoutingResponse(b, &http.Response{StatusCode: http.StatusOK}, 20*time.Millisecond)
+	s.Varz.CaptureBadGateway(&http.Request{})
+
+	var buf bytes.Buffer
+	m := common.NewMetricsWriter(&buf, "router")
+	s.Varz.(common.MetricsCollector).WriteMetrics(m)
+	m.Flush()
+
+	lines := []string{
+		`router_requests_total 1`,
+		`router_responses_total{status="2xx"} 1`,
+		`router_responses_total{status="5xx"} 0`,
+		`router_latency_seconds_bucket{le="0.01"} 0`,
+		`router_latency_seconds_bucket{le="0.025"} 1`,
+		`router_latency_seconds_count 1`,
+		`router_component_requests_total{component="cc"} 1`,
+		`router_component_responses_total{component="cc",status="2xx"} 1`,
+		`router_component_latency_seconds_count{component="cc"} 1`,
+		`router_app_requests_total{app="app1"} 1`,
+		`router_app_responses_total{app="app1",status="2xx"} 1`,
+		`router_app_latency_seconds_count{app="app1"} 1`,
+		`router_app_metrics_evictions_total 0`,
+		`router_bad_gateways_total 1`,
+		`router_urls 1`,
+		`router_droplets 1`,
+	}
+
+	for _, line := range lines {
+		c.Check(strings.Contains(buf.String(), "\n"+line+"\n"), Equals, true, Commentf("missing %s", line))
+	}
+}